@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A named airway, as an ordered sequence of fixes.
+type Airway struct {
+	Name		string
+	Fixes		Locations
+	Segments	[]AirwaySegment // Segments[i] joins Fixes[i] to Fixes[i+1]
+}
+
+type Airways []Airway
+
+// Restrictions on one airway segment.
+type AirwaySegment struct {
+	Direction	string // F forward only, B backward only, blank for both
+	Level		string // B both, H high, L low, blank if not given
+	MinAlt		string // ft or flight level, as given
+	MaxAlt		string
+}
+
+// Whether the segment may be flown at the given level, H or L, where a blank
+// level allows every segment.
+func (seg AirwaySegment) AllowsLevel(level string) bool {
+	return len(level) == 0 || len(seg.Level) == 0 || seg.Level == "B" ||
+		seg.Level == level
+}
+
+// Airways from the csv file in the data directory, if present, and from the
+// ER records of any ARINC 424 files.  Fixes are looked up in locs.
+func LoadAirways(datapath string, locs Locations) Airways {
+	airways := Airways([]Airway{})
+	path := filepath.Join(datapath, AIRWAYS_CSV_NAME)
+	if fileExists(path) {
+		airways = append(airways, ReadAirwaysFile(path, locs)...)
+		Println("Parsed %d airways in %s", len(airways), path)
+	}
+	filenames, err := getFilesBySuffix(datapath, ARINC_FILE_SUFFIX)
+	ifError(err)
+	for _, filename := range filenames {
+		_, fixes := ReadARINC424(filename)
+		airways2 := AirwaysFromARINC(fixes, locs)
+		Println("Parsed %d airways in %s", len(airways2), filename)
+		airways = append(airways, airways2...)
+	}
+	return airways
+}
+
+// Lines "airway,seq,label,direction,level,minalt,maxalt", where label is as
+// for FindBy and the restrictions apply to the segment to the next fix.  A
+// fix not found breaks the airway, as the segments either side of it cannot
+// be flown without it.
+func ReadAirwaysFile(fpath string, locs Locations) Airways {
+	file, err := os.Open(fpath)
+	ifError(err)
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	lines, err := reader.ReadAll()
+	ifError(err)
+	type row struct {
+		seq		int
+		loc		Location
+		seg		AirwaySegment
+		missing	bool
+	}
+	rows := map[string][]row{}
+	names := []string{}
+	for i, fields := range lines {
+		if len(fields) < 3 {
+			Fatal("%s line %d: need at least airway, seq and label", fpath, i+1)
+		}
+		for len(fields) < 7 {
+			fields = append(fields, "")
+		}
+		for j := range fields {
+			fields[j] = strings.TrimSpace(fields[j])
+		}
+		seq, err := strconv.Atoi(fields[1])
+		if err != nil {
+			Fatal("%s line %d: bad sequence %q", fpath, i+1, fields[1])
+		}
+		loc, exist, _ := locs.FindBy(fields[2])
+		if !exist {
+			Println("%s line %d: no location %q, airway broken there", fpath,
+				i+1, fields[2])
+		}
+		if _, ok := rows[fields[0]]; !ok {
+			names = append(names, fields[0])
+		}
+		rows[fields[0]] = append(rows[fields[0]], row{
+			seq:	seq,
+			loc:	loc,
+			seg:	AirwaySegment{
+				Direction:	fields[3],
+				Level:		fields[4],
+				MinAlt:		fields[5],
+				MaxAlt:		fields[6],
+			},
+			missing:	!exist,
+		})
+	}
+	result := Airways([]Airway{})
+	for _, name := range names {
+		sort.SliceStable(rows[name], func(i, j int) bool {
+			return rows[name][i].seq < rows[name][j].seq
+		})
+		aw := Airway{Name: name}
+		finish := func() {
+			// The last fix starts no segment
+			if len(aw.Fixes) > 1 {
+				aw.Segments = aw.Segments[:len(aw.Fixes)-1]
+				result = append(result, aw)
+			}
+			aw = Airway{Name: name}
+			return
+		}
+		for _, r := range rows[name] {
+			if r.missing {
+				finish()
+				continue
+			}
+			aw.Fixes = append(aw.Fixes, r.loc)
+			aw.Segments = append(aw.Segments, r.seg)
+		}
+		finish()
+	}
+	return result
+}
+
+// Airways from ARINC 424 ER records in file order.  Fixes are matched on
+// identifier and ICAO region, and a description code ending an airway
+// ("E" in its second place) breaks the route into separate pieces.
+func AirwaysFromARINC(fixes []ARINCAirwayFix, locs Locations) Airways {
+	byIdent := map[string]int{}
+	for i, loc := range locs {
+		if len(loc.ICAOcode) > 0 {
+			key := loc.ICAOcode + "/" + loc.Region
+			if _, ok := byIdent[key]; !ok {
+				byIdent[key] = i
+			}
+		}
+	}
+	result := Airways([]Airway{})
+	aw := Airway{}
+	finish := func() {
+		if len(aw.Fixes) > 1 {
+			aw.Segments = aw.Segments[:len(aw.Fixes)-1]
+			result = append(result, aw)
+		}
+		aw = Airway{}
+		return
+	}
+	missing := 0
+	for _, fix := range fixes {
+		if fix.Route != aw.Name {
+			finish()
+			aw.Name = fix.Route
+		}
+		i, ok := byIdent[fix.Fix + "/" + fix.Region]
+		if !ok {
+			// A gap in the data also breaks the airway
+			missing++
+			finish()
+			aw.Name = fix.Route
+			continue
+		}
+		aw.Fixes = append(aw.Fixes, locs[i])
+		aw.Segments = append(aw.Segments, AirwaySegment{
+			Direction:	fix.Direction,
+			Level:		fix.Level,
+			MinAlt:		fix.MinAlt,
+			MaxAlt:		fix.MaxAlt,
+		})
+		if len(fix.Desc) > 1 && fix.Desc[1] == 'E' {
+			finish()
+			aw.Name = fix.Route
+		}
+	}
+	finish()
+	if missing > 0 {
+		Println("%d airway fixes not found among locations", missing)
+	}
+	return result
+}
+
+// Edge in the route graph, from a location to locs[To].
+type RouteEdge struct {
+	To		int
+	Dist	float64 // rad
+	Airway	string // blank for a direct-to leg
+}
+
+// Most direct-to legs from each location, to the nearest, since otherwise
+// the number of legs grows as the square of directmax where locations are
+// dense.  Longer direct-to legs there are near enough made up of shorter.
+const MAX_DIRECT_EDGES int = 50
+
+// Directed graph over Locations, with airway segments and direct-to legs as
+// edges.
+type RouteGraph struct {
+	Locs	Locations
+	Edges	[][]RouteEdge // by index into Locs
+}
+
+// Build the graph from airway segments allowed at level (H, L or blank for
+// any), adding direct-to legs from each location to those no more than
+// directmax km away, if directmax is positive, up to the MAX_DIRECT_EDGES
+// nearest.  Airway fixes are matched to
+// locs exactly, or else to the nearest location within 2 km, since culling
+// redundancies may have replaced them.
+func (locs Locations) BuildRouteGraph(airways Airways, directmax float64, level string) *RouteGraph {
+	g := &RouteGraph{Locs: locs, Edges: make([][]RouteEdge, len(locs))}
+	idx := locs.Index(QUERY_GRID_CELL)
+	exact := map[Location]int{}
+	for i, loc := range locs {
+		exact[loc] = i
+	}
+	find := func(loc Location) (int, bool) {
+		if i, ok := exact[loc]; ok {
+			return i, true
+		}
+		nbs := idx.WithinRadius(loc, 2.0)
+		if len(nbs) > 0 {
+			return nbs[0].Index, true
+		}
+		return 0, false
+	}
+	nairway := 0
+	for _, aw := range airways {
+		for k, seg := range aw.Segments {
+			if !seg.AllowsLevel(level) {
+				continue
+			}
+			i, ok1 := find(aw.Fixes[k])
+			j, ok2 := find(aw.Fixes[k+1])
+			if !ok1 || !ok2 || i == j {
+				continue
+			}
+			dist := locs[i].ToCartesianVector().AngleWith(
+				locs[j].ToCartesianVector())
+			if seg.Direction != "B" {
+				g.addEdge(i, RouteEdge{To: j, Dist: dist, Airway: aw.Name})
+				nairway++
+			}
+			if seg.Direction != "F" {
+				g.addEdge(j, RouteEdge{To: i, Dist: dist, Airway: aw.Name})
+				nairway++
+			}
+		}
+	}
+	ndirect, ncapped := 0, 0
+	if directmax > 0 {
+		for i, loc := range locs {
+			// Widen the search only until enough are found
+			var nbs Neighbours
+			for km := math.Min(100.0, directmax); ; km = math.Min(2.0*km, directmax) {
+				nbs = idx.WithinRadius(loc, km)
+				if len(nbs) > MAX_DIRECT_EDGES || km >= directmax {
+					break
+				}
+			}
+			n := 0
+			for _, nb := range nbs {
+				if nb.Index == i {
+					continue
+				}
+				if n == MAX_DIRECT_EDGES {
+					ncapped++
+					break
+				}
+				g.addEdge(i, RouteEdge{To: nb.Index, Dist: DistToRad(nb.Dist)})
+				n++
+			}
+			ndirect += n
+		}
+	}
+	Println("Route graph has %d airway and %d direct-to edges", nairway, ndirect)
+	if ncapped > 0 {
+		Println("Direct-to legs limited to the nearest %d at %d locations",
+			MAX_DIRECT_EDGES, ncapped)
+	}
+	return g
+}
+
+// Add an edge, unless there is already one to the same location on the same
+// airway.
+func (g *RouteGraph) addEdge(from int, e RouteEdge) {
+	for _, e2 := range g.Edges[from] {
+		if e2.To == e.To && e2.Airway == e.Airway {
+			return
+		}
+	}
+	g.Edges[from] = append(g.Edges[from], e)
+	return
+}
+
+// Connected locations, From and To being a direction the pair may be flown,
+// and Both whether it may also be flown the other way.
+type RoutePair struct {
+	From, To	int
+	Both		bool
+}
+
+// Each pair of connected locations once.
+func (g *RouteGraph) Pairs() []RoutePair {
+	joined := map[[2]int]bool{}
+	for i, edges := range g.Edges {
+		for _, e := range edges {
+			joined[[2]int{i, e.To}] = true
+		}
+	}
+	seen := map[[2]int]bool{}
+	result := []RoutePair{}
+	for i, edges := range g.Edges {
+		for _, e := range edges {
+			pair := [2]int{i, e.To}
+			if e.To < i {
+				pair = [2]int{e.To, i}
+			}
+			if !seen[pair] {
+				seen[pair] = true
+				back := joined[[2]int{e.To, i}]
+				result = append(result, RoutePair{From: i, To: e.To, Both: back})
+			}
+		}
+	}
+	return result
+}
+
+// As FindPairsPassingWithinRadius, but only for pairs joined in the graph,
+// flown only in the directions their edges go.  Filters try the direction
+// given first, so a one way pair is dropped only if flying it the right way
+// does not fit.
+func (g *RouteGraph) FindFlybys(filters []FlybyFilter) []Flyby {
+	pairs := g.Pairs()
+	nproc := len(filters)
+	Println("Testing %d connected pairs", len(pairs))
+	ch := make(chan []Flyby)
+	for i := 0; i < nproc; i++ {
+		k1 := i*len(pairs)/nproc
+		k2 := (i+1)*len(pairs)/nproc
+		go func(pairs []RoutePair, filter FlybyFilter) {
+			result := []Flyby{}
+			for _, pair := range pairs {
+				fits, _, fb := filter.NearestApproach(
+					g.Locs[pair.From], g.Locs[pair.To])
+				if fits && (pair.Both || fb.Loc1 == g.Locs[pair.From]) {
+					result = append(result, *fb)
+				}
+			}
+			ch <- result
+		}(pairs[k1:k2], filters[i])
+	}
+	results := []Flyby{}
+	for i := 0; i < nproc; i++ {
+		results = append(results, <-ch...)
+	}
+	return results
+}
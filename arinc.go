@@ -0,0 +1,295 @@
+/*
+	Parse ARINC 424 navigation data, e.g. the FAA CIFP, for the records:
+	EA enroute waypoints, D VHF navaids, DB NDB navaids, PA airports and
+	ER enroute airways.  Files are 132 column fixed width text.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// One fix along an enroute airway (ER record), in sequence.
+type ARINCAirwayFix struct {
+	Route		string
+	Seq			int
+	Fix			string
+	Region		string // ICAO region code of the fix
+	Section		string // section and subsection of the fix record, e.g. "EA"
+	Desc		string // waypoint description code
+	Level		string // B both, H high, L low
+	Direction	string // F forward, B backward, blank for both
+	MinAlt		string // ft or flight level, as given
+	MaxAlt		string
+}
+
+var ARINC_WAYPOINT_KIND map[string]string = map[string]string{
+	"C": "Intersection/RNAV",
+	"I": "Unnamed intersection",
+	"N": "NDB",
+	"R": "Intersection",
+	"U": "Uncharted intersection",
+	"V": "VFR",
+	"W": "RNAV",
+}
+
+var ARINC_LEVEL map[string]string = map[string]string{
+	"B": "Both",
+	"H": "High",
+	"L": "Low",
+	"T": "Terminal",
+	"U": "Undefined",
+}
+
+// Text in the given 1-based, inclusive columns, trimmed.
+func arincField(line string, from, to int) string {
+	if from > len(line) {
+		return ""
+	}
+	if to > len(line) {
+		to = len(line)
+	}
+	return strings.TrimSpace(line[from-1:to])
+}
+
+// As arincField, but untrimmed and padded, for fields where position matters.
+func arincRaw(line string, from, to int) string {
+	for len(line) < to {
+		line += " "
+	}
+	return line[from-1:to]
+}
+
+// Section and subsection, which for airports is held in column 13.
+func arincSection(line string) string {
+	sec := arincField(line, 5, 5)
+	if sec == "P" || sec == "H" {
+		return sec + arincField(line, 13, 13)
+	}
+	return sec + arincField(line, 6, 6)
+}
+
+// Packed latitude "N03281400" or longitude "E072500900", as deg, min, sec
+// and hundredths of a second.
+func parseARINCLatLong(txt string) (float64, bool) {
+	if len(txt) != 9 && len(txt) != 10 {
+		return 0.0, false
+	}
+	n := len(txt) - 6 // end of degrees
+	dir := txt[:1]
+	if dir != "N" && dir != "S" && dir != "E" && dir != "W" {
+		return 0.0, false
+	}
+	deg, err1 := strconv.Atoi(txt[1:n])
+	min, err2 := strconv.Atoi(txt[n:n+2])
+	sec, err3 := strconv.Atoi(txt[n+2:])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0.0, false
+	}
+	result := float64(deg) + float64(min)/60.0 + float64(sec)/360000.0
+	if dir == "S" || dir == "W" {
+		result = -result
+	}
+	return result, true
+}
+
+func arincNumber(line string, from, to int) float64 {
+	result, err := strconv.ParseFloat(arincField(line, from, to), 64)
+	if err != nil {
+		return 0.0
+	}
+	return result
+}
+
+func ReadARINC424(fpath string) (Locations, []ARINCAirwayFix) {
+	byts, err := ioutil.ReadFile(fpath)
+	ifError(err)
+	lines := strings.Split(string(byts), "\n")
+	locs := Locations([]Location{})
+	fixes := []ARINCAirwayFix{}
+	skipped := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		// Standard and tailored records only, no headers
+		if len(line) < 50 || (line[0] != 'S' && line[0] != 'T') {
+			continue
+		}
+		var loc Location
+		ok := true
+		switch arincSection(line) {
+			case "EA":
+				loc, ok = parseARINCWaypoint(line)
+			case "D":
+				loc, ok = parseARINCVHFNavaid(line)
+			case "DB":
+				loc, ok = parseARINCNDB(line)
+			case "PA":
+				loc, ok = parseARINCAirport(line)
+			case "ER":
+				// Primary records only
+				if cont := arincField(line, 39, 39); cont == "0" || cont == "1" {
+					fixes = append(fixes, parseARINCAirwayFix(line))
+				}
+				continue
+			default:
+				continue
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		if len(loc.Type) > 0 {
+			locs = append(locs, loc)
+		}
+	}
+	if skipped > 0 {
+		Println("Skipped %d records with bad coordinates in %s", skipped, fpath)
+	}
+	return locs, fixes
+}
+
+// Primary records are numbered 0 or 1, continuation records carry no position
+// and are returned as a Location with no Type.
+func arincPrimary(line string) bool {
+	cont := arincField(line, 22, 22)
+	return cont == "0" || cont == "1"
+}
+
+func arincLatLong(line string, latcol, longcol int) (float64, float64, bool) {
+	lat, ok1 := parseARINCLatLong(arincField(line, latcol, latcol+8))
+	long, ok2 := parseARINCLatLong(arincField(line, longcol, longcol+9))
+	return lat, long, ok1 && ok2
+}
+
+func parseARINCWaypoint(line string) (Location, bool) {
+	if !arincPrimary(line) {
+		return Location{}, true
+	}
+	lat, long, ok := arincLatLong(line, 33, 42)
+	typ := arincField(line, 27, 27)
+	kind, known := ARINC_WAYPOINT_KIND[typ]
+	if !known {
+		kind = typ
+	}
+	control := ARINC_LEVEL[arincField(line, 31, 31)]
+	if arincField(line, 7, 10) != "ENRT" {
+		control = ARINC_LEVEL["T"]
+	}
+	return Location{
+		Type:		LOCTYPE["Waypoint"].Tag,
+		ICAOcode:	arincField(line, 14, 18),
+		Region:		arincField(line, 20, 21),
+		Kind:		kind,
+		Control:	control,
+		Name:		arincField(line, 99, 123),
+		Lat:		lat,
+		Long:		long,
+	}, ok
+}
+
+func parseARINCVHFNavaid(line string) (Location, bool) {
+	if !arincPrimary(line) {
+		return Location{}, true
+	}
+	class := arincRaw(line, 28, 32)
+	var kind string
+	switch {
+		case class[0] == 'V' && class[1] == 'D': kind = "VOR-DME"
+		case class[0] == 'V' && (class[1] == 'T' || class[1] == 'M'):
+			kind = "VORTAC"
+		case class[0] == 'V': kind = "VOR"
+		case class[1] == 'D': kind = "DME"
+		case class[1] == 'T' || class[1] == 'M': kind = "TACAN"
+		case class[1] == 'I': kind = "ILS-DME"
+		default: kind = strings.TrimSpace(class)
+	}
+	// DME only stations have no VOR position
+	lat, long, ok := arincLatLong(line, 33, 42)
+	if !ok && len(arincField(line, 33, 51)) == 0 {
+		lat, long, ok = arincLatLong(line, 56, 65)
+	}
+	return Location{
+		Type:		LOCTYPE["Waypoint"].Tag,
+		ICAOcode:	arincField(line, 14, 17),
+		Region:		arincField(line, 20, 21),
+		Kind:		kind,
+		Control:	ARINC_LEVEL[class[2:3]],
+		Name:		arincField(line, 94, 123),
+		Frequency:	arincNumber(line, 23, 27)*10.0, // MHz/100 -> kHz
+		Elevation:	arincNumber(line, 80, 84),
+		Lat:		lat,
+		Long:		long,
+	}, ok
+}
+
+func parseARINCNDB(line string) (Location, bool) {
+	if !arincPrimary(line) {
+		return Location{}, true
+	}
+	lat, long, ok := arincLatLong(line, 33, 42)
+	kind := "NDB"
+	switch arincField(line, 28, 28) {
+		case "S": kind = "SABH"
+		case "M": kind = "Marine beacon"
+	}
+	return Location{
+		Type:		LOCTYPE["Waypoint"].Tag,
+		ICAOcode:	arincField(line, 14, 17),
+		Region:		arincField(line, 20, 21),
+		Kind:		kind,
+		Name:		arincField(line, 94, 123),
+		Frequency:	arincNumber(line, 23, 27)/10.0, // kHz/10 -> kHz
+		Lat:		lat,
+		Long:		long,
+	}, ok
+}
+
+func parseARINCAirport(line string) (Location, bool) {
+	if !arincPrimary(line) {
+		return Location{}, true
+	}
+	lat, long, ok := arincLatLong(line, 33, 42)
+	return Location{
+		Type:			LOCTYPE["Airport"].Tag,
+		Kind:			"Airport",
+		ICAOcode:		arincField(line, 7, 10),
+		Region:			arincField(line, 11, 12),
+		IATAcode:		arincField(line, 14, 16),
+		Name:			arincField(line, 94, 123),
+		RunwayLength:	arincNumber(line, 28, 30)*100.0,
+		Elevation:		arincNumber(line, 57, 61),
+		Lat:			lat,
+		Long:			long,
+	}, ok
+}
+
+func parseARINCAirwayFix(line string) ARINCAirwayFix {
+	seq, _ := strconv.Atoi(arincField(line, 26, 29))
+	return ARINCAirwayFix{
+		Route:		arincField(line, 14, 18),
+		Seq:		seq,
+		Fix:		arincField(line, 30, 34),
+		Region:		arincField(line, 35, 36),
+		Section:	arincField(line, 37, 37) + arincField(line, 38, 38),
+		Desc:		arincField(line, 40, 43),
+		Level:		arincField(line, 46, 46),
+		Direction:	arincField(line, 47, 47),
+		MinAlt:		arincField(line, 84, 88),
+		MaxAlt:		arincField(line, 94, 98),
+	}
+}
+
+// Locations from every ARINC 424 file in the data directory.
+func LoadARINCData(datapath string) Locations {
+	locs := Locations([]Location{})
+	filenames, err := getFilesBySuffix(datapath, ARINC_FILE_SUFFIX)
+	ifError(err)
+	Println("Parsing %d ARINC 424 files", len(filenames))
+	for _, filename := range filenames {
+		locs2, _ := ReadARINC424(filename)
+		locs = append(locs, locs2...)
+	}
+	return locs
+}
@@ -8,22 +8,57 @@ import (
 
 // Command line args/option invocations
 var cmdDownload bool
+var cmdRefresh bool
 var cmdHelp bool
 var cmdTest string
 var cmdFind string
 var cmdRaw bool
 var cmdNear string
 var cmdDelta float64
+var cmdCircle bool
+var cmdNearest int
 var cmdMake bool
 var cmdPath string
+var cmdScenario string
+var cmdSources string
+var cmdPrefer string
+var cmdConflict float64
+var cmdRoute string
+var cmdVia string
+var cmdLeg float64
+var cmdViaDelta float64
+var cmdModel string
+var cmdGeo string
+var cmdPathModel string
+var cmdDR string
+var cmdDRHeading string
+var cmdDRLength float64
+var cmdDRWidth float64
 
 const (
 	DATA_DIR string = "data"
+	TESTDATA_DIR string = "testdata"
 	NATION_INDEX_NAME string = "nations.dat"
 	ADDITIONAL_LOCATIONS_NAME string = "locations_supplementary.csv"
+	USER_LOCATIONS_NAME string = "locations_user.csv"
+	MERGE_CONFLICTS_NAME string = "merge_conflicts.csv"
 	RESULT_NAME string = "result.csv"
+	RESULT_SCENARIO_NAME string = "result_scenario.json"
+	SCENARIO_DATE_FORMAT string = "2006-01-02"
+	DOWNLOAD_MANIFEST_NAME string = "download_manifest.json"
 	LOCATION_CSV_NAME string = "locations_native.csv"
+	NATIVE_VERSION_TAG string = "#version"
+	NATIVE_FORMAT_VERSION int = 2
 	TRACK_CSV_NAME string = "locations_track.csv"
+	AIRWAYS_CSV_NAME string = "airways.csv"
+	OA_AIRPORTS_NAME string = "airports.csv"
+	OA_NAVAIDS_NAME string = "navaids.csv"
+	OA_RUNWAYS_NAME string = "runways.csv"
+	ARINC_FILE_SUFFIX string = ".424"
+	XPLANE_FIX_NAME string = "earth_fix.dat"
+	XPLANE_NAV_NAME string = "earth_nav.dat"
+	XPLANE_APT_NAME string = "apt.dat"
+	WMM_COF_NAME string = "WMM.COF"
 	BASE_ADDRESS string = "http://www.fallingrain.com/world/"
 	US_STATES string = "AL AK AZ AR CA CO CT DE DC FL GA HI ID IL IN IA KS KY LA ME MT NE NV NH NJ NM NY NC ND OH OK OR MD MA MI MN MS MO PA RI SC SD TN TX UT VT VA WA WV WI WY"
 	AIRPORT_TAG string = "airports"
@@ -40,13 +75,31 @@ func init() {
 	// Command line args/options
 	flag.BoolVar(&cmdHelp, "help", false, "display this info")
 	flag.BoolVar(&cmdDownload, "w", false, "download html files from http://www.fallingrain.com")
+	flag.BoolVar(&cmdRefresh, "refresh", false, "with -w, ask the server whether files already downloaded have changed")
 	flag.StringVar(&cmdTest, "t", "", "perform ad-hoc test identified by name")
 	flag.StringVar(&cmdFind, "f", "", "find location with given regex for name or code")
 	flag.BoolVar(&cmdRaw, "r", false, "use raw data")
 	flag.StringVar(&cmdNear, "n", "", "find location with given label within square of half-length given by -d in m")
 	flag.Float64Var(&cmdDelta, "d", 0.0, "offset value used by other commands")
+	flag.BoolVar(&cmdCircle, "c", false, "with -n, search a circle of radius -d in m rather than a square")
+	flag.IntVar(&cmdNearest, "k", 0, "with -n, find the given number of nearest locations")
 	flag.BoolVar(&cmdMake, "m", false, "make native location data file in csv format")
 	flag.StringVar(&cmdPath, "p", "", "provide info on path specified by comma separated list of locations")
+	flag.StringVar(&cmdScenario, "s", "", "read flyby search scenario from given JSON file")
+	flag.StringVar(&cmdRoute, "route", "", "find the -k shortest routes between comma separated origin and destination")
+	flag.StringVar(&cmdVia, "via", "", "with -route, comma separated list of locations the route must pass near, in order")
+	flag.Float64Var(&cmdLeg, "leg", 0.0, "with -route, maximum leg length in km")
+	flag.Float64Var(&cmdViaDelta, "viad", 10.0, "with -via, distance in km within which the route must pass")
+	flag.StringVar(&cmdModel, "model", "sphere", "geodesy model for distances and nearest approaches: sphere or wgs84")
+	flag.StringVar(&cmdPathModel, "pathmodel", "greatcircle", "how paths between locations are flown: greatcircle or rhumb")
+	flag.StringVar(&cmdDR, "dr", "", "list locations passed near by tracks through the given location, ahead and behind")
+	flag.StringVar(&cmdDRHeading, "drh", "0,360", "with -dr, heading range from,to in deg clockwise from north")
+	flag.Float64Var(&cmdDRLength, "drlen", 2000.0, "with -dr, length in km of track ahead and behind")
+	flag.Float64Var(&cmdDRWidth, "drw", 10.0, "with -dr, distance in km from the track within which locations are listed")
+	flag.StringVar(&cmdGeo, "geo", "", "geodesy operation on the remaining args: distance, destination, intermediate, midpoint, crosstrack, intersection, sun")
+	flag.StringVar(&cmdSources, "src", "fallingrain,supplementary", "comma separated list of location data sources, the first taking priority: fallingrain, ourairports, arinc, xplane, supplementary, user")
+	flag.StringVar(&cmdPrefer, "prefer", "", "with -src, sources to prefer for particular fields when merging, e.g. coords=arinc,ourairports;frequency=xplane")
+	flag.Float64Var(&cmdConflict, "conflict", 0.5, "with -src, distance in km between sources' coordinates for a merged location to be reported")
 	// Fill out location types
 	for _, typ := range LOCTYPE {
 		typ.SourceSuffix = "/" + strings.ToLower(typ.Plural) + ".html"
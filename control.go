@@ -1,29 +1,94 @@
 package main
 
-func (locs Locations) MakeUserFilters() []FlybyFilter {
-	// Now for some great circles
-	label := "Name:Kudahuvadhoo"
-	loc3, exist, _ := locs.FindBy(label)
-	if !exist {
-		Fatal("Could not find location using %q", label)
-	}
-	amax := 4000.0 // km
-	bmax := 2000.0 // km
-	cmax := 2000.0 // km
-	dmax := 0.5 //0.75 // km
-	heading := []float64{-45.0,0}//-45.0-22.5, 22.5} // deg from north
+import (
+	"time"
+)
 
-	nproc := 4
+func (locs Locations) MakeUserFilters(sc Scenario, datapath string) []FlybyFilter {
+	// Now for some great circles
+	var mm *MagneticModel
+	if sc.UsesMagnetic() {
+		mm = ReadMagneticModelFile(GetMagneticModelPath(datapath))
+		Println("Using magnetic model %v", mm)
+	}
+	var wind WindField
+	if sc.Wind != nil {
+		wind = sc.Wind.Field(datapath)
+	}
+	obs := []ObserverConstraint{}
+	for _, spec := range sc.ObserverList() {
+		loc3, exist, _ := locs.FindBy(spec.Label)
+		if !exist {
+			Fatal("Could not find location using %q", spec.Label)
+		}
+		o := ObserverConstraint{ObserverSpec: spec, Loc: loc3}
+		if mm != nil {
+			o.Declination = mm.Declination(loc3, sc.SightingDate(spec))
+			o.Declined = true
+			if spec.Magnetic {
+				o.Heading = MagneticToTrue(spec.Heading, o.Declination)
+				Println("Magnetic heading %.1f to %.1f at %v is true %.1f " +
+					"to %.1f, declination %.2f deg", spec.Heading[0],
+					spec.Heading[1], loc3, o.Heading[0], o.Heading[1],
+					o.Declination)
+			}
+		}
+		if timed, t, _ := spec.When(); timed {
+			Println("At %v at %s, %v", loc3, t.UTC().Format(time.RFC3339),
+				SunAt(loc3, t))
+		}
+		if spec.Sight != nil {
+			Println("From %v the aircraft can be seen out to %.2f km",
+				loc3, spec.Sight.Range())
+		}
+		if wind != nil {
+			east, north := wind.At(loc3)
+			o.Drift = &Drift{Heading: o.Heading, Airspeed: sc.Airspeed,
+				East: east, North: north}
+			o.Heading = o.Drift.Tracks()
+			Println("At %v %v, so tracks %.1f to %.1f deg", loc3, *o.Drift,
+				o.Heading[0], o.Heading[1])
+		}
+		obs = append(obs, o)
+	}
+	timeline := locs.MakeTimeline(sc)
 	filters := []FlybyFilter{}
-	for i := 0; i < nproc; i++ {
+	for i := 0; i < sc.Nproc; i++ {
 		ff := &FlybyPoint{
-			nearestApproach: MakeNearestApproachFilter(loc3, amax, bmax, cmax, dmax, heading),
+			nearestApproach: MakeObserversFilter(
+				obs, sc.Amax, sc.Bmax, sc.Cmax, sc.MinOptional, timeline,
+				sc.Scoring),
 		}
 		filters = append(filters, ff)
 	}
     return filters
 }
 
+// Speeds, departure and rings from the scenario, or nil if no speed is given,
+// in which case the scenario has no times either.  Times are reckoned along
+// paths of the model in use.
+func (locs Locations) MakeTimeline(sc Scenario) *Timeline {
+	if len(sc.Speed) != 2 {
+		return nil
+	}
+	timeline := &Timeline{Vmin: sc.Speed[0], Vmax: sc.Speed[1],
+		Path: pathModel}
+	if sc.Departure != nil {
+		loc, exist, _ := locs.FindBy(sc.Departure.Label)
+		if !exist {
+			Fatal("Could not find location using %q", sc.Departure.Label)
+		}
+		dep := TimedEvent{Label: sc.Departure.Label}
+		_, dep.Time, dep.Tolerance = sc.Departure.When()
+		timeline.Departure = &dep
+		timeline.DepartureLoc = loc
+	}
+	for _, spec := range sc.Rings {
+		timeline.Rings = append(timeline.Rings, spec.Ring())
+	}
+	return timeline
+}
+
 func (locs Locations) Choose() Locations {
 	//choose := []string{"ICAO:VRMV", "ICAO:GAN"}
 	choose := []string{}
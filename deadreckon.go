@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A location passed near by a track from the origin.
+type TrackHit struct {
+	Location
+	Heading	float64 // deg clockwise from north, of the track
+	Along	float64 // km from the origin, negative behind it
+	Cross	float64 // km, positive to the right of the track
+}
+
+type TrackHits []TrackHit
+
+func (hit TrackHit) String() string {
+	return fmt.Sprintf("%v heading %.0f deg, along %.1f km, cross %.2f km",
+		hit.Location, hit.Heading, hit.Along, hit.Cross)
+}
+
+// Step between the headings tried across a range for rhumb lines, and the
+// interval about the best of them to which that heading is then refined.
+const (
+	DR_HEADING_STEP float64 = 1.0 // deg
+	DR_HEADING_PRECISION float64 = 1e-6 // deg
+)
+
+// Headings from h0 clockwise to h1 in deg, in steps no more than
+// DR_HEADING_STEP, always including both ends.
+func headingRange(h0, h1 float64) []float64 {
+	span := math.Mod(h1 - h0 + 360.0, 360.0)
+	if h1 - h0 >= 360.0 {
+		span = 360.0
+	}
+	n := int(math.Ceil(span/DR_HEADING_STEP))
+	if n < 1 {
+		return []float64{math.Mod(h0 + 360.0, 360.0)}
+	}
+	result := []float64{}
+	for i := 0; i <= n; i++ {
+		result = append(result,
+			math.Mod(h0 + span*float64(i)/float64(n) + 360.0, 360.0))
+	}
+	return result
+}
+
+// Where loc lies relative to the track through origin at heading, under the
+// path model in use: km along it and km to the side.
+func trackOffsets(origin Location, heading float64, loc Location, length float64) (float64, float64) {
+	if pathModel == RHUMB_PATH {
+		back := RhumbDestination(origin, heading + 180.0, length)
+		ahead := RhumbDestination(origin, heading, length)
+		s, d := RhumbNearest(back, ahead, loc)
+		// Side from the bearing of loc off the track at its nearest point
+		p := RhumbDestination(back, heading, s)
+		side := math.Sin(DegToRad(p.BearingTo(loc) - heading))
+		if side < 0 {
+			d = -d
+		}
+		return s - length, d
+	}
+	gc := GreatCircle{Loc1: origin, Loc2: origin.Destination(heading, 100.0)}
+	return gc.AlongTrack(loc), gc.CrossTrack(loc)
+}
+
+// Heading from h0 clockwise to h1 deg whose rhumb line through origin
+// passes nearest loc.  Headings are tried in steps across the range, and
+// the best refined by golden section search to the steps either side.
+func nearestRhumbHeading(origin Location, h0, h1 float64, loc Location, length float64) float64 {
+	cross := func(h float64) float64 {
+		_, d := trackOffsets(origin, h, loc, length)
+		return math.Abs(d)
+	}
+	headings := headingRange(h0, h1)
+	best, dbest := 0, math.Inf(1)
+	for i, h := range headings {
+		if d := cross(h); d < dbest {
+			best, dbest = i, d
+		}
+	}
+	lo, hi := headings[best], headings[best]
+	if best > 0 {
+		lo -= CourseSpan(headings[best-1], headings[best])
+	}
+	if best < len(headings) - 1 {
+		hi += CourseSpan(headings[best], headings[best+1])
+	}
+	r := (math.Sqrt(5.0) - 1.0)/2.0
+	a, b := hi - r*(hi - lo), lo + r*(hi - lo)
+	da, db := cross(a), cross(b)
+	for hi - lo > DR_HEADING_PRECISION {
+		if da < db {
+			hi, b, db = b, a, da
+			a = hi - r*(hi - lo)
+			da = cross(a)
+		} else {
+			lo, a, da = a, b, db
+			b = lo + r*(hi - lo)
+			db = cross(b)
+		}
+	}
+	if h := (lo + hi)/2.0; cross(h) < dbest {
+		return math.Mod(h + 360.0, 360.0)
+	}
+	return headings[best]
+}
+
+// Waypoints and airports within width km of a track through origin, flown
+// at any heading from h0 clockwise to h1 deg, up to length km ahead of and
+// behind the origin.  Each location is given for the heading whose track
+// passes nearest, and they are ordered by distance along the track.  A great
+// circle passes nearest heading straight for the location or away from it,
+// or else at whichever end of the range is closer to that.
+func (locs Locations) DeadReckon(origin Location, h0, h1, length, width float64) TrackHits {
+	cands := Locations([]Location{})
+	for _, nb := range locs.WithinRadius(origin, length + width) {
+		if nb.Type == LOCTYPE["Waypoint"].Tag || nb.Type == LOCTYPE["Airport"].Tag {
+			cands = append(cands, nb.Location)
+		}
+	}
+	hits := TrackHits([]TrackHit{})
+	for _, loc := range cands {
+		if loc == origin {
+			continue
+		}
+		var headings []float64
+		if pathModel == RHUMB_PATH {
+			headings = []float64{nearestRhumbHeading(origin, h0, h1, loc, length)}
+		} else {
+			bearing := origin.BearingTo(loc)
+			headings = []float64{ClampCourse(bearing, h0, h1),
+				ClampCourse(bearing + 180.0, h0, h1)}
+		}
+		var best *TrackHit
+		for _, h := range headings {
+			along, cross := trackOffsets(origin, h, loc, length)
+			if math.Abs(along) > length || math.Abs(cross) > width {
+				continue
+			}
+			if best == nil || math.Abs(cross) < math.Abs(best.Cross) {
+				best = &TrackHit{Location: loc, Heading: h, Along: along, Cross: cross}
+			}
+		}
+		if best != nil {
+			hits = append(hits, *best)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Along < hits[j].Along
+	})
+	return hits
+}
+
+// Print the locations passed near by tracks through the location with the
+// given label, behind it first.
+func (locs Locations) PrintDeadReckoning(label, headings string, length, width float64) {
+	origin, exist, _ := locs.FindBy(label)
+	if !exist {
+		Fatal("Could not find location using %q", label)
+	}
+	var h0, h1 float64
+	if n, err := fmt.Sscanf(headings, "%g,%g", &h0, &h1); n != 2 || err != nil {
+		Fatal("Give the heading range as from,to in deg, not %q", headings)
+	}
+	hits := locs.DeadReckon(origin, h0, h1, length, width)
+	Println("%d locations within %g km of %s tracks from %v, headings %g to %g deg",
+		len(hits), width, pathModel.Name(), origin, h0, h1)
+	for _, hit := range hits {
+		Println(" %v", hit)
+	}
+	return
+}
@@ -7,16 +7,17 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"code.google.com/p/go.net/html"
-	"net/http"
 )
 
-// Download waypoint and airport pages for nations in given file.
-func Download(datapath string) {
+// Download waypoint and airport pages for nations in given file, skipping
+// those already downloaded unless refresh, and listing any that failed.
+func Download(datapath string, refresh bool) {
 	// Grab html files
 	nationpath := filepath.Join(datapath, NATION_INDEX_NAME)
 	byts, err := ioutil.ReadFile(nationpath)
 	ifError(err)
 	lines := strings.Split(string(byts), "\n")
+	jobs := []FetchJob{}
 	for _, typ := range LOCTYPE {
 		for _, line := range lines {
 			if len(line) > 0 {
@@ -36,20 +37,14 @@ func Download(datapath string) {
 						addr = BASE_ADDRESS + code + "/" + state + typ.SourceSuffix
 						filename = filepath.Join(datapath, code + state + typ.LocalSuffix)
 					}
-					Println("Downloading %s", addr)
-					resp, err := http.Get(addr)
-					ifError(err)
-					txt, err := ioutil.ReadAll(resp.Body)
-					resp.Body.Close()
-					ifError(err)
-					byts := []byte(txt)
-					Println("Saving %s", filename)
-					err = ioutil.WriteFile(filename, byts, 0755)
-					ifError(err)
+					jobs = append(jobs, FetchJob{Url: addr, Path: filename})
 				}
 			}
 		}
 	}
+	fetcher := NewFetcher(datapath)
+	fetcher.Refresh = refresh
+	PrintFetchSummary(fetcher.FetchAll(jobs))
 	return
 }
 
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A file to fetch from Url and save at Path.
+type FetchJob struct {
+	Url		string
+	Path	string
+}
+
+// What was fetched into a file, and when, kept in the manifest so later runs
+// can skip it or ask the server whether it has changed.
+type FetchRecord struct {
+	Url				string		`json:"url"`
+	ETag			string		`json:"etag,omitempty"`
+	LastModified	string		`json:"lastmodified,omitempty"`
+	Size			int64		`json:"size"`
+	Fetched			time.Time	`json:"fetched"`
+}
+
+// How a job ended.
+type FetchResult struct {
+	Job			FetchJob
+	Status		string // one of the FETCH_ statuses
+	Attempts	int
+	Err			error
+}
+
+const (
+	FETCH_FETCHED string = "fetched"
+	FETCH_UNCHANGED string = "unchanged" // server said not modified
+	FETCH_SKIPPED string = "skipped" // already complete
+	FETCH_FAILED string = "failed"
+)
+
+// Defaults, gentle enough for a small site.
+const (
+	DOWNLOAD_WORKERS int = 4
+	DOWNLOAD_DELAY time.Duration = 500*time.Millisecond // between requests
+	DOWNLOAD_RETRIES int = 3
+	DOWNLOAD_BACKOFF time.Duration = 2*time.Second // before the first retry
+	DOWNLOAD_TIMEOUT time.Duration = 60*time.Second
+)
+
+// Fetches files a few at a time, no more often than Delay between requests
+// to be polite to the server, retrying failed requests after a Backoff
+// doubling each time.  Files already complete by the manifest are skipped,
+// unless Refresh, when the server is asked whether they have changed.
+type Fetcher struct {
+	Client			*http.Client
+	Workers			int
+	Delay			time.Duration
+	Retries			int
+	Backoff			time.Duration
+	Refresh			bool
+	ManifestPath	string
+	manifest		map[string]FetchRecord // by path
+	mutex			sync.Mutex
+	turn			sync.Mutex // held while waiting to make a request
+	next			time.Time // when the next request may start
+}
+
+// A failed request that may or may not be worth retrying, as opposed to a
+// network error, which always is.
+type fetchError struct {
+	msg		string
+	retry	bool
+	after	time.Duration // asked to wait by the server
+}
+
+func (err fetchError) Error() string {
+	return err.msg
+}
+
+func GetDownloadManifestPath(datapath string) string {
+	return filepath.Join(datapath, DOWNLOAD_MANIFEST_NAME)
+}
+
+// A fetcher with the default settings, keeping its manifest in the data
+// directory.
+func NewFetcher(datapath string) *Fetcher {
+	return &Fetcher{
+		Client:			&http.Client{Timeout: DOWNLOAD_TIMEOUT},
+		Workers:		DOWNLOAD_WORKERS,
+		Delay:			DOWNLOAD_DELAY,
+		Retries:		DOWNLOAD_RETRIES,
+		Backoff:		DOWNLOAD_BACKOFF,
+		ManifestPath:	GetDownloadManifestPath(datapath),
+	}
+}
+
+func (f *Fetcher) readManifest() {
+	f.manifest = map[string]FetchRecord{}
+	byts, err := ioutil.ReadFile(f.ManifestPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	ifError(err)
+	if err := json.Unmarshal(byts, &f.manifest); err != nil {
+		Fatal("Could not parse download manifest %s: %v", f.ManifestPath, err)
+	}
+	return
+}
+
+// Caller holds the mutex.  Written after every file, so an interrupted run
+// can carry on where it stopped.
+func (f *Fetcher) writeManifest() error {
+	byts, err := json.MarshalIndent(f.manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	part := f.ManifestPath + ".part"
+	if err := ioutil.WriteFile(part, append(byts, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(part, f.ManifestPath)
+}
+
+// Wait for our turn to make a request, at least Delay after the last began,
+// however late that woke.
+func (f *Fetcher) wait() {
+	f.turn.Lock()
+	defer f.turn.Unlock()
+	time.Sleep(f.next.Sub(time.Now()))
+	f.next = time.Now().Add(f.Delay)
+	return
+}
+
+// Whether the manifest has the file at path, and the file is all there.
+func (f *Fetcher) complete(job FetchJob) (FetchRecord, bool) {
+	f.mutex.Lock()
+	rec, ok := f.manifest[job.Path]
+	f.mutex.Unlock()
+	if !ok || rec.Url != job.Url {
+		return rec, false
+	}
+	stat, err := os.Stat(job.Path)
+	return rec, err == nil && stat.Size() == rec.Size
+}
+
+// One request for the job, conditional on rec if the file is complete.
+// Returns the status and the record to keep.
+func (f *Fetcher) attempt(job FetchJob, rec FetchRecord, complete bool) (string, FetchRecord, error) {
+	req, err := http.NewRequest("GET", job.Url, nil)
+	if err != nil {
+		return FETCH_FAILED, rec, fetchError{msg: err.Error()}
+	}
+	if complete {
+		if len(rec.ETag) > 0 {
+			req.Header.Set("If-None-Match", rec.ETag)
+		}
+		if len(rec.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", rec.LastModified)
+		}
+	}
+	f.wait()
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return FETCH_FAILED, rec, err
+	}
+	defer resp.Body.Close()
+	switch {
+		case resp.StatusCode == http.StatusNotModified && complete:
+			rec.Fetched = time.Now().UTC()
+			return FETCH_UNCHANGED, rec, nil
+		case resp.StatusCode == http.StatusOK:
+		case resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode >= 500:
+			after := time.Duration(0)
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				after = time.Duration(secs)*time.Second
+			}
+			return FETCH_FAILED, rec, fetchError{
+				msg: "server responded " + resp.Status, retry: true, after: after}
+		default:
+			return FETCH_FAILED, rec,
+				fetchError{msg: "server responded " + resp.Status}
+	}
+	// Into a part file first, so a file is never left half written
+	part := job.Path + ".part"
+	out, err := os.Create(part)
+	if err != nil {
+		return FETCH_FAILED, rec, fetchError{msg: err.Error()}
+	}
+	size, err := io.Copy(out, resp.Body)
+	// Cut off part way through is worth retrying, but not failing to write
+	cut := err != nil
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(part, job.Path)
+	}
+	if err != nil {
+		os.Remove(part)
+		return FETCH_FAILED, rec, fetchError{msg: err.Error(), retry: cut}
+	}
+	return FETCH_FETCHED, FetchRecord{
+		Url:			job.Url,
+		ETag:			resp.Header.Get("ETag"),
+		LastModified:	resp.Header.Get("Last-Modified"),
+		Size:			size,
+		Fetched:		time.Now().UTC(),
+	}, nil
+}
+
+func (f *Fetcher) fetch(job FetchJob) FetchResult {
+	result := FetchResult{Job: job}
+	rec, complete := f.complete(job)
+	if complete && !f.Refresh {
+		result.Status = FETCH_SKIPPED
+		return result
+	}
+	backoff := f.Backoff
+	for {
+		result.Attempts++
+		var status string
+		status, rec, result.Err = f.attempt(job, rec, complete)
+		if result.Err == nil {
+			result.Status = status
+			f.mutex.Lock()
+			f.manifest[job.Path] = rec
+			result.Err = f.writeManifest()
+			f.mutex.Unlock()
+			if result.Err != nil {
+				result.Status = FETCH_FAILED
+			}
+			return result
+		}
+		result.Status = FETCH_FAILED
+		wait := backoff
+		if ferr, ok := result.Err.(fetchError); ok {
+			if !ferr.retry {
+				return result
+			}
+			if ferr.after > wait {
+				wait = ferr.after
+			}
+		}
+		if result.Attempts > f.Retries {
+			return result
+		}
+		Println("Retrying %s in %v after %v", job.Url, wait, result.Err)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// Fetch all the jobs, returning how each ended, in the same order.
+func (f *Fetcher) FetchAll(jobs []FetchJob) []FetchResult {
+	f.readManifest()
+	results := make([]FetchResult, len(jobs))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < f.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = f.fetch(jobs[i])
+				if results[i].Status != FETCH_SKIPPED {
+					Println("%s %s (%d attempts)", results[i].Status,
+						jobs[i].Url, results[i].Attempts)
+				}
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// Counts by status, then each failure.
+func PrintFetchSummary(results []FetchResult) {
+	counts := map[string]int{}
+	failed := []FetchResult{}
+	for _, r := range results {
+		counts[r.Status]++
+		if r.Status == FETCH_FAILED {
+			failed = append(failed, r)
+		}
+	}
+	Println("Downloads: %d fetched, %d unchanged, %d skipped, %d failed",
+		counts[FETCH_FETCHED], counts[FETCH_UNCHANGED], counts[FETCH_SKIPPED],
+		counts[FETCH_FAILED])
+	sort.SliceStable(failed, func(i, j int) bool {
+		return failed[i].Job.Url < failed[j].Job.Url
+	})
+	for _, r := range failed {
+		Println(" %s: %v", r.Job.Url, r.Err)
+	}
+	return
+}
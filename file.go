@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"fmt"
 	"strings"
@@ -8,6 +9,7 @@ import (
 	"path/filepath"
 	"code.google.com/p/go.net/html"
 	"encoding/csv"
+	"strconv"
 )
 
 func GetDataPath() string {
@@ -29,7 +31,7 @@ func GetTrackCSVPath(datapath string) string {
 	return filepath.Join(datapath, TRACK_CSV_NAME)
 }
 
-func LoadLocationData(datapath string) Locations {
+func loadFallingRainData(datapath string) Locations {
 	locs := Locations([]Location{})
 	// Parse waypoint html files
 	filenames, err :=
@@ -61,13 +63,6 @@ func LoadLocationData(datapath string) Locations {
 			filepath.Base(
 				strings.TrimSuffix(filename, LOCTYPE["Airport"].LocalSuffix)))
 	}
-	// Parse additional locations in csv file
-	otherpath := filepath.Join(datapath, ADDITIONAL_LOCATIONS_NAME)
-	locs2 := readSupplementaryLocationsFromFile(otherpath)
-	Println("Parsed %d additional locations in %s", len(locs2), otherpath)
-	for _, loc := range locs2 {
-		locs = append(locs, loc)
-	}
 	return locs
 }
 
@@ -114,6 +109,38 @@ func readSupplementaryLocationsFromFile(fpath string) Locations {
     return result
 }
 
+// Names of the columns of the results, the same for every flyby found by
+// one search.
+func flybyColumns(fb Flyby) []string {
+	columns := []string{"n", "type1", "id1", "lat1", "long1",
+		"type2", "id2", "lat2", "long2", "dist", "nearest", "B", "C", "heading"}
+	for _, fix := range fb.Observers {
+		columns = append(columns, fix.Label + " nearest",
+			fix.Label + " heading", fix.Label + " along")
+		if fix.Declined {
+			columns = append(columns, fix.Label + " magnetic heading")
+		}
+		if fix.Sighted {
+			columns = append(columns, fix.Label + " elevation low",
+				fix.Label + " elevation high")
+		}
+		if fix.SunKnown {
+			columns = append(columns, fix.Label + " sun angle")
+		}
+	}
+	if fb.GroundSpeed > 0 {
+		columns = append(columns, "crab", "ground speed")
+	}
+	if len(fb.Factors) > 0 {
+		columns = append(columns, "score")
+		for _, f := range fb.Factors {
+			columns = append(columns, f.Name)
+		}
+	}
+	return columns
+}
+
+// A header naming the columns, then a line for each flyby.
 func WriteFlybysToFile(datapath string, flybys []Flyby) {
 	if len(flybys) > 0 {
 		resultpath := GetResultPath(datapath)
@@ -123,50 +150,216 @@ func WriteFlybysToFile(datapath string, flybys []Flyby) {
 		out, err := os.Create(resultpath)
 		defer out.Close()
 		ifError(err)
-		var line string
+		writer := csv.NewWriter(out)
+		ifError(writer.Write(flybyColumns(flybys[0])))
 		for i, fb := range flybys {
-			line = fmt.Sprintf("%d,%s,%s,%.1f,%.3f,%.1f,%.1f,%.1f\n",
-				i, fb.Loc1.ToSimpleCSV(), fb.Loc2.ToSimpleCSV(),
-				RadToDist(fb.Ang12), RadToDist(fb.Nearest),
-				RadToDeg(fb.B), RadToDeg(fb.C), RadToDeg(fb.Heading))
-			out.WriteString(line)
+			ifError(writer.Write(flybyRecord(i, fb)))
 		}
+		writer.Flush()
+		ifError(writer.Error())
 	}
     return
 }
 
+// The nth flyby's record in the results, in the columns flybyColumns names.
+func flybyRecord(n int, fb Flyby) []string {
+	f := func(format string, x float64) string {
+		return fmt.Sprintf(format, x)
+	}
+	record := []string{strconv.Itoa(n),
+		fb.Loc1.Type, fb.Loc1.Id(), f("%f", fb.Loc1.Lat), f("%f", fb.Loc1.Long),
+		fb.Loc2.Type, fb.Loc2.Id(), f("%f", fb.Loc2.Lat), f("%f", fb.Loc2.Long),
+		f("%.1f", RadToDist(fb.Ang12)), f("%.3f", RadToDist(fb.Nearest)),
+		f("%.1f", RadToDeg(fb.B)), f("%.1f", RadToDeg(fb.C)),
+		f("%.1f", RadToDeg(fb.Heading))}
+	// Nearest distance, heading and along-track distance per observer,
+	// magnetic heading if a magnetic model is in use, elevations if the
+	// observer has a sight and the angle to the sun if a time
+	for _, fix := range fb.Observers {
+		if fix.Fits {
+			record = append(record, f("%.3f", RadToDist(fix.Nearest)),
+				f("%.1f", RadToDeg(fix.Heading)),
+				f("%.1f", RadToDist(fix.AlongTrack)))
+			if fix.Declined {
+				record = append(record, f("%.1f", fix.MagneticHeading()))
+			}
+			if fix.Sighted {
+				record = append(record, f("%.1f", fix.Elevation[0]),
+					f("%.1f", fix.Elevation[1]))
+			}
+			if fix.SunKnown {
+				record = append(record, f("%.1f", fix.SunAngle))
+			}
+		} else {
+			record = append(record, "", "", "")
+			if fix.Declined {
+				record = append(record, "")
+			}
+			if fix.Sighted {
+				record = append(record, "", "")
+			}
+			if fix.SunKnown {
+				record = append(record, "")
+			}
+		}
+	}
+	// Crab angle and ground speed, when there is wind
+	if fb.GroundSpeed > 0 {
+		record = append(record, f("%.1f", fb.Crab), f("%.0f", fb.GroundSpeed))
+	}
+	// Score and each factor in it, when scoring, empty for observers that do
+	// not fit
+	if len(fb.Factors) > 0 {
+		record = append(record, f("%.6g", fb.Score))
+		for _, factor := range fb.Factors {
+			if factor.Skipped {
+				record = append(record, "")
+			} else {
+				record = append(record, f("%.6g", factor.Value))
+			}
+		}
+	}
+	return record
+}
+
 func (locs Locations) WriteToNativeCSV(datapath string) {
-	path := GetLocationCSVPath(datapath)
+	locs.WriteToNativeCSVPath(GetLocationCSVPath(datapath), NativeSettings())
+	return
+}
+
+// The -src, -prefer and -conflict the locations were loaded and merged with,
+// each as name=value.
+func NativeSettings() []string {
+	sources := []string{}
+	for _, src := range strings.Split(cmdSources, ",") {
+		sources = append(sources, strings.TrimSpace(src))
+	}
+	return []string{"src=" + strings.Join(sources, ","),
+		"prefer=" + cmdPrefer,
+		"conflict=" + strconv.FormatFloat(cmdConflict, 'g', -1, 64)}
+}
+
+// Native csv file: a line giving the format version and the settings the
+// locations were made with, a header naming the columns, then one record for
+// each location.
+func (locs Locations) WriteToNativeCSVPath(path string, settings []string) {
 	err := os.RemoveAll(path)
 	ifError(err)
 	Println("Writing location data to %s", path)
 	out, err := os.Create(path)
 	defer out.Close()
 	ifError(err)
+	writer := csv.NewWriter(out)
+	ifError(writer.Write(append([]string{NATIVE_VERSION_TAG,
+		strconv.Itoa(NATIVE_FORMAT_VERSION)}, settings...)))
+	ifError(writer.Write(NATIVE_COLUMNS))
 	for _, loc := range locs {
-		out.WriteString(loc.ToCSVLine())
+		ifError(writer.Write(loc.ToCSVRecord()))
 	}
+	writer.Flush()
+	ifError(writer.Error())
     return
 }
 
-// Assume file exists
+// Settings recorded in the native csv file's version line, none in files
+// from before they were.  Assume file exists.
+func ReadNativeSettings(nativepath string) []string {
+	file, err := os.Open(nativepath)
+	ifError(err)
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	fields, err := reader.Read()
+	if err != nil || len(fields) < 2 || fields[0] != NATIVE_VERSION_TAG {
+		return []string{}
+	}
+	return fields[2:]
+}
+
+// Names of the flags given on the command line.
+func GivenFlags() map[string]bool {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// Settings of the given flags that the native csv file was not made with, so
+// that it does not hold the locations asked for.
+func UnmetNativeSettings(nativepath string, given map[string]bool) []string {
+	recorded := map[string]bool{}
+	for _, setting := range ReadNativeSettings(nativepath) {
+		recorded[setting] = true
+	}
+	unmet := []string{}
+	for _, setting := range NativeSettings() {
+		if given[strings.SplitN(setting, "=", 2)[0]] && !recorded[setting] {
+			unmet = append(unmet, setting)
+		}
+	}
+	return unmet
+}
+
+// Assume file exists.  Files without a version line are version 1, from
+// before the header, and are migrated as they are read.
 func ReadNativeLocationsFile(nativepath string) Locations {
 	result := Locations([]Location{})
 	file, err := os.Open(nativepath)
 	ifError(err)
+	defer file.Close()
 	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
 	lines, err := reader.ReadAll()
-	ifError(err)
-	var loc Location
-	for i, fields := range lines {
-		loc = FromCSVLine(fields, i)
-		result = append(result, loc)
+	if err != nil {
+		Fatal("Could not read native locations %s: %v", nativepath, err)
+	}
+	if len(lines) == 0 {
+		return result
+	}
+	if lines[0][0] != NATIVE_VERSION_TAG {
+		Println("%s is in version 1 format, use -m to remake it in version %d",
+			nativepath, NATIVE_FORMAT_VERSION)
+		for i, fields := range lines {
+			result = append(result, FromCSVLine(fields, i))
+		}
+		return result
+	}
+	version := 0
+	if len(lines[0]) > 1 {
+		version, err = strconv.Atoi(lines[0][1])
+	}
+	if err != nil || version < 2 {
+		Fatal("%s has version %v, not a number from 2", nativepath, lines[0][1:])
+	}
+	if version > NATIVE_FORMAT_VERSION {
+		Println("%s is version %d, newer than %d, so some fields may be lost",
+			nativepath, version, NATIVE_FORMAT_VERSION)
+	}
+	if len(lines) < 2 {
+		Fatal("%s has no header after its version", nativepath)
+	}
+	columns := map[string]int{}
+	for i, name := range lines[1] {
+		columns[name] = i
+	}
+	for _, name := range []string{"type", "lat", "long"} {
+		if _, ok := columns[name]; !ok {
+			Fatal("%s has no %s column", nativepath, name)
+		}
+	}
+	for i, fields := range lines[2:] {
+		result = append(result, FromCSVRecord(fields, columns, i + 3))
 	}
     return result
 }
 
 func (locs Locations) WriteToSimpleCSV(datapath string) {
-	path := GetTrackCSVPath(datapath)
+	locs.WriteToSimpleCSVPath(GetTrackCSVPath(datapath))
+	return
+}
+
+func (locs Locations) WriteToSimpleCSVPath(path string) {
 	err := os.RemoveAll(path)
 	ifError(err)
 	Println("Writing location data to %s", path)
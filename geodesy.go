@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	. "math"
+	"strings"
+)
+
+// A model of the shape of the earth, giving distances in km and azimuths in
+// deg clockwise from north.
+type Geodesy interface {
+	Name() string
+	// Distance from loc1 to loc2, and the azimuths of the path at each end
+	Inverse(loc1, loc2 Location) (dist, az1, az2 float64)
+	// Location dist from loc along a path starting at azimuth az, and the
+	// azimuth of the path on arrival
+	Direct(loc Location, az, dist float64) (Location, float64)
+}
+
+// The earth as a sphere of the given radius in km.
+type Sphere struct {
+	Radius	float64
+}
+
+// The earth as an ellipsoid of revolution, with equatorial radius A in km
+// and flattening F, solved with Vincenty's formulae.
+type Ellipsoid struct {
+	Label	string
+	A		float64
+	F		float64
+}
+
+var SPHERE Geodesy = Sphere{Radius: EARTH_RAD}
+var WGS84 Geodesy = Ellipsoid{Label: "wgs84", A: 6378.137, F: 1.0/298.257223563}
+
+// The model in use, chosen with -model.
+var geodesy Geodesy = SPHERE
+
+// Most iterations of Vincenty's formulae, which fail to converge for nearly
+// antipodal points.
+const VINCENTY_MAX_ITER int = 200
+
+func GeodesyModel(name string) Geodesy {
+	for _, geo := range []Geodesy{SPHERE, WGS84} {
+		if strings.ToLower(name) == geo.Name() {
+			return geo
+		}
+	}
+	Fatal("Unknown geodesy model %q, use sphere or wgs84", name)
+	return nil
+}
+
+func normalizeAzimuth(az float64) float64 {
+	az = Mod(az, 360.0)
+	if az < 0 {
+		az += 360.0
+	}
+	return az
+}
+
+func (sp Sphere) Name() string {
+	return "sphere"
+}
+
+func (sp Sphere) Inverse(loc1, loc2 Location) (float64, float64, float64) {
+	ang := loc1.ToCartesianVector().AngleWith(loc2.ToCartesianVector())
+	az2 := normalizeAzimuth(loc2.BearingTo(loc1) + 180.0)
+	return ang*sp.Radius, loc1.BearingTo(loc2), az2
+}
+
+func (sp Sphere) Direct(loc Location, az, dist float64) (Location, float64) {
+	lat1, long1 := LatLongToRadians(loc)
+	alpha := DegToRad(az)
+	d := dist/sp.Radius
+	lat2 := Asin(Sin(lat1)*Cos(d) + Cos(lat1)*Sin(d)*Cos(alpha))
+	long2 := long1 + Atan2(Sin(alpha)*Sin(d)*Cos(lat1),
+		Cos(d) - Sin(lat1)*Sin(lat2))
+	loc2 := Location{
+		Lat:	RadToDeg(lat2),
+		Long:	normalizeAzimuth(RadToDeg(long2) + 180.0) - 180.0,
+	}
+	return loc2, normalizeAzimuth(loc2.BearingTo(loc) + 180.0)
+}
+
+func (el Ellipsoid) Name() string {
+	return el.Label
+}
+
+func (el Ellipsoid) String() string {
+	return fmt.Sprintf("%s (a %g km, 1/f %.9f)", el.Label, el.A, 1.0/el.F)
+}
+
+// Vincenty's inverse formula.  Nearly antipodal points, for which it does not
+// converge, fall back to a sphere of the same mean radius.
+func (el Ellipsoid) Inverse(loc1, loc2 Location) (float64, float64, float64) {
+	a := el.A
+	f := el.F
+	b := a*(1.0 - f)
+	lat1, long1 := LatLongToRadians(loc1)
+	lat2, long2 := LatLongToRadians(loc2)
+	L := long2 - long1
+	U1 := Atan((1.0 - f)*Tan(lat1))
+	U2 := Atan((1.0 - f)*Tan(lat2))
+	sinU1, cosU1 := Sin(U1), Cos(U1)
+	sinU2, cosU2 := Sin(U2), Cos(U2)
+	lambda := L
+	var sinLambda, cosLambda, sinSigma, cosSigma, sigma float64
+	var cosSqAlpha, cos2SigmaM float64
+	converged := false
+	for i := 0; i < VINCENTY_MAX_ITER; i++ {
+		sinLambda, cosLambda = Sin(lambda), Cos(lambda)
+		sinSigma = Sqrt((cosU2*sinLambda)*(cosU2*sinLambda) +
+			(cosU1*sinU2 - sinU1*cosU2*cosLambda)*
+				(cosU1*sinU2 - sinU1*cosU2*cosLambda))
+		if sinSigma == 0 {
+			// Same point
+			return 0.0, 0.0, 0.0
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1*cosU2*sinLambda/sinSigma
+		cosSqAlpha = 1.0 - sinAlpha*sinAlpha
+		cos2SigmaM = 0.0 // on the equator
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2.0*sinU1*sinU2/cosSqAlpha
+		}
+		C := f/16.0*cosSqAlpha*(4.0 + f*(4.0 - 3.0*cosSqAlpha))
+		last := lambda
+		lambda = L + (1.0 - C)*f*sinAlpha*(sigma + C*sinSigma*
+			(cos2SigmaM + C*cosSigma*(-1.0 + 2.0*cos2SigmaM*cos2SigmaM)))
+		if Abs(lambda - last) < 1e-12 {
+			converged = true
+			break
+		}
+	}
+	if !converged {
+		return Sphere{Radius: (2.0*a + b)/3.0}.Inverse(loc1, loc2)
+	}
+	uSq := cosSqAlpha*(a*a - b*b)/(b*b)
+	A := 1.0 + uSq/16384.0*(4096.0 + uSq*(-768.0 + uSq*(320.0 - 175.0*uSq)))
+	B := uSq/1024.0*(256.0 + uSq*(-128.0 + uSq*(74.0 - 47.0*uSq)))
+	deltaSigma := B*sinSigma*(cos2SigmaM + B/4.0*(cosSigma*
+		(-1.0 + 2.0*cos2SigmaM*cos2SigmaM) - B/6.0*cos2SigmaM*
+		(-3.0 + 4.0*sinSigma*sinSigma)*(-3.0 + 4.0*cos2SigmaM*cos2SigmaM)))
+	dist := b*A*(sigma - deltaSigma)
+	az1 := Atan2(cosU2*sinLambda, cosU1*sinU2 - sinU1*cosU2*cosLambda)
+	az2 := Atan2(cosU1*sinLambda, -sinU1*cosU2 + cosU1*sinU2*cosLambda)
+	return dist, normalizeAzimuth(RadToDeg(az1)), normalizeAzimuth(RadToDeg(az2))
+}
+
+// Vincenty's direct formula.
+func (el Ellipsoid) Direct(loc Location, az, dist float64) (Location, float64) {
+	a := el.A
+	f := el.F
+	b := a*(1.0 - f)
+	lat1, long1 := LatLongToRadians(loc)
+	alpha1 := DegToRad(az)
+	sinAlpha1, cosAlpha1 := Sin(alpha1), Cos(alpha1)
+	tanU1 := (1.0 - f)*Tan(lat1)
+	cosU1 := 1.0/Sqrt(1.0 + tanU1*tanU1)
+	sinU1 := tanU1*cosU1
+	sigma1 := Atan2(tanU1, cosAlpha1)
+	sinAlpha := cosU1*sinAlpha1
+	cosSqAlpha := 1.0 - sinAlpha*sinAlpha
+	uSq := cosSqAlpha*(a*a - b*b)/(b*b)
+	A := 1.0 + uSq/16384.0*(4096.0 + uSq*(-768.0 + uSq*(320.0 - 175.0*uSq)))
+	B := uSq/1024.0*(256.0 + uSq*(-128.0 + uSq*(74.0 - 47.0*uSq)))
+	sigma := dist/(b*A)
+	var sinSigma, cosSigma, cos2SigmaM float64
+	for i := 0; i < VINCENTY_MAX_ITER; i++ {
+		cos2SigmaM = Cos(2.0*sigma1 + sigma)
+		sinSigma, cosSigma = Sin(sigma), Cos(sigma)
+		deltaSigma := B*sinSigma*(cos2SigmaM + B/4.0*(cosSigma*
+			(-1.0 + 2.0*cos2SigmaM*cos2SigmaM) - B/6.0*cos2SigmaM*
+			(-3.0 + 4.0*sinSigma*sinSigma)*(-3.0 + 4.0*cos2SigmaM*cos2SigmaM)))
+		last := sigma
+		sigma = dist/(b*A) + deltaSigma
+		if Abs(sigma - last) < 1e-12 {
+			break
+		}
+	}
+	cos2SigmaM = Cos(2.0*sigma1 + sigma)
+	sinSigma, cosSigma = Sin(sigma), Cos(sigma)
+	tmp := sinU1*sinSigma - cosU1*cosSigma*cosAlpha1
+	lat2 := Atan2(sinU1*cosSigma + cosU1*sinSigma*cosAlpha1,
+		(1.0 - f)*Sqrt(sinAlpha*sinAlpha + tmp*tmp))
+	lambda := Atan2(sinSigma*sinAlpha1, cosU1*cosSigma - sinU1*sinSigma*cosAlpha1)
+	C := f/16.0*cosSqAlpha*(4.0 + f*(4.0 - 3.0*cosSqAlpha))
+	L := lambda - (1.0 - C)*f*sinAlpha*(sigma + C*sinSigma*
+		(cos2SigmaM + C*cosSigma*(-1.0 + 2.0*cos2SigmaM*cos2SigmaM)))
+	alpha2 := Atan2(sinAlpha, -tmp)
+	loc2 := Location{
+		Lat:	RadToDeg(lat2),
+		Long:	normalizeAzimuth(RadToDeg(long1 + L) + 180.0) - 180.0,
+	}
+	return loc2, normalizeAzimuth(RadToDeg(alpha2))
+}
+
+// Fraction of the path length by which a geodesic on the ellipsoid can stray
+// from the great circle through the same end points, or its length differ.
+const GEODESIC_MARGIN float64 = 0.01
+
+// As MakeNearestApproachFilter, but using the given model.  For an ellipsoid,
+// paths are first found on the sphere with limits widened by the margin, then
+// the nearest point of the geodesic to loc3 is searched for, and the
+// distance to it and the course there are checked against dmax and dir.  The
+// sides and angles of the Flyby are all then those on the ellipsoid, with
+// distances in rad of EARTH_RAD.
+func MakeGeodesicApproachFilter(geo Geodesy, loc3 Location, amax, bmax, cmax, dmax float64, dir []float64) func(loc1, loc2 Location) (bool, bool, *Flyby) {
+	if _, ok := geo.(Sphere); ok {
+		return MakeNearestApproachFilter(loc3, amax, bmax, cmax, dmax, dir)
+	}
+	if len(dir) != 2 {
+		Fatal("Course range must have two numbers, but %d given", len(dir))
+	}
+	widen := 1.0 + GEODESIC_MARGIN
+	// A degree either way
+	sphere := MakeNearestApproachFilter(loc3, amax*widen, bmax*widen,
+		cmax*widen, dmax + GEODESIC_MARGIN*amax, WidenCourseRange(dir, 1.0))
+	return func(loc1, loc2 Location) (bool, bool, *Flyby) {
+		fits, avoid, fb := sphere(loc1, loc2)
+		if !fits {
+			return fits, avoid, fb
+		}
+		// In the direction of travel, as the spherical filter arranged, to
+		// which the limits on b and c apply
+		b, az13, _ := geo.Inverse(fb.Loc1, loc3)
+		c, az23, _ := geo.Inverse(fb.Loc2, loc3)
+		if b > bmax || c > cmax {
+			return false, false, nil
+		}
+		a, az1, az2 := geo.Inverse(fb.Loc1, fb.Loc2)
+		if a > amax {
+			return false, false, nil
+		}
+		// Golden section search about the nearest point on the sphere
+		dist := func(s float64) float64 {
+			p, _ := geo.Direct(fb.Loc1, az1, s)
+			d, _, _ := geo.Inverse(p, loc3)
+			return d
+		}
+		s0 := RadToDist(fb.AlongTrack)*a/RadToDist(fb.Ang12)
+		w := 2.0*GEODESIC_MARGIN*a + 1.0
+		lo, hi := Max(0.0, s0 - w), Min(a, s0 + w)
+		g := (Sqrt(5.0) - 1.0)/2.0
+		x1, x2 := hi - g*(hi - lo), lo + g*(hi - lo)
+		f1, f2 := dist(x1), dist(x2)
+		for hi - lo > 1e-6 {
+			if f1 < f2 {
+				hi, x2, f2 = x2, x1, f1
+				x1 = hi - g*(hi - lo)
+				f1 = dist(x1)
+			} else {
+				lo, x1, f1 = x1, x2, f2
+				x2 = lo + g*(hi - lo)
+				f2 = dist(x2)
+			}
+		}
+		s := (lo + hi)/2.0
+		// The nearest point must lie strictly between the ends
+		if s <= 1e-5 || s >= a - 1e-5 {
+			return false, false, nil
+		}
+		d := dist(s)
+		_, course := geo.Direct(fb.Loc1, az1, s)
+		if d > dmax || !InCourseRange(course, dir[0], dir[1]) {
+			return false, false, nil
+		}
+		fb2 := *fb
+		fb2.Ang12 = DistToRad(a)
+		fb2.Ang13 = DistToRad(b)
+		fb2.Ang23 = DistToRad(c)
+		// Angles at each end between the path and loc3
+		fb2.C = DegToRad(CourseDifference(az1, az13))
+		fb2.B = DegToRad(CourseDifference(az2 + 180.0, az23))
+		fb2.Nearest = DistToRad(d)
+		fb2.Heading = DegToRad(course)
+		fb2.AlongTrack = DistToRad(s)
+		return true, false, &fb2
+	}
+}
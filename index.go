@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Spatial index dividing the Earth's surface into lat/long cells of equal
+// size in degrees.  Entries are indices into the indexed Locations, so that
+// callers keep their own notion of ordering.
+type GridIndex struct {
+	locs	Locations
+	cell	float64 // deg
+	cells	map[gridKey][]int
+}
+
+type gridKey struct {
+	Lat		int
+	Long	int
+}
+
+// Smallest cell size used, to keep the number of cells sensible.
+const MIN_GRID_CELL float64 = 0.01 // deg
+
+// Make an empty index over locs, which can be filled with Insert.
+func NewGridIndex(locs Locations, cell float64) *GridIndex {
+	if cell < MIN_GRID_CELL {
+		cell = MIN_GRID_CELL
+	}
+	return &GridIndex{
+		locs:	locs,
+		cell:	cell,
+		cells:	map[gridKey][]int{},
+	}
+}
+
+// Make an index with every location in it.
+func (locs Locations) Index(cell float64) *GridIndex {
+	idx := NewGridIndex(locs, cell)
+	for i := range locs {
+		idx.Insert(i)
+	}
+	return idx
+}
+
+func (idx *GridIndex) key(lat, long float64) gridKey {
+	return gridKey{
+		Lat:	int(math.Floor(lat/idx.cell)),
+		Long:	int(math.Floor(long/idx.cell)),
+	}
+}
+
+// Add location i, using its current coordinates.
+func (idx *GridIndex) Insert(i int) {
+	k := idx.key(idx.locs[i].Lat, idx.locs[i].Long)
+	idx.cells[k] = append(idx.cells[k], i)
+	return
+}
+
+// Candidate indices, in ascending order, of locations inside the lat/long box
+// of half-length ddeg about the given point.  Longitudes are not wrapped, in
+// keeping with the simple box tests used elsewhere, so callers apply their
+// own exact test to the candidates.
+func (idx *GridIndex) InSquare(lat, long, ddeg float64) []int {
+	return idx.InBox(lat-ddeg, lat+ddeg, long-ddeg, long+ddeg)
+}
+
+// Candidate indices, in ascending order, of locations inside the given box.
+func (idx *GridIndex) InBox(lat0, lat1, long0, long1 float64) []int {
+	result := []int{}
+	k0 := idx.key(lat0, long0)
+	k1 := idx.key(lat1, long1)
+	ncells := (k1.Lat-k0.Lat+1)*(k1.Long-k0.Long+1)
+	if ncells > len(idx.cells) {
+		// Cheaper to visit every occupied cell
+		for k, entries := range idx.cells {
+			if k.Lat >= k0.Lat && k.Lat <= k1.Lat &&
+				k.Long >= k0.Long && k.Long <= k1.Long {
+				result = append(result, entries...)
+			}
+		}
+	} else {
+		var k gridKey
+		for k.Lat = k0.Lat; k.Lat <= k1.Lat; k.Lat++ {
+			for k.Long = k0.Long; k.Long <= k1.Long; k.Long++ {
+				result = append(result, idx.cells[k]...)
+			}
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+// A location found by a distance query, with the great circle distance and
+// initial bearing from the centre of the query.
+type Neighbour struct {
+	Location
+	Index	int		// into the indexed Locations
+	Dist	float64	// km
+	Bearing	float64	// deg clockwise from north
+}
+
+type Neighbours []Neighbour
+
+func (nb Neighbour) String() string {
+	return fmt.Sprintf("%v %.3f km %.1f deg", nb.Location, nb.Dist, nb.Bearing)
+}
+
+// Locations no more than km from center along the surface, nearest first,
+// as measured by the geodesy model in use.
+func (idx *GridIndex) WithinRadius(center Location, km float64) Neighbours {
+	r := DistToRad(km)
+	if _, ok := geodesy.(Sphere); !ok {
+		r *= 1.0 + GEODESIC_MARGIN
+	}
+	dlat := RadToDeg(r)
+	lat0 := math.Max(center.Lat-dlat, -90.0)
+	lat1 := math.Min(center.Lat+dlat, 90.0)
+	var candidates []int
+	// Longitude extent of a spherical cap, unless it covers a pole
+	sinr := math.Sin(math.Min(r, PI_2))/math.Cos(DegToRad(center.Lat))
+	if lat0 <= -90.0 || lat1 >= 90.0 || r >= PI_2 || sinr >= 1.0 {
+		candidates = idx.InBox(lat0, lat1, -180.0, 180.0)
+	} else {
+		dlong := RadToDeg(math.Asin(sinr))
+		long0 := center.Long - dlong
+		long1 := center.Long + dlong
+		candidates = idx.InBox(lat0, lat1, long0, long1)
+		// Wrap around the antimeridian
+		if long0 < -180.0 {
+			candidates = append(candidates,
+				idx.InBox(lat0, lat1, long0+360.0, 180.0)...)
+		}
+		if long1 > 180.0 {
+			candidates = append(candidates,
+				idx.InBox(lat0, lat1, -180.0, long1-360.0)...)
+		}
+	}
+	result := Neighbours([]Neighbour{})
+	for _, i := range candidates {
+		dist, az, _ := geodesy.Inverse(center, idx.locs[i])
+		if dist <= km {
+			result = append(result, Neighbour{
+				Location:	idx.locs[i],
+				Index:		i,
+				Dist:		dist,
+				Bearing:	az,
+			})
+		}
+	}
+	sort.Stable(result)
+	return result
+}
+
+// The k locations nearest to center, nearest first.  The search radius is
+// doubled until enough locations are found.
+func (idx *GridIndex) Nearest(center Location, k int) Neighbours {
+	result := Neighbours([]Neighbour{})
+	if k < 1 {
+		return result
+	}
+	maxkm := RadToDist(PI)
+	for km := 100.0; ; km *= 2.0 {
+		result = idx.WithinRadius(center, math.Min(km, maxkm))
+		if len(result) >= k || km >= maxkm {
+			break
+		}
+	}
+	if len(result) > k {
+		result = result[:k]
+	}
+	return result
+}
+
+func (nbs Neighbours) Len() int {
+	return len(nbs)
+}
+
+func (nbs Neighbours) Less(i, j int) bool {
+	return nbs[i].Dist < nbs[j].Dist
+}
+
+func (nbs Neighbours) Swap(i, j int) {
+	nbs[i], nbs[j] = nbs[j], nbs[i]
+}
+
+// Cell size used when a one-off index is made for a distance query.
+const QUERY_GRID_CELL float64 = 1.0 // deg
+
+func (locs Locations) WithinRadius(center Location, km float64) Neighbours {
+	return locs.Index(QUERY_GRID_CELL).WithinRadius(center, km)
+}
+
+func (locs Locations) Nearest(center Location, k int) Neighbours {
+	return locs.Index(QUERY_GRID_CELL).Nearest(center, k)
+}
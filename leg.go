@@ -17,19 +17,47 @@ func (locs Locations) ToLegs() Legs {
 	return legs
 }
 
+// The locations visited, in order.
+func (legs Legs) ToLocations() Locations {
+	locs := Locations([]Location{})
+	for i, leg := range legs {
+		if i == 0 {
+			locs = append(locs, leg.Loc1)
+		}
+		locs = append(locs, leg.Loc2)
+	}
+	return locs
+}
+
+// Great circle length in rad.
+func (leg Leg) Length() float64 {
+	return leg.Loc1.ToCartesianVector().AngleWith(leg.Loc2.ToCartesianVector())
+}
+
+// Point a distance s rad along the legs, flown by the path model, from the
+// start of the first, or on the path of the last leg beyond its end.
+func (legs Legs) PointAt(path PathModel, s float64) Vector {
+	for i, leg := range legs {
+		length := path.Angle(leg.Loc1, leg.Loc2)
+		if s <= length || i == len(legs)-1 {
+			return path.PointAt(leg.Loc1, leg.Loc2, s)
+		}
+		s -= length
+	}
+	return Vector{}
+}
+
 func (locs Locations) Path(labstr, datapath string) {
 	locs2 := locs.LabelsToLocations(labstr)
 	legs := locs2.ToLegs()
 	if len(legs) > 0 {
 		var dist float64
 		for _, leg := range legs {
-			dist += RadToDist(
-				leg.Loc1.ToCartesianVector().AngleWith(
-					leg.Loc2.ToCartesianVector()))
+			dist += pathModel.Length(leg.Loc1, leg.Loc2)
 		}
 		Println(
-			"Great circle path length across %d locations is %.1f km",
-			len(locs2), dist)
+			"Path length by %s on the %s across %d locations is %.1f km",
+			pathModel.Name(), geodesy.Name(), len(locs2), dist)
 		locs2.WriteToSimpleCSV(datapath)
 	} else {
 		Println("Cannot process path for a single location")
@@ -18,14 +18,19 @@ type Location struct {
 	Country		string
 	State		string
 	Region		string
+	Elevation	float64 // ft
 	// Airport
 	Kind		string
 	FAAcode		string
 	IATAcode	string
 	Desc		string
 	Name		string
+	RunwayLength	float64 // ft, longest
 	// Waypoint
 	Control     string
+	Frequency	float64 // kHz
+	// Name of the LocationSource it came from
+	Source		string
 }
 
 func NewLocation() *Location {
@@ -55,30 +60,68 @@ func (loc Location) Id() string {
 	}
 }
 
-func (loc Location) ToCSVLine() string {
-	return fmt.Sprintf(
-		"%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%.6f,%.6f\n",
-		FixText(loc.Type),			// 0
-		FixText(loc.Country),		// 1
-		FixText(loc.State),			// 2
-		FixText(loc.Region),		// 3
-		FixText(loc.ICAOcode),		// 4
-		FixText(loc.IATAcode),		// 5
-		FixText(loc.FAAcode),		// 6
-		FixText(loc.Name),			// 7
-		FixText(loc.Kind),			// 8
-		FixText(loc.Desc),			// 9
-		FixText(loc.Control),		// 10
-        loc.Lat,					// 11
-		loc.Long)					// 12
+// Columns of the native csv file, as named in its header.
+var NATIVE_COLUMNS []string = []string{"type", "country", "state", "region",
+	"icao", "iata", "faa", "name", "kind", "desc", "control", "lat", "long",
+	"elevation", "runway", "frequency", "source"}
+
+// Record for the native csv file, in the order of NATIVE_COLUMNS, text in
+// full and numbers exactly.
+func (loc Location) ToCSVRecord() []string {
+	number := func(x float64) string {
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return []string{loc.Type, loc.Country, loc.State, loc.Region,
+		loc.ICAOcode, loc.IATAcode, loc.FAAcode, loc.Name, loc.Kind, loc.Desc,
+		loc.Control, number(loc.Lat), number(loc.Long), number(loc.Elevation),
+		number(loc.RunwayLength), number(loc.Frequency), loc.Source}
 }
 
-func FixText(txt string) string {
-	result := strings.Replace(txt, ",", " ", -1)
-	result = strings.Replace(result, "\"", "", -1)
-	return result
+// Location from a record of the native csv file, its fields found by the
+// columns of the header, n being the line.  Columns not known are ignored,
+// and those missing left empty, so files from later versions with more
+// columns can be read.
+func FromCSVRecord(record []string, columns map[string]int, n int) Location {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	number := func(name string) float64 {
+		txt := field(name)
+		if len(txt) == 0 {
+			return 0.0
+		}
+		x, err := strconv.ParseFloat(txt, 64)
+		if err != nil {
+			Fatal("Line %d has %q for %s, not a number", n, txt, name)
+		}
+		return x
+	}
+	return Location{
+		Type:			field("type"),
+		Country:		field("country"),
+		State:			field("state"),
+		Region:			field("region"),
+		ICAOcode:		field("icao"),
+		IATAcode:		field("iata"),
+		FAAcode:		field("faa"),
+		Name:			field("name"),
+		Kind:			field("kind"),
+		Desc:			field("desc"),
+		Control:		field("control"),
+		Lat:			number("lat"),
+		Long:			number("long"),
+		Elevation:		number("elevation"),
+		RunwayLength:	number("runway"),
+		Frequency:		number("frequency"),
+		Source:			field("source"),
+	}
 }
 
+// Location from a line of a version 1 native csv file, which had no header,
+// and commas and quotes removed from its text.
 func FromCSVLine(parts []string, n int) Location {
 	if len(parts) != 13 {
 		Fatal("Line %d has %d, not 13 columns", n, len(parts))
@@ -116,12 +159,15 @@ func (locs Locations) RemoveRedundant(d float64) Locations {
 		"Removing redundancies from %d raw locations, might take a while", n0)
 	t0 := time.Now()
 	ddeg := RadToDeg(DistToRad(d/1000.0))
+	// Index holds only earlier locations, so the first match is the same one
+	// a scan from the start would find.
+	idx := NewGridIndex(locs, ddeg)
 	keep := []int{}
 	found := false
 	var i, j int
 	for i = 0; i<len(locs); i++ {
 		found = false
-		for j = 0; j < i; j++ {
+		for _, j = range idx.InSquare(locs[i].Lat, locs[i].Long, ddeg) {
 			if math.Abs(locs[i].Lat-locs[j].Lat) < ddeg &&
 				math.Abs(locs[i].Long-locs[j].Long) < ddeg {
 				found = true
@@ -136,6 +182,7 @@ func (locs Locations) RemoveRedundant(d float64) Locations {
 		if !found {
 			keep = append(keep, i)
 		}
+		idx.Insert(i)
 	}
 	result := Locations([]Location{})
 	for _, i = range keep {
@@ -192,7 +239,7 @@ func (locs Locations) PrintNearbyLocations(label string, d float64) {
 		2*d, 2*d, loc0)
 	ddeg := RadToDeg(DistToRad(d/1000.0))
 	c := 0
-	for i := 0; i<len(locs); i++ {
+	for _, i := range locs.Index(ddeg).InSquare(loc0.Lat, loc0.Long, ddeg) {
 		if i != i0 {
 			if math.Abs(locs[i].Lat-loc0.Lat) < ddeg &&
 				math.Abs(locs[i].Long-loc0.Long) < ddeg {
@@ -208,6 +255,55 @@ func (locs Locations) PrintNearbyLocations(label string, d float64) {
     os.Exit(0)
 }
 
+// Dispatch -n to the square, circle (-c) or k-nearest (-k) search.
+func (locs Locations) PrintNearby(label string) {
+	if cmdNearest > 0 {
+		locs.PrintNearestLocations(label, cmdNearest)
+	} else if cmdCircle {
+		locs.PrintLocationsWithinRadius(label, cmdDelta)
+	} else {
+		locs.PrintNearbyLocations(label, cmdDelta)
+	}
+}
+
+// Great circle distance search in a circle of radius d, in m.
+func (locs Locations) PrintLocationsWithinRadius(label string, d float64) {
+	loc0, exist, i0 := locs.FindBy(label)
+	if !exist {
+		Println("No location found with that label code")
+		os.Exit(1)
+	}
+	Println(
+		"Results within a circle of radius %.1f m centered on %v:", d, loc0)
+	c := 0
+	for _, nb := range locs.WithinRadius(loc0, d/1000.0) {
+		if nb.Index != i0 {
+			Println(" %v", nb)
+			c++
+		}
+	}
+	Println("Found %d locations", c)
+	os.Exit(0)
+}
+
+func (locs Locations) PrintNearestLocations(label string, k int) {
+	loc0, exist, i0 := locs.FindBy(label)
+	if !exist {
+		Println("No location found with that label code")
+		os.Exit(1)
+	}
+	Println("The %d locations nearest to %v:", k, loc0)
+	// Ask for one more, since the centre will be among them
+	c := 0
+	for _, nb := range locs.Nearest(loc0, k+1) {
+		if nb.Index != i0 && c < k {
+			Println(" %v", nb)
+			c++
+		}
+	}
+	os.Exit(0)
+}
+
 func (locs Locations) FindByICAO(icaoCode string) (Location, bool, int) {
 	for i, loc := range locs {
 		if loc.ICAOcode == icaoCode {
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	. "math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A World Magnetic Model, read from the Gauss coefficients of a WMM.COF file
+// as published by NOAA, giving the declination at a location and date.
+type MagneticModel struct {
+	Name	string
+	Epoch	float64 // decimal year
+	Nmax	int
+	// Gauss coefficients in nT, and their secular variation in nT/year,
+	// indexed by degree n and order m
+	G, H, Gdot, Hdot	[][]float64
+}
+
+// Reference radius in km of the model's spherical harmonics.
+const WMM_REF_RAD float64 = 6371.2
+
+// Latitude nearest a pole at which the declination is found, since it is
+// not defined at the pole itself.
+const WMM_MAX_LAT float64 = 89.99999 // deg
+
+func GetMagneticModelPath(datapath string) string {
+	return filepath.Join(datapath, WMM_COF_NAME)
+}
+
+// Read a coefficient file: a header line with the epoch and model name, then
+// a line of n, m, g, h, gdot, hdot for each term, ending with a line of 9s.
+func ReadMagneticModelFile(path string) *MagneticModel {
+	file, err := os.Open(path)
+	if err != nil {
+		Fatal("Could not open magnetic model, download WMM.COF into the " +
+			"data directory: %v", err)
+	}
+	defer file.Close()
+	mm := &MagneticModel{}
+	type term struct {
+		n, m	int
+		coeffs	[]float64
+	}
+	terms := []term{}
+	scanner := bufio.NewScanner(file)
+	for nline := 1; scanner.Scan(); nline++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "9999") {
+			break
+		}
+		if nline == 1 {
+			if len(fields) < 2 {
+				Fatal("Magnetic model %s has no epoch and name", path)
+			}
+			mm.Epoch, err = strconv.ParseFloat(fields[0], 64)
+			ifError(err)
+			mm.Name = fields[1]
+			continue
+		}
+		if len(fields) != 6 {
+			Fatal("Magnetic model %s line %d has %d fields, not 6",
+				path, nline, len(fields))
+		}
+		t := term{}
+		t.n, err = strconv.Atoi(fields[0])
+		ifError(err)
+		t.m, err = strconv.Atoi(fields[1])
+		ifError(err)
+		if t.n < 1 || t.m < 0 || t.m > t.n {
+			Fatal("Magnetic model %s line %d has degree %d, order %d",
+				path, nline, t.n, t.m)
+		}
+		for _, f := range fields[2:] {
+			x, err := strconv.ParseFloat(f, 64)
+			ifError(err)
+			t.coeffs = append(t.coeffs, x)
+		}
+		terms = append(terms, t)
+		if t.n > mm.Nmax {
+			mm.Nmax = t.n
+		}
+	}
+	ifError(scanner.Err())
+	if len(terms) == 0 {
+		Fatal("Magnetic model %s has no coefficients", path)
+	}
+	for _, c := range []*[][]float64{&mm.G, &mm.H, &mm.Gdot, &mm.Hdot} {
+		*c = make([][]float64, mm.Nmax + 1)
+		for n := range *c {
+			(*c)[n] = make([]float64, n + 1)
+		}
+	}
+	for _, t := range terms {
+		mm.G[t.n][t.m], mm.H[t.n][t.m] = t.coeffs[0], t.coeffs[1]
+		mm.Gdot[t.n][t.m], mm.Hdot[t.n][t.m] = t.coeffs[2], t.coeffs[3]
+	}
+	return mm
+}
+
+func (mm *MagneticModel) String() string {
+	return fmt.Sprintf("%s, epoch %.1f, degree %d", mm.Name, mm.Epoch, mm.Nmax)
+}
+
+// Year with the fraction of it passed, e.g. 2014.18 for 8 March 2014.
+func DecimalYear(t time.Time) float64 {
+	t = t.UTC()
+	start := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(t.Year() + 1, 1, 1, 0, 0, 0, 0, time.UTC)
+	return float64(t.Year()) + t.Sub(start).Seconds()/end.Sub(start).Seconds()
+}
+
+// Schmidt semi-normalised associated Legendre functions of cos theta, and
+// their derivatives with respect to theta, up to degree nmax.
+func schmidtLegendre(nmax int, theta float64) ([][]float64, [][]float64) {
+	P := make([][]float64, nmax + 1)
+	dP := make([][]float64, nmax + 1)
+	for n := range P {
+		P[n] = make([]float64, n + 1)
+		dP[n] = make([]float64, n + 1)
+	}
+	ct, st := Cos(theta), Sin(theta)
+	P[0][0] = 1.0
+	for n := 1; n <= nmax; n++ {
+		// Sectoral terms from the one before
+		if n == 1 {
+			P[1][1], dP[1][1] = st, ct
+		} else {
+			k := Sqrt(float64(2*n - 1)/float64(2*n))
+			P[n][n] = k*st*P[n-1][n-1]
+			dP[n][n] = k*(ct*P[n-1][n-1] + st*dP[n-1][n-1])
+		}
+		// The rest from the two degrees before
+		for m := 0; m < n; m++ {
+			k1 := float64(2*n - 1)
+			k2 := Sqrt(float64((n - 1)*(n - 1) - m*m))
+			k := Sqrt(float64(n*n - m*m))
+			P[n][m] = k1*ct*P[n-1][m]/k
+			dP[n][m] = k1*(ct*dP[n-1][m] - st*P[n-1][m])/k
+			if n - 2 >= m {
+				P[n][m] -= k2*P[n-2][m]/k
+				dP[n][m] -= k2*dP[n-2][m]/k
+			}
+		}
+	}
+	return P, dP
+}
+
+// North, east and down components in nT of the field at sea level at loc on
+// the date, with north and down in the geodetic frame.
+func (mm *MagneticModel) Field(loc Location, date time.Time) (float64, float64, float64) {
+	dt := DecimalYear(date) - mm.Epoch
+	lat := DegToRad(Max(-WMM_MAX_LAT, Min(WMM_MAX_LAT, loc.Lat)))
+	long := DegToRad(loc.Long)
+	// Geocentric latitude and radius of the point on the WGS-84 ellipsoid
+	wgs := WGS84.(Ellipsoid)
+	e2 := wgs.F*(2.0 - wgs.F)
+	rc := wgs.A/Sqrt(1.0 - e2*Sin(lat)*Sin(lat))
+	p := rc*Cos(lat)
+	z := rc*(1.0 - e2)*Sin(lat)
+	r := Sqrt(p*p + z*z)
+	latc := Asin(z/r)
+	P, dP := schmidtLegendre(mm.Nmax, PI_2 - latc)
+	var x, y, zc float64
+	for n := 1; n <= mm.Nmax; n++ {
+		scale := Pow(WMM_REF_RAD/r, float64(n + 2))
+		for m := 0; m <= n; m++ {
+			g := mm.G[n][m] + dt*mm.Gdot[n][m]
+			h := mm.H[n][m] + dt*mm.Hdot[n][m]
+			cm, sm := Cos(float64(m)*long), Sin(float64(m)*long)
+			x += scale*(g*cm + h*sm)*dP[n][m]
+			y += scale*float64(m)*(g*sm - h*cm)*P[n][m]
+			zc -= scale*float64(n + 1)*(g*cm + h*sm)*P[n][m]
+		}
+	}
+	y /= Cos(latc)
+	// From geocentric to geodetic
+	psi := latc - lat
+	return x*Cos(psi) - zc*Sin(psi), y, x*Sin(psi) + zc*Cos(psi)
+}
+
+// Declination in deg at loc on the date, east of true north positive, which
+// is added to a magnetic course to give the true course.
+func (mm *MagneticModel) Declination(loc Location, date time.Time) float64 {
+	x, y, _ := mm.Field(loc, date)
+	return RadToDeg(Atan2(y, x))
+}
+
+// Magnetic course range as true courses, given the declination in deg.
+func MagneticToTrue(heading []float64, declination float64) []float64 {
+	return []float64{
+		normalizeAzimuth(heading[0] + declination),
+		normalizeAzimuth(heading[1] + declination),
+	}
+}
@@ -18,7 +18,13 @@ type Flyby struct {
 	Ang23	float64 // rad
 	Ang13	float64 // rad
 	Nearest	float64 // rad
-	Heading	float64 // deg from north (-ve west, +ve east)
+	Heading	float64 // rad, true course at the nearest point, Loc1 to Loc2
+	AlongTrack	float64 // rad from Loc1 to nearest point
+	Crab		float64 // deg, heading less track, when there is wind
+	GroundSpeed	float64 // km/h, when there is wind
+	Observers	[]ObserverFix // when there is more than one observer
+	Score		float64 // product of Factors, when scoring
+	Factors		[]ScoreFactor
 }
 
 type FlybyFilter interface {
@@ -70,97 +76,144 @@ func (locs Locations) FindPairsPassingWithinRadius(filters []FlybyFilter) []Flyb
 	return results
 }
 
-// We try to eliminate pairs from calculation (counted as "avoided").
+// Filter for great circle paths from loc1 to loc2 passing within dmax km of
+// loc3 at a true course within dir, from dir[0] clockwise to dir[1] deg.
+// Paths are tried in both directions, and the Flyby goes from Loc1 to Loc2
+// in the direction of travel.  Pairs too far apart, or too far from loc3
+// either way round, are rejected first (counted as "avoided").  Limits on b
+// and c apply to the start and end in the direction of travel.
 func MakeNearestApproachFilter(loc3 Location, amax, bmax, cmax, dmax float64, dir []float64) func(loc1, loc2 Location) (bool, bool, *Flyby) {
 	if len(dir) != 2 {
-		Fatal("Latitude range for great circle normal must have " +
-			"two numbers, but %d given", len(dir))
+		Fatal("Course range must have two numbers, but %d given", len(dir))
 	}
-	dir0 := DegToRad(dir[0])
-	dir1 := DegToRad(dir[1])
 	amax = DistToRad(amax)
 	bmax = DistToRad(bmax)
 	cmax = DistToRad(cmax)
 	dmax = DistToRad(dmax)
-	avoid := false
-	var tmp Location
-	var a, b, c, d, B, C, e float64
-	var v0, v1, n, t Vector
-	var northdev float64
+	var a, b, c, d, B, C, e, course float64
+	var v1, n, v4 Vector
 	return func(loc1, loc2 Location) (bool, bool, *Flyby) {
-		avoid = false
-		if loc3.Lat < 0 && loc1.Lat > 0 && loc2.Lat > 0 {
-			// loc1, loc2 both other side of equator
-			avoid = true
+		a, b, c = UnitSphericalTriangleSides(loc1, loc2, loc3)
+		//
+		//                   3            1 start, 2 end, 3 fixed, 4 nearest
+		//                  _.__   c      a -> d great circles segments
+		//          b   _--`  \ ```-._    A, B, C spherical triangle angles
+		//          _--`     d \ __-*` 2  d meets 4 perpendicularly
+		//       _-`       __--`4   (B)   ab form C, ac form B
+		//     .` C  __--``      
+		//    /__--``        a
+		//  1                   
+		if a > amax || (b > bmax || c > cmax) && (c > bmax || b > cmax) {
+			return false, true, nil
 		}
-		if loc3.Lat > 0 && loc1.Lat < 0 && loc2.Lat < 0 {
-			// loc1, loc2 both other side of equator
-			avoid = true
+		// Cosine rule
+		C = SafeAcos((Cos(c) - Cos(a)*Cos(b)) / (Sin(a)*Sin(b)))
+		if C >= PI_2 {
+			return false, false, nil
 		}
-		if !avoid {
-			// Order loc1, loc2, always go north to south
-			if loc1.Lat > loc2.Lat {
-				tmp = loc2
-				loc2 = loc1
-				loc1 = tmp
-			}
-			a, b, c = UnitSphericalTriangleSides(loc1, loc2, loc3)
-			//
-			//                   3            1 start, 2 end, 3 fixed, 4 nearest
-			//                  _.__   c      a -> d great circles segments
-			//          b   _--`  \ ```-._    A, B, C spherical triangle angles
-			//          _--`     d \ __-*` 2  d meets 4 perpendicularly
-			//       _-`       __--`4   (B)   ab form C, ac form B
-			//     .` C  __--``      
-			//    /__--``        a
-			//  1                   
-			if a <= amax && b <= bmax && c <= cmax {
-				// Cosine rule
-				C = Acos((Cos(c) - Cos(a)*Cos(b)) / (Sin(a)*Sin(b)))
-				if RadToDeg(C) < 90 {
-					d = Asin(Sin(b)*Sin(C)) // Sine rule
-					if d <= dmax {
-						B = Acos((Cos(b) - Cos(c)*Cos(a)) / (Sin(c)*Sin(a)))
-						if RadToDeg(B) < 90 {
-							// Check compass heading.
-							// e is angular distance from start of path on gc to
-							// nearest point on gc to loc3.
-							e = Atan(Cos(C)*Tan(b)) // One of Napier's rules
-							// Rotate vector to start point 1, around gc normal
-							// vector, by angle e, to get vector to nearest
-							// point (4) on gc to loc3.
-							v0 = loc1.ToCartesianVector() // start
-                            n = GreatCircleNormal(loc1, loc2).Norm()
-							v1 = v0.RotateAround(n, e) // nearest gc pt to loc3
-                            t = v1.Cross(n).Neg() // tangent to gc at this pt
-							northdev, _ = t.Norm().UnitToUnitSpherical()
-							// Deviation from north in rad,
-							// -ve -> west, +ve -> east
-							northdev = Abs(northdev)*Sign(n.Z)
-							if northdev >= dir0 && northdev <= dir1 {
-								fb := &Flyby{
-									GreatCircle: GreatCircle{
-										Loc1:	loc1,
-										Loc2:	loc2,
-										Ang12:	a,
-									},
-									B:			B,
-									C:			C,
-									Ang23:		c,
-									Ang13:		b,
-									Nearest:	d,
-									Heading:	northdev,
-								}
-								return true, false, fb
-							}
-						}
-					}
-				}
-			}
+		d = Asin(Sin(b)*Sin(C)) // Sine rule
+		if d > dmax {
+			return false, false, nil
+		}
+		B = SafeAcos((Cos(b) - Cos(c)*Cos(a)) / (Sin(c)*Sin(a)))
+		if B >= PI_2 {
 			return false, false, nil
 		}
-		return false, true, nil
+		// e is angular distance from start of path on gc to nearest point
+		// on gc to loc3.  One of Napier's rules, tan e = cos C tan b, with e
+		// beyond a right angle when b is, since cos b = cos d cos e.
+		e = Atan2(Cos(C)*Sin(b), Cos(b))
+		// Rotate vector to start point 1, around gc normal vector, by angle
+		// e, to get vector to nearest point (4) on gc to loc3, and find the
+		// course there.
+		v1 = loc1.ToCartesianVector()
+		n = GreatCircleNormal(loc1, loc2).Norm()
+		v4 = v1.RotateAround(n, e)
+		course = CourseAt(v4, n.Cross(v4))
+		fb := &Flyby{
+			GreatCircle: GreatCircle{
+				Loc1:	loc1,
+				Loc2:	loc2,
+				Ang12:	a,
+			},
+			B:			B,
+			C:			C,
+			Ang23:		c,
+			Ang13:		b,
+			Nearest:	d,
+			Heading:	DegToRad(course),
+			AlongTrack:	e,
+		}
+		if InCourseRange(course, dir[0], dir[1]) && b <= bmax && c <= cmax {
+			return true, false, fb
+		}
+		// The other way
+		course = Mod(course + 180.0, 360.0)
+		if InCourseRange(course, dir[0], dir[1]) && c <= bmax && b <= cmax {
+			fb.Loc1, fb.Loc2 = loc2, loc1
+			fb.B, fb.C = C, B
+			fb.Ang23, fb.Ang13 = b, c
+			fb.Heading = DegToRad(course)
+			fb.AlongTrack = a - e
+			return true, false, fb
+		}
+		return false, false, nil
+	}
+}
+
+// True course in deg [0, 360) of travel in direction t at the point with unit
+// vector p, from its local east and north.  At a pole, where every direction
+// is south or north, the course is taken as if at longitude 0.
+func CourseAt(p, t Vector) float64 {
+	east := Vector{0.0, 0.0, 1.0}.Cross(p)
+	if east.Mag() < 1e-12 {
+		east = Vector{0.0, -1.0, 0.0}
+	}
+	east = east.Norm()
+	north := p.Cross(east)
+	return Mod(RadToDeg(Atan2(t.Dot(east), t.Dot(north))) + 360.0, 360.0)
+}
+
+// Width in deg of the course range from from clockwise to to, which is the
+// whole circle if to is 360 or more beyond from.
+func CourseSpan(from, to float64) float64 {
+	if to - from >= 360.0 {
+		return 360.0
 	}
+	return Mod(Mod(to - from, 360.0) + 360.0, 360.0)
+}
+
+// Whether course lies in the range from from clockwise to to, all in deg.
+func InCourseRange(course, from, to float64) bool {
+	return Mod(Mod(course - from, 360.0) + 360.0, 360.0) <=
+		CourseSpan(from, to) + 1e-9
+}
+
+// Course range widened by w deg at each end.
+func WidenCourseRange(dir []float64, w float64) []float64 {
+	span := CourseSpan(dir[0], dir[1])
+	if span + 2.0*w >= 360.0 {
+		return []float64{0.0, 360.0}
+	}
+	return []float64{dir[0] - w, dir[0] + span + w}
+}
+
+// Least angle in deg between two courses.
+func CourseDifference(c1, c2 float64) float64 {
+	return Abs(Remainder(c1 - c2, 360.0))
+}
+
+// Course in [0, 360) in the range from from clockwise to to nearest course,
+// all in deg.
+func ClampCourse(course, from, to float64) float64 {
+	if !InCourseRange(course, from, to) {
+		if CourseDifference(course, from) <= CourseDifference(course, to) {
+			course = from
+		} else {
+			course = to
+		}
+	}
+	return Mod(Mod(course, 360.0) + 360.0, 360.0)
 }
 
 func (locs Locations) findPairsPassingWithinRadius(n1, n2 int, filter FlybyFilter, iproc int, parent chan []Flyby) {
@@ -222,6 +275,11 @@ func maxPairs(j1, j2 int) int {
 	return (j2-j1)*(1+j1+j2)/2
 }
 
+// Acos, for arguments rounded just beyond [-1, 1], as for a point on a path.
+func SafeAcos(x float64) float64 {
+	return Acos(Max(-1.0, Min(1.0, x)))
+}
+
 func Sign(x float64) float64 {
 	if x < 0.0 {
 		return -1.0
@@ -259,6 +317,17 @@ func DistToRad(dist float64) float64 {
 	return dist/EARTH_RAD
 }
 
+// Initial bearing in deg clockwise from north, [0, 360), of the great circle
+// path from loc to loc2.
+func (loc Location) BearingTo(loc2 Location) float64 {
+	lat1, long1 := LatLongToRadians(loc)
+	lat2, long2 := LatLongToRadians(loc2)
+	dlong := long2 - long1
+	y := Sin(dlong)*Cos(lat2)
+	x := Cos(lat1)*Sin(lat2) - Sin(lat1)*Cos(lat2)*Cos(dlong)
+	return Mod(RadToDeg(Atan2(y, x)) + 360.0, 360.0)
+}
+
 func (loc Location) ToUnitSpherical() (float64, float64) {
 	return LatToPolar(loc.Lat), LongToAzimuth(loc.Long)
 }
@@ -291,6 +360,14 @@ func (v Vector) Neg() Vector {
 	}
 }
 
+func (v Vector) Add(u Vector) Vector {
+	return Vector{
+		v.X + u.X,
+		v.Y + u.Y,
+		v.Z + u.Z,
+	}
+}
+
 func (v Vector) Mag() float64 {
 	return Sqrt(v.X*v.X + v.Y*v.Y + v.Z*v.Z)
 }
@@ -310,7 +387,8 @@ func (v Vector) Dot(u Vector) float64 {
 
 // Angle between vectors in radians
 func (v Vector) AngleWith(u Vector) float64 {
-	return Acos(v.Norm().Dot(u.Norm()))
+	// Rounding can take the dot product of parallel vectors just past 1
+	return SafeAcos(v.Norm().Dot(u.Norm()))
 }
 
 func (v Vector) Cross(u Vector) Vector {
@@ -346,7 +424,7 @@ func RotationMatrix(u Vector, a float64) Matrix {
 			u.Y*u.Z*(1-Cos(a)) - u.X*Sin(a),
 		},
 		R2: Vector{
-			u.Z*u.Z*(1-Cos(a)) - u.Y*Sin(a),
+			u.Z*u.X*(1-Cos(a)) - u.Y*Sin(a),
 			u.Z*u.Y*(1-Cos(a)) + u.X*Sin(a),
 			Cos(a) + u.Z*u.Z*(1-Cos(a)),
 		},
@@ -354,8 +432,8 @@ func RotationMatrix(u Vector, a float64) Matrix {
 }
 
 func (v Vector) UnitToUnitSpherical() (polar, azim float64) {
-	polar = Acos(v.Z)
-	azim = Atan(v.Y/v.X)
+	polar = SafeAcos(v.Z)
+	azim = Atan2(v.Y, v.X)
 	return
 }
 
@@ -371,12 +449,51 @@ func (loc Location) ToCartesianVector() Vector {
 	return UnitSphericalToCartesianVector(loc.ToUnitSpherical())
 }
 
+// Inverse of ToCartesianVector, for a vector of any length.
+func (v Vector) ToLocation() Location {
+	u := v.Norm()
+	long := RadToDeg(Atan2(u.Y, u.X) - PI)
+	if long < -180.0 {
+		long += 360.0
+	}
+	return Location{
+		Lat:	PolarToLat(SafeAcos(u.Z)),
+		Long:	long,
+	}
+}
+
 func GreatCircleNormal(loc1, loc2 Location) Vector {
 	v := loc1.ToCartesianVector()
 	u := loc2.ToCartesianVector()
 	return v.Cross(u)
 }
 
+// Least angular distance in rad from loc3 to the great circle segment from
+// loc1 to loc2, which is the cross-track distance if the nearest point lies
+// between them, otherwise the distance to the nearer end.
+func SegmentDistance(loc1, loc2, loc3 Location) float64 {
+	v1 := loc1.ToCartesianVector()
+	v2 := loc2.ToCartesianVector()
+	v3 := loc3.ToCartesianVector()
+	ends := Min(v1.AngleWith(v3), v2.AngleWith(v3))
+	n := v1.Cross(v2)
+	if n.Mag() < 1e-12 {
+		return ends
+	}
+	n = n.Norm()
+	xt := v3.Dot(n)
+	// Foot of the perpendicular, on the segment if the angles add up
+	p := Vector{v3.X - xt*n.X, v3.Y - xt*n.Y, v3.Z - xt*n.Z}
+	if p.Mag() < 1e-12 {
+		return ends
+	}
+	a := v1.AngleWith(v2)
+	if Abs(v1.AngleWith(p) + p.AngleWith(v2) - a) < 1e-9 {
+		return Asin(Min(1.0, Abs(xt)))
+	}
+	return ends
+}
+
 // On unit sphere, side lengths same as included angles.
 func UnitSphericalTriangleSides(loc1, loc2, loc3 Location) (a, b, c float64) {
     a = loc1.ToCartesianVector().AngleWith(loc2.ToCartesianVector())
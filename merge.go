@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// How locations from different sources describing the same place are matched
+// and combined into one.  Each field is taken from the first source in
+// Priority with a value for it, unless Fields gives sources to prefer for
+// that field.
+type MergePolicy struct {
+	Priority		[]string // source names
+	Fields			map[string][]string // by field name, source names
+	CodeDist		float64 // km, furthest apart locations sharing a code match
+	NearDist		float64 // km, furthest apart locations match by name
+	MinSimilarity	float64 // of names, 0 to 1
+	ConflictDist	float64 // km, coordinates further apart are reported
+}
+
+// A merged location whose sources disagree on where it is, with the
+// locations from each source and their distances in km from the merged one.
+type MergeConflict struct {
+	Merged	Location
+	Sources	Locations
+	Dist	[]float64
+}
+
+type MergeConflicts []MergeConflict
+
+// A field of Location taken as a whole from one source.
+type mergeField struct {
+	name	string
+	has		func(loc Location) bool
+	take	func(loc *Location, from Location)
+}
+
+const (
+	MERGE_CODE_DIST float64 = 50.0
+	MERGE_NEAR_DIST float64 = 1.0
+	MERGE_NAME_SIMILARITY float64 = 0.6
+)
+
+var MERGE_FIELDS []mergeField = []mergeField{
+	{"coords", func(loc Location) bool { return true },
+		func(loc *Location, from Location) { loc.Lat, loc.Long = from.Lat, from.Long }},
+	{"country", func(loc Location) bool { return len(loc.Country) > 0 },
+		func(loc *Location, from Location) { loc.Country = from.Country }},
+	{"state", func(loc Location) bool { return len(loc.State) > 0 },
+		func(loc *Location, from Location) { loc.State = from.State }},
+	{"region", func(loc Location) bool { return len(loc.Region) > 0 },
+		func(loc *Location, from Location) { loc.Region = from.Region }},
+	{"icao", func(loc Location) bool { return len(loc.ICAOcode) > 0 },
+		func(loc *Location, from Location) { loc.ICAOcode = from.ICAOcode }},
+	{"iata", func(loc Location) bool { return len(loc.IATAcode) > 0 },
+		func(loc *Location, from Location) { loc.IATAcode = from.IATAcode }},
+	{"faa", func(loc Location) bool { return len(loc.FAAcode) > 0 },
+		func(loc *Location, from Location) { loc.FAAcode = from.FAAcode }},
+	{"name", func(loc Location) bool { return len(loc.Name) > 0 },
+		func(loc *Location, from Location) { loc.Name = from.Name }},
+	{"desc", func(loc Location) bool { return len(loc.Desc) > 0 },
+		func(loc *Location, from Location) { loc.Desc = from.Desc }},
+	{"kind", func(loc Location) bool { return len(loc.Kind) > 0 },
+		func(loc *Location, from Location) { loc.Kind = from.Kind }},
+	{"elevation", func(loc Location) bool { return loc.Elevation != 0 },
+		func(loc *Location, from Location) { loc.Elevation = from.Elevation }},
+	{"runway", func(loc Location) bool { return loc.RunwayLength > 0 },
+		func(loc *Location, from Location) { loc.RunwayLength = from.RunwayLength }},
+	{"control", func(loc Location) bool { return len(loc.Control) > 0 },
+		func(loc *Location, from Location) { loc.Control = from.Control }},
+	{"frequency", func(loc Location) bool { return loc.Frequency > 0 },
+		func(loc *Location, from Location) { loc.Frequency = from.Frequency }},
+}
+
+func GetMergeConflictsPath(datapath string) string {
+	return filepath.Join(datapath, MERGE_CONFLICTS_NAME)
+}
+
+// The default policy for the sources given, first preferred, with field
+// preferences such as "coords=arinc,ourairports;frequency=xplane".
+func NewMergePolicy(sources []string, prefer string, conflict float64) MergePolicy {
+	policy := MergePolicy{
+		Fields:			map[string][]string{},
+		CodeDist:		MERGE_CODE_DIST,
+		NearDist:		MERGE_NEAR_DIST,
+		MinSimilarity:	MERGE_NAME_SIMILARITY,
+		ConflictDist:	conflict,
+	}
+	for _, src := range sources {
+		policy.Priority = append(policy.Priority, strings.TrimSpace(src))
+	}
+	for _, pref := range strings.Split(prefer, ";") {
+		if len(strings.TrimSpace(pref)) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pref, "=", 2)
+		field := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || mergeFieldIndex(field) < 0 {
+			Fatal("Merge preference %q must be a field=sources, the field " +
+				"one of %s", pref, strings.Join(mergeFieldNames(), ", "))
+		}
+		for _, src := range strings.Split(parts[1], ",") {
+			policy.Fields[field] = append(policy.Fields[field],
+				LocationSourceByName(src).Name())
+		}
+	}
+	return policy
+}
+
+func mergeFieldIndex(name string) int {
+	for i, field := range MERGE_FIELDS {
+		if field.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func mergeFieldNames() []string {
+	names := []string{}
+	for _, field := range MERGE_FIELDS {
+		names = append(names, field.name)
+	}
+	return names
+}
+
+// Rank of the source for the field, lower preferred.
+func (policy MergePolicy) rank(field, source string) int {
+	for i, src := range policy.Fields[field] {
+		if src == source {
+			return i
+		}
+	}
+	n := len(policy.Fields[field])
+	for i, src := range policy.Priority {
+		if src == source {
+			return n + i
+		}
+	}
+	return n + len(policy.Priority)
+}
+
+// Names in capitals, keeping only letters and digits, and spaces between.
+func normalizeName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToUpper(name),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}), " ")
+}
+
+// Edit distance between strings, in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb) + 1)
+	cur := make([]int, len(rb) + 1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j] + 1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1] + 1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// Similarity of names from 0 to 1, being 1 if either is missing, or one is
+// contained in the other, as with "MALE" and "MALE INTL".
+func NameSimilarity(name1, name2 string) float64 {
+	a, b := normalizeName(name1), normalizeName(name2)
+	if len(a) == 0 || len(b) == 0 || strings.Contains(a, b) ||
+		strings.Contains(b, a) {
+		return 1.0
+	}
+	n := math.Max(float64(len([]rune(a))), float64(len([]rune(b))))
+	return 1.0 - float64(levenshtein(a, b))/n
+}
+
+// Codes a location can be matched by, with its type, since the same code may
+// name both an airport and a waypoint.
+func mergeKeys(loc Location) []string {
+	keys := []string{}
+	for _, code := range []string{"ICAO:" + loc.ICAOcode,
+		"IATA:" + loc.IATAcode, "FAA:" + loc.FAAcode} {
+		if !strings.HasSuffix(code, ":") {
+			keys = append(keys, loc.Type + ":" + code)
+		}
+	}
+	return keys
+}
+
+// Merge locations from different sources describing the same place, those
+// of the same type either sharing a code within CodeDist, or within NearDist
+// with similar names.  Each is matched against the first location of each
+// group, taking the groups in order, and a group takes only one location
+// from each source.  The merged locations are in the order of the first of
+// each group, and record all their sources, joined by +.
+func (locs Locations) Merge(policy MergePolicy) (Locations, MergeConflicts) {
+	groups := [][]int{}
+	byKey := map[string][]int{} // groups by code
+	groupOf := map[int]int{} // first location of group to group
+	ddeg := RadToDeg(DistToRad(policy.NearDist))
+	idx := NewGridIndex(locs, ddeg) // of the first of each group
+	joins := func(g int, loc Location, dmax float64, names bool) bool {
+		first := locs[groups[g][0]]
+		if first.Type != loc.Type {
+			return false
+		}
+		for _, i := range groups[g] {
+			if locs[i].Source == loc.Source {
+				return false
+			}
+		}
+		if names && NameSimilarity(first.Name, loc.Name) < policy.MinSimilarity {
+			return false
+		}
+		dist, _, _ := geodesy.Inverse(first, loc)
+		return dist <= dmax
+	}
+	for i, loc := range locs {
+		g := -1
+		for _, key := range mergeKeys(loc) {
+			for _, g2 := range byKey[key] {
+				if (g < 0 || g2 < g) && joins(g2, loc, policy.CodeDist, false) {
+					g = g2
+				}
+			}
+		}
+		if g < 0 {
+			for _, nb := range idx.WithinRadius(loc, policy.NearDist) {
+				if joins(groupOf[nb.Index], loc, policy.NearDist, true) {
+					g = groupOf[nb.Index]
+					break
+				}
+			}
+		}
+		if g < 0 {
+			g = len(groups)
+			groups = append(groups, []int{})
+			groupOf[i] = g
+			idx.Insert(i)
+		}
+		groups[g] = append(groups[g], i)
+		for _, key := range mergeKeys(loc) {
+			if n := len(byKey[key]); n == 0 || byKey[key][n-1] != g {
+				byKey[key] = append(byKey[key], g)
+			}
+		}
+	}
+	result := Locations([]Location{})
+	conflicts := MergeConflicts([]MergeConflict{})
+	for _, group := range groups {
+		members := Locations([]Location{})
+		for _, i := range group {
+			members = append(members, locs[i])
+		}
+		merged := policy.merge(members)
+		result = append(result, merged)
+		if len(members) < 2 {
+			continue
+		}
+		conflict := MergeConflict{Merged: merged, Sources: members}
+		far := false
+		for _, loc := range members {
+			dist, _, _ := geodesy.Inverse(merged, loc)
+			conflict.Dist = append(conflict.Dist, dist)
+			far = far || dist > policy.ConflictDist
+		}
+		if far {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	Println("Merged %d locations from %d sources into %d, %d disagreeing " +
+		"on coordinates by more than %g km", len(locs), len(policy.Priority),
+		len(result), len(conflicts), policy.ConflictDist)
+	return result, conflicts
+}
+
+// One location from a group, each field from the most preferred source
+// having it.
+func (policy MergePolicy) merge(members Locations) Location {
+	merged := members[0]
+	if len(members) == 1 {
+		return merged
+	}
+	sources := []string{}
+	for _, loc := range members {
+		sources = append(sources, loc.Source)
+	}
+	for _, field := range MERGE_FIELDS {
+		best := -1
+		for i, loc := range members {
+			if field.has(loc) && (best < 0 || policy.rank(field.name,
+				loc.Source) < policy.rank(field.name, members[best].Source)) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			field.take(&merged, members[best])
+		}
+	}
+	merged.Source = strings.Join(sources, "+")
+	return merged
+}
+
+func (mc MergeConflict) String() string {
+	line := fmt.Sprintf("%v from %s:", mc.Merged, mc.Merged.Source)
+	for i, loc := range mc.Sources {
+		line += fmt.Sprintf(" %s %f %f %.3f km;", loc.Source, loc.Lat,
+			loc.Long, mc.Dist[i])
+	}
+	return strings.TrimSuffix(line, ";")
+}
+
+var MERGE_CONFLICT_COLUMNS []string = []string{"type", "id", "lat", "long",
+	"source", "source lat", "source long", "dist"}
+
+// Write a header naming the columns, then one record for each source of each
+// conflict: the merged location, the source, where it puts the location, and
+// how far that is from the merged coordinates in km.
+func (mcs MergeConflicts) WriteToFile(path string) {
+	err := os.RemoveAll(path)
+	ifError(err)
+	if len(mcs) == 0 {
+		return
+	}
+	Println("Writing merge conflicts to %s", path)
+	out, err := os.Create(path)
+	ifError(err)
+	defer out.Close()
+	writer := csv.NewWriter(out)
+	ifError(writer.Write(MERGE_CONFLICT_COLUMNS))
+	coord := func(x float64) string {
+		return strconv.FormatFloat(x, 'f', 6, 64)
+	}
+	for _, mc := range mcs {
+		for i, loc := range mc.Sources {
+			ifError(writer.Write([]string{mc.Merged.Type, mc.Merged.Id(),
+				coord(mc.Merged.Lat), coord(mc.Merged.Long), loc.Source,
+				coord(loc.Lat), coord(loc.Long),
+				strconv.FormatFloat(mc.Dist[i], 'f', 3, 64)}))
+		}
+	}
+	writer.Flush()
+	ifError(writer.Error())
+	return
+}
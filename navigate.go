@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	. "math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spherical navigation on a sphere of radius EARTH_RAD, with distances in km
+// and bearings in deg clockwise from north.
+
+// Bearing on arrival at loc2 of the great circle path from loc.
+func (loc Location) FinalBearingTo(loc2 Location) float64 {
+	return Mod(loc2.BearingTo(loc) + 180.0, 360.0)
+}
+
+// Location dist km from loc along the great circle starting at bearing.
+func (loc Location) Destination(bearing, dist float64) Location {
+	loc2, _ := Sphere{Radius: EARTH_RAD}.Direct(loc, bearing, dist)
+	return loc2
+}
+
+// Location a fraction f of the way along the great circle path from loc to
+// loc2.
+func (loc Location) IntermediateTo(loc2 Location, f float64) Location {
+	v1 := loc.ToCartesianVector()
+	v2 := loc2.ToCartesianVector()
+	a := v1.AngleWith(v2)
+	if a < 1e-12 {
+		return Location{Lat: loc.Lat, Long: loc.Long}
+	}
+	s1 := Sin((1.0 - f)*a)/Sin(a)
+	s2 := Sin(f*a)/Sin(a)
+	return Vector{
+		s1*v1.X + s2*v2.X, s1*v1.Y + s2*v2.Y, s1*v1.Z + s2*v2.Z,
+	}.ToLocation()
+}
+
+func (loc Location) MidpointTo(loc2 Location) Location {
+	return loc.IntermediateTo(loc2, 0.5)
+}
+
+// Distance in km of loc3 from the great circle through Loc1 and Loc2, positive
+// to the right of the path from Loc1 to Loc2 and negative to the left.
+func (gc GreatCircle) CrossTrack(loc3 Location) float64 {
+	n := GreatCircleNormal(gc.Loc1, gc.Loc2).Norm()
+	// The normal points to the left
+	return -RadToDist(Asin(Max(-1.0, Min(1.0, n.Dot(loc3.ToCartesianVector())))))
+}
+
+// Distance in km from Loc1 along the great circle to the point nearest loc3,
+// negative if it lies behind Loc1.
+func (gc GreatCircle) AlongTrack(loc3 Location) float64 {
+	v1 := gc.Loc1.ToCartesianVector()
+	v3 := loc3.ToCartesianVector()
+	n := GreatCircleNormal(gc.Loc1, gc.Loc2).Norm()
+	// Direction of travel at Loc1
+	t := n.Cross(v1)
+	return RadToDist(Atan2(v3.Dot(t), v3.Dot(v1)))
+}
+
+// Where the great circle leaving loc1 at bearing1 first meets that leaving
+// loc2 at bearing2, ahead of both if possible.  False if the great circles
+// are the same.
+func Intersection(loc1 Location, bearing1 float64, loc2 Location, bearing2 float64) (Location, bool) {
+	// Normals of each great circle, from a point along it
+	n1 := GreatCircleNormal(loc1, loc1.Destination(bearing1, 1000.0))
+	n2 := GreatCircleNormal(loc2, loc2.Destination(bearing2, 1000.0))
+	x := n1.Cross(n2)
+	if x.Mag() < 1e-12 {
+		return Location{}, false
+	}
+	x = x.Norm()
+	v1 := loc1.ToCartesianVector()
+	v2 := loc2.ToCartesianVector()
+	// Of the two antipodal intersections, take the one ahead of loc1 and
+	// loc2, or failing that the nearer
+	ahead := n1.Norm().Cross(v1).Dot(x) + n2.Norm().Cross(v2).Dot(x)
+	if ahead < 0 || (ahead == 0 && v1.Add(v2).Dot(x) < 0) {
+		x = x.Neg()
+	}
+	return x.ToLocation(), true
+}
+
+// Position given as "lat,long" in decimal degrees.
+func ParseLatLong(txt string) Location {
+	parts := strings.Split(txt, ",")
+	if len(parts) != 2 {
+		Fatal("Give a position as lat,long, not %q", txt)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	long, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || Abs(lat) > 90 || Abs(long) > 180 {
+		Fatal("Give a position as lat,long in degrees, not %q", txt)
+	}
+	return Location{Lat: lat, Long: long}
+}
+
+func parseGeoNumber(txt string) float64 {
+	x, err := strconv.ParseFloat(txt, 64)
+	if err != nil {
+		Fatal("Expected a number, not %q", txt)
+	}
+	return x
+}
+
+func formatLatLong(loc Location) string {
+	return fmt.Sprintf("%.6f,%.6f", loc.Lat, loc.Long)
+}
+
+// Usage of each -geo operation, by name.
+var GEO_OPS map[string]string = map[string]string{
+	"distance":		"lat,long lat,long",
+	"destination":	"lat,long bearing km",
+	"intermediate":	"lat,long lat,long fraction",
+	"midpoint":		"lat,long lat,long",
+	"crosstrack":	"lat,long lat,long lat,long",
+	"intersection":	"lat,long bearing lat,long bearing",
+	"sun":			"lat,long time",
+}
+
+// Carry out the -geo operation op on the remaining command line args.
+func GeoCommand(op string, args []string) {
+	usage, ok := GEO_OPS[op]
+	if !ok {
+		ops := []string{}
+		for name := range GEO_OPS {
+			ops = append(ops, name)
+		}
+		sort.Strings(ops)
+		Fatal("Unknown -geo operation %q, use one of %s", op,
+			strings.Join(ops, ", "))
+	}
+	if len(args) != len(strings.Fields(usage)) {
+		Fatal("Usage: -geo %s %s", op, usage)
+	}
+	switch op {
+		case "distance":
+			loc1, loc2 := ParseLatLong(args[0]), ParseLatLong(args[1])
+			dist, az1, az2 := geodesy.Inverse(loc1, loc2)
+			Println("Distance on the %s %.3f km, initial bearing %.4f deg, " +
+				"final bearing %.4f deg", geodesy.Name(), dist, az1, az2)
+		case "destination":
+			loc, az := geodesy.Direct(ParseLatLong(args[0]),
+				parseGeoNumber(args[1]), parseGeoNumber(args[2]))
+			Println("Destination on the %s %s, final bearing %.4f deg",
+				geodesy.Name(), formatLatLong(loc), az)
+		case "intermediate":
+			loc := ParseLatLong(args[0]).IntermediateTo(ParseLatLong(args[1]),
+				parseGeoNumber(args[2]))
+			Println("Intermediate point %s", formatLatLong(loc))
+		case "midpoint":
+			loc := ParseLatLong(args[0]).MidpointTo(ParseLatLong(args[1]))
+			Println("Midpoint %s", formatLatLong(loc))
+		case "crosstrack":
+			gc := GreatCircle{Loc1: ParseLatLong(args[0]), Loc2: ParseLatLong(args[1])}
+			loc3 := ParseLatLong(args[2])
+			Println("Cross-track %.4f km, along-track %.4f km",
+				gc.CrossTrack(loc3), gc.AlongTrack(loc3))
+		case "intersection":
+			loc, ok := Intersection(ParseLatLong(args[0]), parseGeoNumber(args[1]),
+				ParseLatLong(args[2]), parseGeoNumber(args[3]))
+			if !ok {
+				Fatal("The paths lie on the same great circle")
+			}
+			Println("Intersection %s", formatLatLong(loc))
+		case "sun":
+			t, err := time.Parse(time.RFC3339, args[1])
+			if err != nil {
+				Fatal("Give the time like \"2014-03-08T06:15:00+05:00\", " +
+					"not %q", args[1])
+			}
+			Println("At %s, %v", t.UTC().Format(time.RFC3339),
+				SunAt(ParseLatLong(args[0]), t))
+	}
+	return
+}
@@ -0,0 +1,233 @@
+package main
+
+// An observer as used by the filter, with its location found, and its
+// heading as true courses even if given as magnetic.
+type ObserverConstraint struct {
+	ObserverSpec
+	Loc			Location
+	Declination	float64 // deg east of true north at Loc, if Declined
+	Declined	bool	// whether a magnetic model is in use
+	Drift		*Drift	// wind at Loc if given, when Heading is the tracks
+}
+
+// What one observer saw of a flyby.
+type ObserverFix struct {
+	Label		string
+	Fits		bool
+	Nearest		float64 // rad
+	Heading		float64 // rad, true course at the nearest point
+	AlongTrack	float64 // rad from Loc1 to nearest point
+	Declination	float64 // deg, at the observer, if Declined
+	Declined	bool
+	// Elevation in deg of the nearest point, at the lowest and highest
+	// altitudes, if the observer has a Sight
+	Elevation	[]float64
+	Sighted		bool
+	// Angle in deg between the aircraft's heading at the nearest point and
+	// the sun, if the observer has a time
+	SunAngle	float64
+	SunKnown	bool
+}
+
+// Magnetic course in deg at the nearest point, taking the declination there
+// to be that at the observer, which is at most dmax away.
+func (fix ObserverFix) MagneticHeading() float64 {
+	return normalizeAzimuth(RadToDeg(fix.Heading) - fix.Declination)
+}
+
+// Combines a nearest approach filter for each observer.  Every observer that
+// is not optional must fit, as must at least minOptional of the others, and
+// the observers that fit must all see the aircraft flying the same way along
+// the path, passing them in the order given.  The way is chosen once for the
+// pair, loc1 to loc2 if every observer that is not optional fits flying that
+// way, or failing that the other, and with none such, the first way any
+// optional observer fits.  Observers fitting only the other way do not fit.
+// The Flyby is that of the first observer that fits, with all observers in
+// Observers.  If timeline is not nil, the observers that fit and were given
+// times must also agree with its speeds.  If scoring is not nil, distances
+// and headings beyond the limits are allowed but score less, and flybys
+// scoring below its Minscore are dropped.  Observers with a Drift must see a
+// heading that, with the wind, holds the track, and the crab angle and
+// ground speed of the first are given in the Flyby.  Observers with a time
+// are given the angle to the sun, which must meet their Sun constraints if
+// any.
+func MakeObserversFilter(obs []ObserverConstraint, amax, bmax, cmax float64, minOptional int, timeline *Timeline, scoring *ScoringSpec) func(loc1, loc2 Location) (bool, bool, *Flyby) {
+	filters := []func(loc1, loc2 Location) (bool, bool, *Flyby){}
+	for _, o := range obs {
+		dmax, heading := o.Reach(), o.Heading
+		if scoring != nil {
+			dmax, heading = scoring.Widen(dmax, heading)
+		}
+		filter := pathModel.ApproachFilter(o.Loc, amax, bmax, cmax, dmax, heading)
+		if o.Drift != nil {
+			filter = driftFilter(filter, *o.Drift, scoring)
+		}
+		filters = append(filters, filter)
+	}
+	// Observers that must fit first, since they can end the search
+	order := []int{}
+	for pass := 0; pass < 2; pass++ {
+		for i, o := range obs {
+			if o.Optional == (pass == 1) {
+				order = append(order, i)
+			}
+		}
+	}
+	events := make([]TimedEvent, len(obs))
+	timed := make([]bool, len(obs))
+	suns := make([]SunPosition, len(obs))
+	for i, o := range obs {
+		events[i].Label = o.Label
+		timed[i], events[i].Time, events[i].Tolerance = o.When()
+		if timed[i] {
+			suns[i] = SunAt(o.Loc, events[i].Time)
+		}
+		if o.Sun != nil {
+			filters[i] = sunFilter(filters[i], *o.Sun, suns[i])
+		}
+	}
+	fixes := make([]ObserverFix, len(obs))
+	fbs := make([]*Flyby, len(obs))
+	var fits, avoid, chosen bool
+	var noptional, nfits int
+	return func(loc1, loc2 Location) (bool, bool, *Flyby) {
+		from, to := loc1, loc2
+		for way := 0; way < 2; way++ {
+			if way == 1 {
+				from, to = loc2, loc1
+			}
+			chosen, nfits = true, 0
+			for _, i := range order {
+				fits, avoid, fbs[i] = filters[i](from, to)
+				if fits && fbs[i].Loc1 == from {
+					nfits++
+					continue
+				}
+				fbs[i] = nil
+				if !obs[i].Optional {
+					if !fits {
+						// Fits neither way
+						return false, avoid, nil
+					}
+					chosen = false
+					break
+				}
+			}
+			if chosen && nfits > 0 {
+				break
+			}
+		}
+		if !chosen || nfits == 0 {
+			return false, false, nil
+		}
+		noptional = 0
+		var first *Flyby
+		for i, o := range obs {
+			fixes[i] = ObserverFix{Label: o.Label,
+				Declination: o.Declination, Declined: o.Declined,
+				Sighted: o.Sight != nil, SunKnown: timed[i]}
+			if fbs[i] == nil {
+				continue
+			}
+			fixes[i].Fits = true
+			fixes[i].Nearest = fbs[i].Nearest
+			fixes[i].Heading = fbs[i].Heading
+			fixes[i].AlongTrack = fbs[i].AlongTrack
+			if o.Sight != nil {
+				fixes[i].Elevation = o.Sight.Elevations(RadToDist(fbs[i].Nearest))
+			}
+			if timed[i] {
+				fixes[i].SunAngle = suns[i].AngleTo(aircraftHeading(fbs[i]))
+			}
+			if first == nil {
+				first = fbs[i]
+			}
+			if o.Optional {
+				noptional++
+			}
+		}
+		if noptional < minOptional || !inTrackOrder(fixes) {
+			return false, false, nil
+		}
+		if timeline != nil && !timeline.Fits(first.GreatCircle,
+			fixedEvents(fixes, events, timed)) {
+			return false, false, nil
+		}
+		fb := *first
+		fb.Observers = append([]ObserverFix{}, fixes...)
+		if scoring != nil {
+			fb.Score, fb.Factors = scoring.Score(&fb, obs)
+			if fb.Score < scoring.Minscore {
+				return false, false, nil
+			}
+		}
+		return true, false, &fb
+	}
+}
+
+// Only flybys whose track, with the wind, can be held by a heading seen, with
+// their crab angle and ground speed.  When scoring, the headings are widened
+// as the tracks were.
+func driftFilter(filter func(loc1, loc2 Location) (bool, bool, *Flyby), drift Drift, scoring *ScoringSpec) func(loc1, loc2 Location) (bool, bool, *Flyby) {
+	if scoring != nil {
+		_, drift.Heading = scoring.Widen(0, drift.Heading)
+	}
+	return func(loc1, loc2 Location) (bool, bool, *Flyby) {
+		fits, avoid, fb := filter(loc1, loc2)
+		if !fits {
+			return fits, avoid, fb
+		}
+		crab, gs, ok := drift.Solve(RadToDeg(fb.Heading))
+		if !ok {
+			return false, false, nil
+		}
+		fb.Crab, fb.GroundSpeed = crab, gs
+		return true, false, fb
+	}
+}
+
+// Way the aircraft pointed at the nearest point, in deg: its course, turned
+// by the crab angle if there is wind.
+func aircraftHeading(fb *Flyby) float64 {
+	return normalizeAzimuth(RadToDeg(fb.Heading) + fb.Crab)
+}
+
+// Only flybys meeting the sun constraints, with the sun where it was for the
+// observer.
+func sunFilter(filter func(loc1, loc2 Location) (bool, bool, *Flyby), spec SunSpec, sun SunPosition) func(loc1, loc2 Location) (bool, bool, *Flyby) {
+	return func(loc1, loc2 Location) (bool, bool, *Flyby) {
+		fits, avoid, fb := filter(loc1, loc2)
+		if fits && !spec.Fits(sun, aircraftHeading(fb)) {
+			return false, false, nil
+		}
+		return fits, avoid, fb
+	}
+}
+
+// Whether the observers that fit are passed in order along the path.
+func inTrackOrder(fixes []ObserverFix) bool {
+	last := -1
+	for i, fix := range fixes {
+		if !fix.Fits {
+			continue
+		}
+		if last >= 0 && fix.AlongTrack < fixes[last].AlongTrack {
+			return false
+		}
+		last = i
+	}
+	return true
+}
+
+// Timed events for the observers that fit, at their nearest points.
+func fixedEvents(fixes []ObserverFix, events []TimedEvent, timed []bool) []TimedEvent {
+	result := []TimedEvent{}
+	for i, fix := range fixes {
+		if fix.Fits && timed[i] {
+			ev := events[i]
+			ev.Positions = []float64{fix.AlongTrack}
+			result = append(result, ev)
+		}
+	}
+	return result
+}
@@ -0,0 +1,186 @@
+/*
+	Read the public domain CSV files from:
+	http://ourairports.com/data/
+	Files are expected in the data directory under their usual names.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Load airports, with their longest open runway, and navaids.
+func ReadOurAirports(dir string) Locations {
+	result := Locations([]Location{})
+	runways := map[string]float64{}
+	path := filepath.Join(dir, OA_RUNWAYS_NAME)
+	if fileExists(path) {
+		runways = readOurAirportsRunways(path)
+		Println("Parsed runways for %d airports in %s", len(runways), path)
+	}
+	found := false
+	path = filepath.Join(dir, OA_AIRPORTS_NAME)
+	if fileExists(path) {
+		found = true
+		locs := readOurAirportsAirports(path, runways)
+		Println("Parsed %d airports in %s", len(locs), path)
+		result = append(result, locs...)
+	}
+	path = filepath.Join(dir, OA_NAVAIDS_NAME)
+	if fileExists(path) {
+		found = true
+		locs := readOurAirportsNavaids(path)
+		Println("Parsed %d navaids in %s", len(locs), path)
+		result = append(result, locs...)
+	}
+	if !found {
+		Fatal("Neither %s nor %s found in %s",
+			OA_AIRPORTS_NAME, OA_NAVAIDS_NAME, dir)
+	}
+	return result
+}
+
+func fileExists(fpath string) bool {
+	finfo, err := os.Stat(fpath)
+	return err == nil && !finfo.IsDir()
+}
+
+// A csv file with a header row, read in full.
+type csvTable struct {
+	path	string
+	cols	map[string]int
+	rows	[][]string
+}
+
+func readCSVTable(fpath string) csvTable {
+	file, err := os.Open(fpath)
+	ifError(err)
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	lines, err := reader.ReadAll()
+	ifError(err)
+	if len(lines) == 0 {
+		Fatal("%s has no header row", fpath)
+	}
+	tbl := csvTable{path: fpath, cols: map[string]int{}, rows: lines[1:]}
+	for i, name := range lines[0] {
+		tbl.cols[strings.TrimSpace(name)] = i
+	}
+	return tbl
+}
+
+// Fatal unless every named column is present.
+func (tbl csvTable) require(names ...string) {
+	for _, name := range names {
+		if _, ok := tbl.cols[name]; !ok {
+			Fatal("%s has no %q column", tbl.path, name)
+		}
+	}
+	return
+}
+
+// Value in named column, or "" if the column or value is missing.
+func (tbl csvTable) get(row []string, name string) string {
+	i, ok := tbl.cols[name]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// Number in named column, 0 if empty.
+func (tbl csvTable) getFloat(row []string, n int, name string) float64 {
+	txt := tbl.get(row, name)
+	if len(txt) == 0 {
+		return 0.0
+	}
+	result, err := strconv.ParseFloat(txt, 64)
+	if err != nil {
+		Fatal("%s line %d: bad %s %q", tbl.path, n+2, name, txt)
+	}
+	return result
+}
+
+// Longest runway not marked closed, keyed by airport ident.
+func readOurAirportsRunways(fpath string) map[string]float64 {
+	tbl := readCSVTable(fpath)
+	tbl.require("airport_ident", "length_ft", "closed")
+	result := map[string]float64{}
+	for n, row := range tbl.rows {
+		if tbl.get(row, "closed") == "1" {
+			continue
+		}
+		ident := tbl.get(row, "airport_ident")
+		length := tbl.getFloat(row, n, "length_ft")
+		if length > result[ident] {
+			result[ident] = length
+		}
+	}
+	return result
+}
+
+func readOurAirportsAirports(fpath string, runways map[string]float64) Locations {
+	tbl := readCSVTable(fpath)
+	tbl.require("ident", "type", "name", "latitude_deg", "longitude_deg")
+	result := Locations([]Location{})
+	for n, row := range tbl.rows {
+		ident := tbl.get(row, "ident")
+		loc := Location{
+			Type:			LOCTYPE["Airport"].Tag,
+			Kind:			tbl.get(row, "type"),
+			Name:			tbl.get(row, "name"),
+			Desc:			tbl.get(row, "municipality"),
+			Country:		tbl.get(row, "iso_country"),
+			IATAcode:		tbl.get(row, "iata_code"),
+			Lat:			tbl.getFloat(row, n, "latitude_deg"),
+			Long:			tbl.getFloat(row, n, "longitude_deg"),
+			Elevation:		tbl.getFloat(row, n, "elevation_ft"),
+			RunwayLength:	runways[ident],
+		}
+		// Newer files carry the ICAO code separately, otherwise the GPS code
+		// is the ICAO code where one exists.
+		loc.ICAOcode = tbl.get(row, "icao_code")
+		if len(loc.ICAOcode) == 0 {
+			loc.ICAOcode = tbl.get(row, "gps_code")
+		}
+		if len(loc.ICAOcode) == 0 {
+			loc.ICAOcode = ident
+		}
+		// Region is given as country-subdivision, e.g. "US-CA"
+		region := tbl.get(row, "iso_region")
+		if i := strings.Index(region, "-"); i >= 0 {
+			loc.State = region[i+1:]
+		}
+		if loc.Country == "US" {
+			loc.FAAcode = tbl.get(row, "local_code")
+		}
+		result = append(result, loc)
+	}
+	return result
+}
+
+func readOurAirportsNavaids(fpath string) Locations {
+	tbl := readCSVTable(fpath)
+	tbl.require("ident", "type", "latitude_deg", "longitude_deg")
+	result := Locations([]Location{})
+	for n, row := range tbl.rows {
+		result = append(result, Location{
+			Type:		LOCTYPE["Waypoint"].Tag,
+			Kind:		tbl.get(row, "type"),
+			ICAOcode:	tbl.get(row, "ident"),
+			Name:		tbl.get(row, "name"),
+			Country:	tbl.get(row, "iso_country"),
+			Control:	tbl.get(row, "usageType"),
+			Lat:		tbl.getFloat(row, n, "latitude_deg"),
+			Long:		tbl.getFloat(row, n, "longitude_deg"),
+			Elevation:	tbl.getFloat(row, n, "elevation_ft"),
+			Frequency:	tbl.getFloat(row, n, "frequency_khz"),
+		})
+	}
+	return result
+}
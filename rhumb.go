@@ -0,0 +1,286 @@
+package main
+
+import (
+	. "math"
+	"strings"
+)
+
+// How an aircraft flies from loc1 to loc2: along a great circle, as when
+// navigating between beacons, or along a rhumb line, at constant heading.
+type PathModel interface {
+	Name() string
+	// Length in km
+	Length(loc1, loc2 Location) float64
+	// As MakeNearestApproachFilter, for paths of this kind
+	ApproachFilter(loc3 Location, amax, bmax, cmax, dmax float64, dir []float64) func(loc1, loc2 Location) (bool, bool, *Flyby)
+	// Length in rad on the sphere, as positions along paths are timed
+	Angle(loc1, loc2 Location) float64
+	// Point s rad along the path from loc1 to loc2, or on beyond loc2
+	PointAt(loc1, loc2 Location, s float64) Vector
+	// Distances in rad from loc1 at which the path to loc2 crosses the ring,
+	// in increasing order
+	RingCrossings(ring SatelliteRing, loc1, loc2 Location) []float64
+}
+
+// Great circles, or geodesics if the geodesy model is an ellipsoid.
+type GreatCirclePath struct{}
+
+// Rhumb lines on the sphere.
+type RhumbPath struct{}
+
+var GREAT_CIRCLE_PATH PathModel = GreatCirclePath{}
+var RHUMB_PATH PathModel = RhumbPath{}
+
+// The model in use, chosen with -pathmodel.
+var pathModel PathModel = GREAT_CIRCLE_PATH
+
+func PathModelByName(name string) PathModel {
+	for _, pm := range []PathModel{GREAT_CIRCLE_PATH, RHUMB_PATH} {
+		if strings.ToLower(name) == pm.Name() {
+			return pm
+		}
+	}
+	Fatal("Unknown path model %q, use greatcircle or rhumb", name)
+	return nil
+}
+
+func (gp GreatCirclePath) Name() string {
+	return "greatcircle"
+}
+
+func (gp GreatCirclePath) Length(loc1, loc2 Location) float64 {
+	dist, _, _ := geodesy.Inverse(loc1, loc2)
+	return dist
+}
+
+func (gp GreatCirclePath) ApproachFilter(loc3 Location, amax, bmax, cmax, dmax float64, dir []float64) func(loc1, loc2 Location) (bool, bool, *Flyby) {
+	return MakeGeodesicApproachFilter(geodesy, loc3, amax, bmax, cmax, dmax, dir)
+}
+
+func (gp GreatCirclePath) Angle(loc1, loc2 Location) float64 {
+	return Leg{Loc1: loc1, Loc2: loc2}.Length()
+}
+
+func (gp GreatCirclePath) PointAt(loc1, loc2 Location, s float64) Vector {
+	v1 := loc1.ToCartesianVector()
+	n := GreatCircleNormal(loc1, loc2)
+	if n.Mag() < 1e-12 {
+		return v1
+	}
+	return v1.RotateAround(n.Norm(), s)
+}
+
+func (gp GreatCirclePath) RingCrossings(ring SatelliteRing, loc1, loc2 Location) []float64 {
+	return ring.Crossings(loc1, loc2)
+}
+
+func (rp RhumbPath) Name() string {
+	return "rhumb"
+}
+
+func (rp RhumbPath) Length(loc1, loc2 Location) float64 {
+	return RhumbDistance(loc1, loc2)
+}
+
+// Difference in isometric latitude, and the ratio of the change in latitude
+// to it, which is the cosine of the latitude along an east-west line.
+func rhumbStretch(lat1, lat2 float64) (float64, float64) {
+	dpsi := Log(Tan(PI_4 + lat2/2.0)/Tan(PI_4 + lat1/2.0))
+	if Abs(dpsi) > 1e-12 {
+		return dpsi, (lat2 - lat1)/dpsi
+	}
+	return dpsi, Cos(lat1)
+}
+
+// Change in longitude in rad, the short way round.
+func wrapLongitude(dlong float64) float64 {
+	if Abs(dlong) > PI {
+		if dlong > 0 {
+			return dlong - 2.0*PI
+		}
+		return dlong + 2.0*PI
+	}
+	return dlong
+}
+
+// Distance in km along the rhumb line from loc1 to loc2.
+func RhumbDistance(loc1, loc2 Location) float64 {
+	lat1, long1 := LatLongToRadians(loc1)
+	lat2, long2 := LatLongToRadians(loc2)
+	_, q := rhumbStretch(lat1, lat2)
+	dlong := wrapLongitude(long2 - long1)
+	return RadToDist(Sqrt((lat2 - lat1)*(lat2 - lat1) + q*q*dlong*dlong))
+}
+
+// Constant bearing in deg clockwise from north of the rhumb line from loc1 to
+// loc2.
+func RhumbBearing(loc1, loc2 Location) float64 {
+	lat1, long1 := LatLongToRadians(loc1)
+	lat2, long2 := LatLongToRadians(loc2)
+	dpsi, _ := rhumbStretch(lat1, lat2)
+	dlong := wrapLongitude(long2 - long1)
+	return Mod(RadToDeg(Atan2(dlong, dpsi)) + 360.0, 360.0)
+}
+
+// Location dist km from loc along the rhumb line at bearing deg.
+func RhumbDestination(loc Location, bearing, dist float64) Location {
+	lat1, long1 := LatLongToRadians(loc)
+	theta := DegToRad(bearing)
+	d := DistToRad(dist)
+	lat2 := lat1 + d*Cos(theta)
+	// Over a pole is not a rhumb line, so stop there
+	if Abs(lat2) > PI_2 {
+		lat2 = Copysign(PI_2, lat2)
+	}
+	_, q := rhumbStretch(lat1, lat2)
+	long2 := long1 + d*Sin(theta)/q
+	return Location{
+		Lat:	RadToDeg(lat2),
+		Long:	Mod(RadToDeg(long2) + 540.0, 360.0) - 180.0,
+	}
+}
+
+// Samples along a rhumb line used to find roughly where it comes nearest a
+// location, or crosses a ring, before refining.
+const RHUMB_SAMPLES int = 32
+
+func (rp RhumbPath) Angle(loc1, loc2 Location) float64 {
+	return DistToRad(RhumbDistance(loc1, loc2))
+}
+
+func (rp RhumbPath) PointAt(loc1, loc2 Location, s float64) Vector {
+	return RhumbDestination(loc1, RhumbBearing(loc1, loc2),
+		RadToDist(s)).ToCartesianVector()
+}
+
+// Crossings are found between samples along the line where it goes into or
+// out of the ring, by bisection.
+func (rp RhumbPath) RingCrossings(ring SatelliteRing, loc1, loc2 Location) []float64 {
+	length := rp.Angle(loc1, loc2)
+	c := ring.Centre.ToCartesianVector()
+	outside := func(s float64) float64 {
+		return rp.PointAt(loc1, loc2, s).AngleWith(c) - ring.Radius
+	}
+	result := []float64{}
+	step := length/float64(RHUMB_SAMPLES)
+	lo, flo := 0.0, outside(0.0)
+	for i := 1; i <= RHUMB_SAMPLES && length > 0; i++ {
+		hi := length*float64(i)/float64(RHUMB_SAMPLES)
+		fhi := outside(hi)
+		if flo == 0 {
+			result = append(result, lo)
+		} else if flo*fhi < 0 {
+			a, b := lo, hi
+			for b - a > 1e-12*step {
+				m := (a + b)/2.0
+				if fm := outside(m); fm*flo > 0 {
+					a = m
+				} else {
+					b = m
+				}
+			}
+			result = append(result, (a + b)/2.0)
+		}
+		lo, flo = hi, fhi
+	}
+	if flo == 0 && length > 0 {
+		result = append(result, length)
+	}
+	return result
+}
+
+// Distance in km along the rhumb line from loc1 to loc2 of the point nearest
+// loc3, and the great circle distance in km between them.
+func RhumbNearest(loc1, loc2, loc3 Location) (float64, float64) {
+	length := RhumbDistance(loc1, loc2)
+	bearing := RhumbBearing(loc1, loc2)
+	v3 := loc3.ToCartesianVector()
+	dist := func(s float64) float64 {
+		p := RhumbDestination(loc1, bearing, s)
+		return RadToDist(p.ToCartesianVector().AngleWith(v3))
+	}
+	best := 0
+	fbest := dist(0.0)
+	for i := 1; i <= RHUMB_SAMPLES; i++ {
+		f := dist(length*float64(i)/float64(RHUMB_SAMPLES))
+		if f < fbest {
+			best, fbest = i, f
+		}
+	}
+	// Golden section search between the samples either side
+	step := length/float64(RHUMB_SAMPLES)
+	lo := Max(0.0, float64(best - 1)*step)
+	hi := Min(length, float64(best + 1)*step)
+	g := (Sqrt(5.0) - 1.0)/2.0
+	x1, x2 := hi - g*(hi - lo), lo + g*(hi - lo)
+	f1, f2 := dist(x1), dist(x2)
+	for hi - lo > 1e-6 {
+		if f1 < f2 {
+			hi, x2, f2 = x2, x1, f1
+			x1 = hi - g*(hi - lo)
+			f1 = dist(x1)
+		} else {
+			lo, x1, f1 = x1, x2, f2
+			x2 = lo + g*(hi - lo)
+			f2 = dist(x2)
+		}
+	}
+	s := (lo + hi)/2.0
+	return s, dist(s)
+}
+
+// Paths are tried in both directions, as for great circles, and the course
+// is that of the whole rhumb line.  The nearest point must lie strictly
+// between the ends.  Before searching for it, since a point s along the path
+// is at least b - s and c - (a - s) from loc3, the nearest approach is at
+// least (b + c - a)/2, which rules out most pairs cheaply.
+func (rp RhumbPath) ApproachFilter(loc3 Location, amax, bmax, cmax, dmax float64, dir []float64) func(loc1, loc2 Location) (bool, bool, *Flyby) {
+	if len(dir) != 2 {
+		Fatal("Course range must have two numbers, but %d given", len(dir))
+	}
+	v3 := loc3.ToCartesianVector()
+	return func(loc1, loc2 Location) (bool, bool, *Flyby) {
+		b := RadToDist(loc1.ToCartesianVector().AngleWith(v3))
+		c := RadToDist(loc2.ToCartesianVector().AngleWith(v3))
+		if (b > bmax || c > cmax) && (c > bmax || b > cmax) {
+			return false, true, nil
+		}
+		course := RhumbBearing(loc1, loc2)
+		if !InCourseRange(course, dir[0], dir[1]) {
+			course = Mod(course + 180.0, 360.0)
+			if !InCourseRange(course, dir[0], dir[1]) {
+				return false, false, nil
+			}
+			loc1, loc2 = loc2, loc1
+			b, c = c, b
+		}
+		if b > bmax || c > cmax {
+			return false, false, nil
+		}
+		a := RhumbDistance(loc1, loc2)
+		if a > amax || b - a > dmax || (b + c - a)/2.0 > dmax {
+			return false, false, nil
+		}
+		s, d := RhumbNearest(loc1, loc2, loc3)
+		if d > dmax || s <= 1e-5 || s >= a - 1e-5 {
+			return false, false, nil
+		}
+		// Angles at each end between the rhumb line and the great circle
+		// to loc3
+		return true, false, &Flyby{
+			GreatCircle: GreatCircle{
+				Loc1:	loc1,
+				Loc2:	loc2,
+				Ang12:	DistToRad(a),
+			},
+			C:			DegToRad(CourseDifference(course, loc1.BearingTo(loc3))),
+			B:			DegToRad(CourseDifference(course + 180.0,
+				loc2.BearingTo(loc3))),
+			Ang23:		DistToRad(c),
+			Ang13:		DistToRad(b),
+			Nearest:	DistToRad(d),
+			Heading:	DegToRad(course),
+			AlongTrack:	DistToRad(s),
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	. "math"
+	"time"
+)
+
+// A ring of locations at constant range from a satellite, as measured from
+// the timing of a ping at Time, give or take Tolerance.
+type SatelliteRing struct {
+	Label		string
+	Centre		Location // sub-satellite point
+	Radius		float64 // rad from Centre
+	Time		time.Time
+	Tolerance	time.Duration
+}
+
+// Angular radius in rad, from the centre of the earth, of the ring of points
+// on the surface at slant range km from a satellite altitude km up.
+func RingRadiusFromRange(altitude, slant float64) float64 {
+	r := EARTH_RAD + altitude
+	return SafeAcos((r*r + EARTH_RAD*EARTH_RAD - slant*slant) /
+		(2.0*EARTH_RAD*r))
+}
+
+// Angular radius in rad of the ring of points on the surface which see a
+// satellite altitude km up at elevation deg above the horizon.
+func RingRadiusFromElevation(altitude, elevation float64) float64 {
+	e := DegToRad(elevation)
+	return SafeAcos(EARTH_RAD*Cos(e)/(EARTH_RAD + altitude)) - e
+}
+
+// Angular distances in rad from loc1 at which the great circle segment from
+// loc1 to loc2 crosses the ring, in increasing order.
+func (ring SatelliteRing) Crossings(loc1, loc2 Location) []float64 {
+	v1 := loc1.ToCartesianVector()
+	length := v1.AngleWith(loc2.ToCartesianVector())
+	n := GreatCircleNormal(loc1, loc2)
+	if n.Mag() < 1e-12 {
+		return []float64{}
+	}
+	// Points along the segment are v1 cos s + w sin s, so the crossings
+	// solve A cos s + B sin s = cos(Radius).
+	w := n.Norm().Cross(v1)
+	c := ring.Centre.ToCartesianVector()
+	A := v1.Dot(c)
+	B := w.Dot(c)
+	R := Sqrt(A*A + B*B)
+	result := []float64{}
+	if R < 1e-12 || Abs(Cos(ring.Radius)) > R {
+		return result
+	}
+	phi := Atan2(B, A)
+	delta := Acos(Cos(ring.Radius)/R)
+	for _, s := range []float64{phi - delta, phi + delta} {
+		for s < 0 {
+			s += 2.0*PI
+		}
+		for s >= 2.0*PI {
+			s -= 2.0*PI
+		}
+		if s <= length && (len(result) == 0 || s != result[0]) {
+			result = append(result, s)
+		}
+	}
+	if len(result) == 2 && result[1] < result[0] {
+		result[0], result[1] = result[1], result[0]
+	}
+	return result
+}
+
+// As Crossings, but for a route of several legs flown by the path model,
+// with distances measured from the start of the first leg.
+func (ring SatelliteRing) LegCrossings(path PathModel, legs Legs) []float64 {
+	result := []float64{}
+	var start float64
+	for _, leg := range legs {
+		for _, s := range path.RingCrossings(ring, leg.Loc1, leg.Loc2) {
+			// A crossing at a shared fix is counted once
+			if len(result) == 0 || start + s - result[len(result)-1] > 1e-9 {
+				result = append(result, start + s)
+			}
+		}
+		start += path.Angle(leg.Loc1, leg.Loc2)
+	}
+	return result
+}
+
+// Timed event for the ring, at each place the route crosses it.
+func (ring SatelliteRing) Event(path PathModel, legs Legs) TimedEvent {
+	return TimedEvent{
+		Label:		ring.Label,
+		Positions:	ring.LegCrossings(path, legs),
+		Time:		ring.Time,
+		Tolerance:	ring.Tolerance,
+	}
+}
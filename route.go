@@ -0,0 +1,280 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A route through the graph, as indices into its Locs.
+type Route struct {
+	Nodes	[]int
+	Dist	float64 // rad
+}
+
+// Edges or locations a search must not use, for Yen's algorithm.
+type routeBlocks struct {
+	edges	map[[2]int]bool
+	nodes	map[int]bool
+}
+
+type routeItem struct {
+	node	int
+	dist	float64
+}
+
+type routeQueue []routeItem
+
+// Edges leaving a node, of the route graph itself or of one derived from it.
+type routeEdges func(node int) []RouteEdge
+
+func (q routeQueue) Len() int {
+	return len(q)
+}
+
+func (q routeQueue) Less(i, j int) bool {
+	return q[i].dist < q[j].dist
+}
+
+func (q routeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *routeQueue) Push(x interface{}) {
+	*q = append(*q, x.(routeItem))
+}
+
+func (q *routeQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Dijkstra's algorithm, using only legs no longer than maxleg rad.
+func (edges routeEdges) shortestRoute(from, to int, maxleg float64, blocks routeBlocks) (Route, bool) {
+	dist := map[int]float64{from: 0.0}
+	prev := map[int]int{}
+	done := map[int]bool{}
+	q := &routeQueue{{node: from}}
+	for q.Len() > 0 {
+		item := heap.Pop(q).(routeItem)
+		if done[item.node] {
+			continue
+		}
+		done[item.node] = true
+		if item.node == to {
+			break
+		}
+		for _, e := range edges(item.node) {
+			if e.Dist > maxleg || blocks.nodes[e.To] ||
+				blocks.edges[[2]int{item.node, e.To}] {
+				continue
+			}
+			d := item.dist + e.Dist
+			if old, seen := dist[e.To]; !seen || d < old {
+				dist[e.To] = d
+				prev[e.To] = item.node
+				heap.Push(q, routeItem{node: e.To, dist: d})
+			}
+		}
+	}
+	if !done[to] {
+		return Route{}, false
+	}
+	nodes := []int{to}
+	for n := to; n != from; {
+		n = prev[n]
+		nodes = append([]int{n}, nodes...)
+	}
+	return Route{Nodes: nodes, Dist: dist[to]}, true
+}
+
+func (edges routeEdges) routeDist(nodes []int) float64 {
+	var d float64
+	for k := 0; k < len(nodes)-1; k++ {
+		best := -1.0
+		for _, e := range edges(nodes[k]) {
+			if e.To == nodes[k+1] && (best < 0 || e.Dist < best) {
+				best = e.Dist
+			}
+		}
+		d += best
+	}
+	return d
+}
+
+func sameNodes(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The k shortest routes passing within radius rad of each of the via
+// locations in order, by Yen's algorithm.  The search is over nodes of a
+// derived graph, each a location with the number of via locations passed so
+// far, and a leg moves on to the next stage when it passes near the next via
+// location.  So unlike filtering the shortest routes, which may give up
+// before finding any that turn aside to a distant via location, this finds
+// the shortest that do.  Routes may come back through a location they passed
+// before reaching a via location.  Only routes for which accept returns true
+// are kept, until k are found or maxtried routes have been looked at.
+func (g *RouteGraph) KShortestRoutesVia(from, to, k int, maxleg float64, via Locations, radius float64, accept func(Route) bool, maxtried int) []Route {
+	n := len(g.Locs)
+	staged := func(state int) []RouteEdge {
+		node, stage := state % n, state / n
+		result := make([]RouteEdge, 0, len(g.Edges[node]))
+		for _, e := range g.Edges[node] {
+			next := stage
+			for next < len(via) && SegmentDistance(
+				g.Locs[node], g.Locs[e.To], via[next]) <= radius {
+				next++
+			}
+			result = append(result, RouteEdge{To: next*n + e.To, Dist: e.Dist,
+				Airway: e.Airway})
+		}
+		return result
+	}
+	unstaged := func(r Route) Route {
+		nodes := make([]int, len(r.Nodes))
+		for i, node := range r.Nodes {
+			nodes[i] = node % n
+		}
+		return Route{Nodes: nodes, Dist: r.Dist}
+	}
+	routes := routeEdges(staged).kShortestRoutes(from, len(via)*n + to, k,
+		maxleg, func(r Route) bool { return accept(unstaged(r)) }, maxtried)
+	for i, r := range routes {
+		routes[i] = unstaged(r)
+	}
+	return routes
+}
+
+// Whether a route crosses the timeline's rings at times it allows, flown
+// from its start, and how many routes to look at for k that do.  With no
+// timeline, every route is accepted and only k are looked at.
+func (g *RouteGraph) TimelineAccept(timeline *Timeline, k int) (func(Route) bool, int) {
+	if timeline == nil {
+		return func(r Route) bool { return true }, k
+	}
+	return func(r Route) bool {
+		return timeline.FitsRoute(g.RouteLegs(r), nil)
+	}, MAX_ROUTES_TRIED
+}
+
+func (edges routeEdges) kShortestRoutes(from, to, k int, maxleg float64, accept func(Route) bool, maxtried int) []Route {
+	result := []Route{}
+	found := []Route{}
+	first, ok := edges.shortestRoute(from, to, maxleg, routeBlocks{})
+	if !ok {
+		return result
+	}
+	candidates := []Route{first}
+	for tried := 0; len(candidates) > 0 && tried < maxtried; tried++ {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Dist < candidates[j].Dist
+		})
+		r := candidates[0]
+		candidates = candidates[1:]
+		found = append(found, r)
+		if accept(r) {
+			result = append(result, r)
+			if len(result) == k {
+				break
+			}
+		}
+		// Deviate from each node of the last route found
+		for i := 0; i < len(r.Nodes)-1; i++ {
+			root := r.Nodes[:i+1]
+			blocks := routeBlocks{edges: map[[2]int]bool{}, nodes: map[int]bool{}}
+			for _, p := range found {
+				if len(p.Nodes) > i && sameNodes(p.Nodes[:i+1], root) {
+					blocks.edges[[2]int{p.Nodes[i], p.Nodes[i+1]}] = true
+				}
+			}
+			for _, n := range root[:i] {
+				blocks.nodes[n] = true
+			}
+			spur, ok := edges.shortestRoute(r.Nodes[i], to, maxleg, blocks)
+			if !ok {
+				continue
+			}
+			nodes := append(append([]int{}, root[:i]...), spur.Nodes...)
+			dup := false
+			for _, c := range candidates {
+				dup = dup || sameNodes(c.Nodes, nodes)
+			}
+			for _, c := range found {
+				dup = dup || sameNodes(c.Nodes, nodes)
+			}
+			if !dup {
+				candidates = append(candidates,
+					Route{Nodes: nodes, Dist: edges.routeDist(nodes)})
+			}
+		}
+	}
+	return result
+}
+
+func (g *RouteGraph) RouteLegs(r Route) Legs {
+	locs := Locations([]Location{})
+	for _, n := range r.Nodes {
+		locs = append(locs, g.Locs[n])
+	}
+	return locs.ToLegs()
+}
+
+// Most routes looked at by Yen's algorithm before giving up, when they are
+// filtered.
+const MAX_ROUTES_TRIED int = 5000
+
+// Print and write out the k shortest routes between labels given as
+// "origin,destination".  Legs are no longer than maxleg km, are
+// airway segments or direct-to legs, and pass within viad km of each of a
+// comma separated list of via labels, in order.  If timeline is not nil, routes
+// must also cross its rings at times it allows.
+func (locs Locations) FindRoutes(labstr, vialabs string, k int, maxleg, viad float64, timeline *Timeline, datapath string) {
+	labels := strings.Split(labstr, ",")
+	if len(labels) != 2 {
+		Fatal("Give a route as origin,destination, not %q", labstr)
+	}
+	ends := locs.LabelsToLocations(labstr)
+	_, _, from := locs.FindBy(labels[0])
+	_, _, to := locs.FindBy(labels[1])
+	via := Locations([]Location{})
+	if len(vialabs) > 0 {
+		via = locs.LabelsToLocations(vialabs)
+	}
+	if maxleg <= 0 {
+		Fatal("Give a maximum leg length in km with -leg")
+	}
+	if k < 1 {
+		k = 1
+	}
+	g := locs.BuildRouteGraph(LoadAirways(datapath, locs), maxleg, "")
+	accept, maxtried := g.TimelineAccept(timeline, k)
+	routes := g.KShortestRoutesVia(from, to, k, DistToRad(maxleg), via,
+		DistToRad(viad), accept, maxtried)
+	Println("Found %d routes from %v to %v", len(routes), ends[0], ends[1])
+	for i, r := range routes {
+		legs := g.RouteLegs(r)
+		Println("Route %d, %d legs, %.1f km:", i+1, len(legs), RadToDist(r.Dist))
+		for _, leg := range legs {
+			Println(" %v -> %v", leg.Loc1, leg.Loc2)
+		}
+		path := GetTrackCSVPath(datapath)
+		if i > 0 {
+			path = strings.TrimSuffix(path, ".csv") + "_" +
+				strconv.Itoa(i+1) + ".csv"
+		}
+		legs.ToLocations().WriteToSimpleCSVPath(path)
+	}
+	return
+}
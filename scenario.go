@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A flyby search scenario, normally read from a JSON file given with -s.
+// A single observer can be given with Observer, Dmax and Heading, or any
+// number with Observers.
+type Scenario struct {
+	Observer	string		`json:"observer,omitempty"`	// label, e.g. "Name:Kudahuvadhoo"
+	Amax		float64		`json:"amax"`		// km
+	Bmax		float64		`json:"bmax"`		// km
+	Cmax		float64		`json:"cmax"`		// km
+	Dmax		float64		`json:"dmax,omitempty"`		// km
+	Heading		[]float64	`json:"heading,omitempty"`	// true courses, deg
+	Magnetic	bool		`json:"magnetic,omitempty"`	// heading is magnetic
+	Sight		*SightSpec	`json:"sight,omitempty"`
+	Observers	[]ObserverSpec	`json:"observers,omitempty"`
+	MinOptional	int			`json:"minoptional,omitempty"`
+	Speed		[]float64	`json:"speed,omitempty"`		// km/h, min and max
+	Departure	*TimedLabel	`json:"departure,omitempty"`
+	Rings		[]RingSpec	`json:"rings,omitempty"`
+	Scoring		*ScoringSpec	`json:"scoring,omitempty"`
+	Wind		*WindSpec	`json:"wind,omitempty"`
+	Airspeed	[]float64	`json:"airspeed,omitempty"`	// km/h, true, min and max
+	// Date of the sightings, e.g. "2014-03-08", for the declination of
+	// magnetic headings of observers without a time
+	Date		string		`json:"date,omitempty"`
+	Nproc		int			`json:"nproc"`
+	// Pairs to search, "all" or "airways" for airway segments and
+	// direct-to legs up to Directmax km, at the given Level (H, L or blank).
+	Pairs		string		`json:"pairs,omitempty"`
+	Directmax	float64		`json:"directmax,omitempty"` // km
+	Level		string		`json:"level,omitempty"`
+}
+
+// A location with the time, in RFC 3339 format, at which the aircraft was
+// there, give or take Tolerance.  Time can be left out.
+type TimedLabel struct {
+	Label		string		`json:"label"`
+	Time		string		`json:"time,omitempty"`
+	Tolerance	float64		`json:"tolerance,omitempty"`	// minutes
+}
+
+// One sighting.  Observers are listed in the order the aircraft passed them.
+// An optional observer need not be passed, but at least MinOptional of them
+// must be.  The aircraft must pass within Dmax, or within Sight, or both if
+// both are given.
+type ObserverSpec struct {
+	TimedLabel
+	Dmax		float64		`json:"dmax,omitempty"`		// km
+	Heading		[]float64	`json:"heading"`	// true courses, deg, first clockwise to second
+	Magnetic	bool		`json:"magnetic,omitempty"`	// heading is magnetic courses instead
+	Sight		*SightSpec	`json:"sight,omitempty"`
+	Sun			*SunSpec	`json:"sun,omitempty"`	// needs a time
+	Optional	bool		`json:"optional,omitempty"`
+}
+
+// Wind blowing from Direction at Speed everywhere, or given on a grid by a
+// csv File in the data directory.  With wind, observers' headings are those
+// the aircraft pointed, and the tracks it made good are found from them.
+type WindSpec struct {
+	Direction	float64		`json:"direction,omitempty"`	// deg, true
+	Speed		float64		`json:"speed,omitempty"`		// km/h
+	File		string		`json:"file,omitempty"`
+}
+
+// A satellite ping, giving a ring of locations around the sub-satellite point
+// at Lat, Long, at either a slant Range from the satellite or an Elevation
+// above the horizon.
+type RingSpec struct {
+	Label		string		`json:"label,omitempty"`
+	Lat			float64		`json:"lat"`		// deg
+	Long		float64		`json:"long"`		// deg
+	Altitude	float64		`json:"altitude"`	// km
+	Range		float64		`json:"range,omitempty"`		// km
+	Elevation	float64		`json:"elevation,omitempty"`	// deg
+	Time		string		`json:"time"`
+	Tolerance	float64		`json:"tolerance,omitempty"`	// minutes
+}
+
+// The scenario used when none is given on the command line.
+func DefaultScenario() Scenario {
+	return Scenario{
+		Amax:		4000.0,
+		Bmax:		2000.0,
+		Cmax:		2000.0,
+		Observers:	[]ObserverSpec{
+			{
+				TimedLabel:	TimedLabel{Label: "Name:Kudahuvadhoo"},
+				Dmax:		0.5,
+				Heading:	[]float64{135.0, 180.0},
+			},
+		},
+		Nproc:		4,
+		Pairs:		"all",
+	}
+}
+
+// Observers, whichever way they were given.
+func (sc Scenario) ObserverList() []ObserverSpec {
+	if len(sc.Observers) > 0 {
+		return sc.Observers
+	}
+	return []ObserverSpec{
+		{
+			TimedLabel:	TimedLabel{Label: sc.Observer},
+			Dmax:		sc.Dmax,
+			Heading:	sc.Heading,
+			Magnetic:	sc.Magnetic,
+			Sight:		sc.Sight,
+		},
+	}
+}
+
+// Whether any observer's heading is magnetic, so the magnetic model is
+// needed.
+func (sc Scenario) UsesMagnetic() bool {
+	for _, obs := range sc.ObserverList() {
+		if obs.Magnetic {
+			return true
+		}
+	}
+	return false
+}
+
+// Date of the sighting by obs, for its declination: its time if given,
+// otherwise the scenario date.
+func (sc Scenario) SightingDate(obs ObserverSpec) time.Time {
+	if timed, t, _ := obs.When(); timed {
+		return t
+	}
+	t, err := time.Parse(SCENARIO_DATE_FORMAT, sc.Date)
+	ifError(err)
+	return t
+}
+
+// Whether a time was given, and if so, the time and its tolerance.
+func (tl TimedLabel) When() (bool, time.Time, time.Duration) {
+	if len(tl.Time) == 0 {
+		return false, time.Time{}, 0
+	}
+	t, err := time.Parse(time.RFC3339, tl.Time)
+	ifError(err)
+	return true, t, time.Duration(tl.Tolerance*float64(time.Minute))
+}
+
+func (tl TimedLabel) problems(name string) []string {
+	var msgs []string
+	if !strings.Contains(tl.Label, ":") {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s %q is not a label such as \"Name:Kudahuvadhoo\"",
+			name, tl.Label))
+	}
+	if len(tl.Time) > 0 {
+		if _, err := time.Parse(time.RFC3339, tl.Time); err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s time %q is not like \"2014-03-08T06:15:00+05:00\"",
+				name, tl.Time))
+		}
+	}
+	if tl.Tolerance < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s tolerance must not be negative, not %g", name, tl.Tolerance))
+	}
+	return msgs
+}
+
+func (spec RingSpec) Ring() SatelliteRing {
+	ring := SatelliteRing{
+		Label:	spec.Label,
+		Centre:	Location{Lat: spec.Lat, Long: spec.Long},
+	}
+	if spec.Range > 0 {
+		ring.Radius = RingRadiusFromRange(spec.Altitude, spec.Range)
+	} else {
+		ring.Radius = RingRadiusFromElevation(spec.Altitude, spec.Elevation)
+	}
+	_, ring.Time, ring.Tolerance =
+		TimedLabel{Time: spec.Time, Tolerance: spec.Tolerance}.When()
+	return ring
+}
+
+func (spec RingSpec) problems(name string) []string {
+	msgs := TimedLabel{Label: ":", Time: spec.Time,
+		Tolerance: spec.Tolerance}.problems(name)
+	if len(spec.Time) == 0 {
+		msgs = append(msgs, name + " must have a time")
+	}
+	if spec.Lat < -90 || spec.Lat > 90 || spec.Long < -180 || spec.Long > 180 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s lat %g, long %g is not a position in deg",
+			name, spec.Lat, spec.Long))
+	}
+	if spec.Altitude <= 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s altitude must be positive in km, not %g", name, spec.Altitude))
+	}
+	if (spec.Range != 0) == (spec.Elevation != 0) {
+		msgs = append(msgs, name + " needs either range or elevation")
+	} else if spec.Range != 0 && (spec.Range < spec.Altitude ||
+		spec.Range > math.Sqrt(spec.Altitude*(spec.Altitude + 2.0*EARTH_RAD))) {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s range %g km does not reach the surface in sight of the satellite",
+			name, spec.Range))
+	} else if spec.Elevation < 0 || spec.Elevation > 90 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s elevation must be between 0 and 90 deg, not %g",
+			name, spec.Elevation))
+	}
+	return msgs
+}
+
+func (spec WindSpec) problems() []string {
+	var msgs []string
+	if len(spec.File) > 0 && (spec.Direction != 0 || spec.Speed != 0) {
+		msgs = append(msgs, "wind needs either a file or a direction and " +
+			"speed, not both")
+	}
+	if spec.Direction < 0 || spec.Direction > 360 {
+		msgs = append(msgs, fmt.Sprintf(
+			"wind direction must be from 0 to 360 deg, not %g", spec.Direction))
+	}
+	if spec.Speed < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"wind speed must not be negative, not %g", spec.Speed))
+	}
+	return msgs
+}
+
+func (obs ObserverSpec) problems(name string) []string {
+	msgs := obs.TimedLabel.problems(name)
+	if obs.Sight != nil {
+		msgs = append(msgs, obs.Sight.problems(name)...)
+		if obs.Dmax < 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s dmax must not be negative, not %g", name, obs.Dmax))
+		}
+	} else if obs.Dmax <= 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s dmax must be a positive distance in km, not %g",
+			name, obs.Dmax))
+	}
+	if obs.Sun != nil {
+		msgs = append(msgs, obs.Sun.problems(name)...)
+		if len(obs.Time) == 0 {
+			msgs = append(msgs, name + " sun needs a time")
+		}
+	}
+	if len(obs.Heading) != 2 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s heading must have two numbers, but %d given",
+			name, len(obs.Heading)))
+	} else {
+		if obs.Heading[0] < 0 || obs.Heading[0] > 360 ||
+			obs.Heading[1] < 0 || obs.Heading[1] > 360 {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s heading %v must be true courses in the direction of " +
+				"travel, from 0 to 360 deg", name, obs.Heading))
+		} else if CourseSpan(obs.Heading[0], obs.Heading[1]) >= 180 {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s heading %v, clockwise from the first course to the " +
+				"second, must span less than 180 deg", name, obs.Heading))
+		}
+	}
+	return msgs
+}
+
+// Returns all problems with the scenario in a single error, or nil.
+func (sc Scenario) Validate() error {
+	var msgs []string
+	for _, lim := range []struct{
+		name	string
+		value	float64
+	}{
+		{"amax", sc.Amax}, {"bmax", sc.Bmax}, {"cmax", sc.Cmax},
+	} {
+		if lim.value <= 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s must be a positive distance in km, not %g",
+				lim.name, lim.value))
+		}
+	}
+	if len(sc.Observers) > 0 {
+		if len(sc.Observer) > 0 || sc.Dmax != 0 || len(sc.Heading) > 0 ||
+			sc.Magnetic || sc.Sight != nil {
+			msgs = append(msgs, "give either observer, dmax and heading, " +
+				"or observers, not both")
+		}
+		noptional := 0
+		for i, obs := range sc.Observers {
+			msgs = append(msgs,
+				obs.problems(fmt.Sprintf("observer %d", i+1))...)
+			if obs.Optional {
+				noptional++
+			}
+		}
+		if noptional == len(sc.Observers) {
+			msgs = append(msgs, "at least one observer must not be optional")
+		}
+		if sc.MinOptional < 0 || sc.MinOptional > noptional {
+			msgs = append(msgs, fmt.Sprintf(
+				"minoptional must be between 0 and %d, not %d",
+				noptional, sc.MinOptional))
+		}
+	} else {
+		msgs = append(msgs, sc.ObserverList()[0].problems("observer")...)
+		if sc.MinOptional != 0 {
+			msgs = append(msgs, "minoptional needs a list of observers")
+		}
+	}
+	timed := sc.Departure != nil || len(sc.Rings) > 0
+	for i, spec := range sc.Rings {
+		msgs = append(msgs, spec.problems(fmt.Sprintf("ring %d", i+1))...)
+	}
+	for _, obs := range sc.ObserverList() {
+		timed = timed || len(obs.Time) > 0
+	}
+	if sc.Departure != nil {
+		msgs = append(msgs, sc.Departure.problems("departure")...)
+		if len(sc.Departure.Time) == 0 {
+			msgs = append(msgs, "departure must have a time")
+		}
+	}
+	if len(sc.Speed) > 0 {
+		if len(sc.Speed) != 2 {
+			msgs = append(msgs, fmt.Sprintf(
+				"speed must have two numbers, but %d given", len(sc.Speed)))
+		} else if sc.Speed[0] < 0 || sc.Speed[1] <= 0 ||
+			sc.Speed[0] > sc.Speed[1] {
+			msgs = append(msgs, fmt.Sprintf(
+				"speed %v must be a minimum and greater maximum in km/h",
+				sc.Speed))
+		}
+	} else if timed {
+		msgs = append(msgs, "times are given, so speed is needed")
+	}
+	if len(sc.Date) > 0 {
+		if _, err := time.Parse(SCENARIO_DATE_FORMAT, sc.Date); err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"date %q is not like \"2014-03-08\"", sc.Date))
+		}
+	}
+	if sc.UsesMagnetic() {
+		// All observers are given a magnetic course in the results
+		for _, obs := range sc.ObserverList() {
+			if len(obs.Time) == 0 && len(sc.Date) == 0 {
+				msgs = append(msgs, "headings are magnetic, so give each " +
+					"observer a time or the scenario a date")
+				break
+			}
+		}
+	}
+	if sc.Scoring != nil {
+		msgs = append(msgs, sc.Scoring.problems()...)
+	}
+	if sc.Wind != nil {
+		msgs = append(msgs, sc.Wind.problems()...)
+		if len(sc.Airspeed) == 0 {
+			msgs = append(msgs, "wind is given, so airspeed is needed")
+		}
+	} else if len(sc.Airspeed) > 0 {
+		msgs = append(msgs, "airspeed needs a wind")
+	}
+	if len(sc.Airspeed) > 0 {
+		if len(sc.Airspeed) != 2 {
+			msgs = append(msgs, fmt.Sprintf(
+				"airspeed must have two numbers, but %d given",
+				len(sc.Airspeed)))
+		} else if sc.Airspeed[0] <= 0 || sc.Airspeed[0] > sc.Airspeed[1] {
+			msgs = append(msgs, fmt.Sprintf(
+				"airspeed %v must be a positive minimum and maximum in km/h",
+				sc.Airspeed))
+		}
+	}
+	if sc.Nproc < 1 {
+		msgs = append(msgs, fmt.Sprintf(
+			"nproc must be at least 1, not %d", sc.Nproc))
+	}
+	if sc.Pairs != "" && sc.Pairs != "all" && sc.Pairs != "airways" {
+		msgs = append(msgs, fmt.Sprintf(
+			"pairs must be \"all\" or \"airways\", not %q", sc.Pairs))
+	}
+	if sc.Directmax < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"directmax must not be negative, not %g", sc.Directmax))
+	}
+	if sc.Level != "" && sc.Level != "H" && sc.Level != "L" {
+		msgs = append(msgs, fmt.Sprintf(
+			"level must be \"H\", \"L\" or left out, not %q", sc.Level))
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+func ReadScenarioFile(fpath string) Scenario {
+	byts, err := ioutil.ReadFile(fpath)
+	ifError(err)
+	var sc Scenario
+	dec := json.NewDecoder(bytes.NewReader(byts))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sc); err != nil {
+		Fatal("Could not parse scenario %s: %v", fpath, err)
+	}
+	if err := sc.Validate(); err != nil {
+		Fatal("Invalid scenario %s:\n%v", fpath, err)
+	}
+	return sc
+}
+
+func GetResultScenarioPath(datapath string) string {
+	return filepath.Join(datapath, RESULT_SCENARIO_NAME)
+}
+
+// Keep the scenario next to the results, so the run can be reproduced.
+func WriteScenarioFile(datapath string, sc Scenario) {
+	path := GetResultScenarioPath(datapath)
+	err := os.RemoveAll(path)
+	ifError(err)
+	byts, err := json.MarshalIndent(sc, "", "\t")
+	ifError(err)
+	Println("Writing scenario to %s", path)
+	err = ioutil.WriteFile(path, append(byts, '\n'), 0644)
+	ifError(err)
+	return
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Scoring of flyby candidates, in place of the hard cutoffs on distance and
+// heading.  Within an observer's dmax and heading range a path scores 1;
+// beyond them the score falls off as a Gaussian with Dsigma on distance and
+// a von Mises distribution with Hsigma on heading.  Paths are searched for up
+// to 3 sigma beyond the limits.  Priors multiply the score for each end of
+// the path, by location Kind, or failing that Type, e.g. "VOR" or "Airport".
+type ScoringSpec struct {
+	Dsigma		float64				`json:"dsigma"`		// km
+	Hsigma		float64				`json:"hsigma"`		// deg
+	Priors		map[string]float64	`json:"priors,omitempty"`
+	Minscore	float64				`json:"minscore,omitempty"`
+}
+
+// How much one constraint contributed to a score.  Observers that do not
+// fit have factors all the same, so that each always has its place, but
+// they are left out of the score.
+type ScoreFactor struct {
+	Name	string
+	Value	float64
+	Skipped	bool
+}
+
+// How far beyond the limits paths are searched for, in sigmas.
+const SCORE_SIGMAS float64 = 3.0
+
+// Number of best scoring flybys printed.
+const SCORE_PRINT_TOP int = 10
+
+func (spec ScoringSpec) problems() []string {
+	var msgs []string
+	if spec.Dsigma <= 0 || spec.Hsigma <= 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"scoring dsigma and hsigma must be positive, not %g and %g",
+			spec.Dsigma, spec.Hsigma))
+	}
+	for kind, p := range spec.Priors {
+		if p < 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"scoring prior for %q must not be negative, not %g", kind, p))
+		}
+	}
+	if spec.Minscore < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"scoring minscore must not be negative, not %g", spec.Minscore))
+	}
+	return msgs
+}
+
+// Limits widened so that paths scoring more than a little are found.
+func (spec ScoringSpec) Widen(dmax float64, heading []float64) (float64, []float64) {
+	return dmax + SCORE_SIGMAS*spec.Dsigma,
+		WidenCourseRange(heading, SCORE_SIGMAS*spec.Hsigma)
+}
+
+// Gaussian fall-off beyond dmax, for distances in km.
+func (spec ScoringSpec) DistanceFactor(d, dmax float64) float64 {
+	x := math.Max(0.0, d - dmax)/spec.Dsigma
+	return math.Exp(-0.5*x*x)
+}
+
+// Von Mises fall-off outside the heading range, in deg, scaled to 1 at its
+// edges.
+func (spec ScoringSpec) HeadingFactor(h float64, heading []float64) float64 {
+	dev := 0.0
+	if !InCourseRange(h, heading[0], heading[1]) {
+		dev = math.Min(CourseDifference(h, heading[0]),
+			CourseDifference(h, heading[1]))
+	}
+	kappa := 1.0/math.Pow(DegToRad(spec.Hsigma), 2)
+	return math.Exp(kappa*(math.Cos(DegToRad(dev)) - 1.0))
+}
+
+func (spec ScoringSpec) Prior(loc Location) float64 {
+	if p, ok := spec.Priors[loc.Kind]; ok && len(loc.Kind) > 0 {
+		return p
+	}
+	if p, ok := spec.Priors[loc.Type]; ok {
+		return p
+	}
+	return 1.0
+}
+
+// Distance and heading factors for each observer, skipped for those that do
+// not fit, and priors for the first and second locations of the path, with
+// the product of those not skipped.
+func (spec ScoringSpec) Score(fb *Flyby, obs []ObserverConstraint) (float64, []ScoreFactor) {
+	factors := []ScoreFactor{}
+	for i, fix := range fb.Observers {
+		distance := ScoreFactor{Name: "distance " + fix.Label, Skipped: !fix.Fits}
+		heading := ScoreFactor{Name: "heading " + fix.Label, Skipped: !fix.Fits}
+		if fix.Fits {
+			distance.Value = spec.DistanceFactor(RadToDist(fix.Nearest),
+				obs[i].Reach())
+			heading.Value = spec.HeadingFactor(RadToDeg(fix.Heading),
+				obs[i].Heading)
+		}
+		factors = append(factors, distance, heading)
+	}
+	if len(spec.Priors) > 0 {
+		factors = append(factors,
+			ScoreFactor{Name: "prior loc1", Value: spec.Prior(fb.Loc1)},
+			ScoreFactor{Name: "prior loc2", Value: spec.Prior(fb.Loc2)})
+	}
+	score := 1.0
+	for _, f := range factors {
+		if !f.Skipped {
+			score *= f.Value
+		}
+	}
+	return score, factors
+}
+
+// Best first.
+func RankFlybys(flybys []Flyby) {
+	sort.SliceStable(flybys, func(i, j int) bool {
+		return flybys[i].Score > flybys[j].Score
+	})
+	return
+}
+
+func PrintTopFlybys(flybys []Flyby, n int) {
+	for i, fb := range flybys {
+		if i == n {
+			break
+		}
+		parts := []string{}
+		for _, f := range fb.Factors {
+			if !f.Skipped {
+				parts = append(parts, fmt.Sprintf("%s %.3g", f.Name, f.Value))
+			}
+		}
+		Println("%2d score %.4g: %v -> %v (%s)", i+1, fb.Score, fb.Loc1, fb.Loc2,
+			strings.Join(parts, ", "))
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	. "math"
+)
+
+// What an observer could see: from an Eye height above the ground, an
+// aircraft flying at any Altitude in the range, at least MinElevation above
+// the horizon.  The earth is a sphere of radius EARTH_RAD, without
+// refraction.
+type SightSpec struct {
+	Eye				float64		`json:"eye,omitempty"`		// m
+	MinElevation	float64		`json:"minelevation,omitempty"`	// deg
+	Altitude		[]float64	`json:"altitude"`	// m, min and max
+}
+
+func (spec SightSpec) problems(name string) []string {
+	var msgs []string
+	if spec.Eye < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s sight eye height must not be negative, not %g m",
+			name, spec.Eye))
+	}
+	if spec.MinElevation < 0 || spec.MinElevation >= 90 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s sight minelevation must be from 0 to less than 90 deg, not %g",
+			name, spec.MinElevation))
+	}
+	if len(spec.Altitude) != 2 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s sight altitude must have two numbers, but %d given",
+			name, len(spec.Altitude)))
+	} else if spec.Altitude[0] < 0 || spec.Altitude[0] > spec.Altitude[1] ||
+		spec.Altitude[1] <= spec.Eye {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s sight altitude %v must be a minimum and maximum in m, " +
+			"the maximum above the eye", name, spec.Altitude))
+	}
+	return msgs
+}
+
+// Central angle in rad from the observer out to which an aircraft at
+// altitude m is at least the minimum elevation above the horizon.
+func (spec SightSpec) reachAngle(altitude float64) float64 {
+	r1 := EARTH_RAD + spec.Eye/1000.0
+	r2 := EARTH_RAD + altitude/1000.0
+	elev := DegToRad(spec.MinElevation)
+	return Max(0.0, SafeAcos(r1*Cos(elev)/r2) - elev)
+}
+
+// Greatest ground distance in km at which the aircraft can be seen, at the
+// highest altitude, since the higher it flies the farther it is seen.
+func (spec SightSpec) Range() float64 {
+	return RadToDist(spec.reachAngle(spec.Altitude[1]))
+}
+
+// Elevation in deg above the horizon of an aircraft at altitude m, dist km
+// away over the ground.
+func (spec SightSpec) Elevation(dist, altitude float64) float64 {
+	r1 := EARTH_RAD + spec.Eye/1000.0
+	r2 := EARTH_RAD + altitude/1000.0
+	psi := DistToRad(dist)
+	return RadToDeg(Atan2(r2*Cos(psi) - r1, r2*Sin(psi)))
+}
+
+// Elevations in deg at the lowest and highest altitudes, dist km away.
+func (spec SightSpec) Elevations(dist float64) []float64 {
+	return []float64{spec.Elevation(dist, spec.Altitude[0]),
+		spec.Elevation(dist, spec.Altitude[1])}
+}
+
+// How near the aircraft must pass an observer, in km: within dmax, if given,
+// and within sight, if given.
+func (obs ObserverSpec) Reach() float64 {
+	if obs.Sight == nil {
+		return obs.Dmax
+	}
+	if obs.Dmax > 0 {
+		return Min(obs.Dmax, obs.Sight.Range())
+	}
+	return obs.Sight.Range()
+}
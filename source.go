@@ -0,0 +1,158 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A provider of locations, such as a website's pages or a navigation
+// database, read from the data directory.
+type LocationSource interface {
+	// Short name used with -src and recorded in each Location's Source
+	Name() string
+	// Where the data comes from
+	Provenance() string
+	Load(datapath string) Locations
+}
+
+type FallingRainSource struct{}
+type OurAirportsSource struct{}
+type ARINCSource struct{}
+type XPlaneSource struct{}
+
+// Locations in the supplementary csv format, from the file Filename in the
+// data directory.
+type CSVFileSource struct {
+	Label		string
+	Filename	string
+	About		string
+}
+
+// Sources by name, which -src chooses from.
+var locationSources map[string]LocationSource = map[string]LocationSource{}
+
+func RegisterLocationSource(src LocationSource) {
+	if _, exists := locationSources[src.Name()]; exists {
+		Fatal("Location data source %q registered twice", src.Name())
+	}
+	locationSources[src.Name()] = src
+	return
+}
+
+func init() {
+	for _, src := range []LocationSource{
+		FallingRainSource{}, OurAirportsSource{}, ARINCSource{}, XPlaneSource{},
+		CSVFileSource{
+			Label:		"supplementary",
+			Filename:	ADDITIONAL_LOCATIONS_NAME,
+			About:		"locations added to this repository by hand",
+		},
+		CSVFileSource{
+			Label:		"user",
+			Filename:	USER_LOCATIONS_NAME,
+			About:		"your own locations and corrections",
+		},
+	} {
+		RegisterLocationSource(src)
+	}
+}
+
+// Names of the sources registered, in order.
+func LocationSourceNames() []string {
+	names := []string{}
+	for name := range locationSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func LocationSourceByName(name string) LocationSource {
+	src, ok := locationSources[strings.TrimSpace(name)]
+	if !ok {
+		Fatal("Unknown location data source %q, use one of %s", name,
+			strings.Join(LocationSourceNames(), ", "))
+	}
+	return src
+}
+
+func (src FallingRainSource) Name() string {
+	return "fallingrain"
+}
+
+func (src FallingRainSource) Provenance() string {
+	return "Falling Rain world airports and waypoints, " + BASE_ADDRESS
+}
+
+func (src FallingRainSource) Load(datapath string) Locations {
+	return loadFallingRainData(datapath)
+}
+
+func (src OurAirportsSource) Name() string {
+	return "ourairports"
+}
+
+func (src OurAirportsSource) Provenance() string {
+	return "OurAirports public domain data, http://ourairports.com/data/"
+}
+
+func (src OurAirportsSource) Load(datapath string) Locations {
+	return ReadOurAirports(datapath)
+}
+
+func (src ARINCSource) Name() string {
+	return "arinc"
+}
+
+func (src ARINCSource) Provenance() string {
+	return "ARINC 424 files such as the FAA CIFP, *" + ARINC_FILE_SUFFIX
+}
+
+func (src ARINCSource) Load(datapath string) Locations {
+	return LoadARINCData(datapath)
+}
+
+func (src XPlaneSource) Name() string {
+	return "xplane"
+}
+
+func (src XPlaneSource) Provenance() string {
+	return "X-Plane navigation data, " + strings.Join([]string{
+		XPLANE_FIX_NAME, XPLANE_NAV_NAME, XPLANE_APT_NAME}, ", ")
+}
+
+func (src XPlaneSource) Load(datapath string) Locations {
+	return LoadXPlaneData(datapath)
+}
+
+func (src CSVFileSource) Name() string {
+	return src.Label
+}
+
+func (src CSVFileSource) Provenance() string {
+	return src.About + ", " + src.Filename
+}
+
+func (src CSVFileSource) Load(datapath string) Locations {
+	return readSupplementaryLocationsFromFile(filepath.Join(datapath,
+		src.Filename))
+}
+
+// Load each source named in turn, recording in each location where it came
+// from.  Sources named first take priority, since RemoveRedundant keeps the
+// first of redundant locations, though it favors airports over waypoints.
+func LoadLocationData(datapath string, names []string) Locations {
+	locs := Locations([]Location{})
+	for _, name := range names {
+		src := LocationSourceByName(name)
+		locs2 := src.Load(datapath)
+		for i := range locs2 {
+			locs2[i].Source = src.Name()
+		}
+		Println("Loaded %d locations from %s: %s", len(locs2), src.Name(),
+			src.Provenance())
+		locs = append(locs, locs2...)
+	}
+	return locs
+}
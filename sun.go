@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	. "math"
+	"time"
+)
+
+// Position of the sun, by the NOAA solar calculator's formulae from Meeus,
+// good to about an arcminute between 1800 and 2100.
+type SunPosition struct {
+	Azimuth		float64 // deg clockwise from true north
+	Elevation	float64 // deg above the horizon, allowing for refraction
+}
+
+// Lighting constraints on a sighting at its time: the sun above the horizon,
+// and the aircraft not flying within MinAngle of the sun.
+type SunSpec struct {
+	Above		bool	`json:"above,omitempty"`
+	MinAngle	float64	`json:"minangle,omitempty"` // deg
+}
+
+// Julian day of the UTC time, including its fraction.
+func JulianDay(t time.Time) float64 {
+	return float64(t.UnixNano())/1e9/86400.0 + 2440587.5
+}
+
+// Declination of the sun in deg, and the equation of time in minutes, being
+// apparent less mean solar time.
+func sunDeclination(t time.Time) (float64, float64) {
+	jc := (JulianDay(t) - 2451545.0)/36525.0
+	// Geometric mean longitude and anomaly, deg, and orbital eccentricity
+	l0 := Mod(280.46646 + jc*(36000.76983 + jc*0.0003032), 360.0)
+	m := 357.52911 + jc*(35999.05029 - 0.0001537*jc)
+	e := 0.016708634 - jc*(0.000042037 + 0.0000001267*jc)
+	mr := DegToRad(m)
+	centre := Sin(mr)*(1.914602 - jc*(0.004817 + 0.000014*jc)) +
+		Sin(2.0*mr)*(0.019993 - 0.000101*jc) + Sin(3.0*mr)*0.000289
+	omega := DegToRad(125.04 - 1934.136*jc)
+	apparent := DegToRad(l0 + centre - 0.00569 - 0.00478*Sin(omega))
+	obliquity := 23.0 + (26.0 + (21.448 -
+		jc*(46.815 + jc*(0.00059 - jc*0.001813)))/60.0)/60.0
+	obliquity = DegToRad(obliquity + 0.00256*Cos(omega))
+	decl := Asin(Sin(obliquity)*Sin(apparent))
+	y := Tan(obliquity/2.0)*Tan(obliquity/2.0)
+	l0r := DegToRad(l0)
+	eqtime := 4.0*RadToDeg(y*Sin(2.0*l0r) - 2.0*e*Sin(mr) +
+		4.0*e*y*Sin(mr)*Cos(2.0*l0r) - 0.5*y*y*Sin(4.0*l0r) -
+		1.25*e*e*Sin(2.0*mr))
+	return RadToDeg(decl), eqtime
+}
+
+// Refraction in deg lifting the sun seen at elevation deg.
+func solarRefraction(elev float64) float64 {
+	te := Tan(DegToRad(elev))
+	var arcsec float64
+	switch {
+		case elev > 85.0:
+			arcsec = 0.0
+		case elev > 5.0:
+			arcsec = 58.1/te - 0.07/(te*te*te) + 0.000086/Pow(te, 5)
+		case elev > -0.575:
+			arcsec = 1735.0 + elev*(-518.2 + elev*(103.4 +
+				elev*(-12.79 + elev*0.711)))
+		default:
+			arcsec = -20.772/te
+	}
+	return arcsec/3600.0
+}
+
+// Where the sun is seen from loc at time t.
+func SunAt(loc Location, t time.Time) SunPosition {
+	t = t.UTC()
+	decl, eqtime := sunDeclination(t)
+	minutes := float64(t.Hour()*60 + t.Minute()) +
+		(float64(t.Second()) + float64(t.Nanosecond())/1e9)/60.0
+	solar := Mod(minutes + eqtime + 4.0*loc.Long, 1440.0)
+	ha := DegToRad(solar/4.0 - 180.0)
+	lat, d := DegToRad(loc.Lat), DegToRad(decl)
+	elev := RadToDeg(Asin(Max(-1.0, Min(1.0,
+		Sin(lat)*Sin(d) + Cos(lat)*Cos(d)*Cos(ha)))))
+	az := RadToDeg(Atan2(Sin(ha), Cos(ha)*Sin(lat) - Tan(d)*Cos(lat))) + 180.0
+	return SunPosition{
+		Azimuth:	normalizeAzimuth(az),
+		Elevation:	elev + solarRefraction(elev),
+	}
+}
+
+// Angle in deg between the sun and the direction of level flight on the
+// course deg, so 0 when flying straight at it.
+func (sun SunPosition) AngleTo(course float64) float64 {
+	return RadToDeg(SafeAcos(Cos(DegToRad(sun.Elevation))*
+		Cos(DegToRad(course - sun.Azimuth))))
+}
+
+func (sun SunPosition) String() string {
+	return fmt.Sprintf("sun azimuth %.1f deg, elevation %.1f deg",
+		sun.Azimuth, sun.Elevation)
+}
+
+func (spec SunSpec) problems(name string) []string {
+	var msgs []string
+	if spec.MinAngle < 0 || spec.MinAngle > 180 {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s sun minangle must be from 0 to 180 deg, not %g",
+			name, spec.MinAngle))
+	}
+	return msgs
+}
+
+// Whether a flight on the course deg, with the sun where it is, meets the
+// constraints.
+func (spec SunSpec) Fits(sun SunPosition, course float64) bool {
+	if spec.Above && sun.Elevation < 0 {
+		return false
+	}
+	return sun.AngleTo(course) >= spec.MinAngle
+}
@@ -4,13 +4,2294 @@
 package main
 
 import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 func Test(which string) {
     switch cmdTest {
+		case "index":
+			testIndex()
+		case "near":
+			testNear()
+		case "ourairports":
+			testOurAirports()
+		case "arinc":
+			testARINC()
+		case "xplane":
+			testXPlane()
+		case "airway":
+			testAirway()
+		case "route":
+			testRoute()
+		case "observers":
+			testObservers()
+		case "timeline":
+			testTimeline()
+		case "ring":
+			testRing()
+		case "geodesy":
+			testGeodesy()
+		case "navigate":
+			testNavigate()
+		case "rhumb":
+			testRhumb()
+		case "deadreckon":
+			testDeadReckon()
+		case "score":
+			testScore()
+		case "heading":
+			testHeading()
+		case "magnetic":
+			testMagnetic()
+		case "wind":
+			testWind()
+		case "sight":
+			testSight()
+		case "sun":
+			testSun()
+		case "download":
+			testDownload()
+		case "sources":
+			testSources()
+		case "merge":
+			testMerge()
+		case "native":
+			testNative()
 		default:
 			Println("No matching tests")
 	}
 	os.Exit(0)
 }
+
+// Random locations clustered enough to give plenty of redundancies.
+func randomLocations(n int, seed int64) Locations {
+	rnd := rand.New(rand.NewSource(seed))
+	locs := Locations([]Location{})
+	for i := 0; i < n; i++ {
+		typ := LOCTYPE["Waypoint"].Tag
+		if rnd.Intn(4) == 0 {
+			typ = LOCTYPE["Airport"].Tag
+		}
+		locs = append(locs, Location{
+			Type:	typ,
+			Name:	fmt.Sprintf("LOC%d", i),
+			Lat:	float64(rnd.Intn(2000))/100.0 - 10.0,
+			Long:	float64(rnd.Intn(2000))/100.0 + 170.0,
+		})
+	}
+	return locs
+}
+
+// Grid index must give the same results as a scan of every location.
+func testIndex() {
+	locs := randomLocations(5000, 1)
+	d := 2000.0 // m
+	ddeg := RadToDeg(DistToRad(d/1000.0))
+	// Reference, comparing with every earlier location
+	scan := append(Locations{}, locs...)
+	want := Locations([]Location{})
+	for i := 0; i < len(scan); i++ {
+		found := false
+		for j := 0; j < i; j++ {
+			if math.Abs(scan[i].Lat-scan[j].Lat) < ddeg &&
+				math.Abs(scan[i].Long-scan[j].Long) < ddeg {
+				found = true
+				if scan[i].Type == LOCTYPE["Waypoint"].Tag &&
+					scan[j].Type == LOCTYPE["Airport"].Tag {
+					scan[i] = scan[j]
+				}
+				break
+			}
+		}
+		if !found {
+			want = append(want, scan[i])
+		}
+	}
+	got := append(Locations{}, locs...).RemoveRedundant(d)
+	if len(got) != len(want) {
+		Fatal("RemoveRedundant kept %d, scan kept %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			Fatal("RemoveRedundant differs at %d: %v vs %v", i, got[i], want[i])
+		}
+	}
+	Println("RemoveRedundant matches scan for %d locations", len(locs))
+	// Square search around every 100th location
+	idx := locs.Index(ddeg)
+	for i0 := 0; i0 < len(locs); i0 += 100 {
+		n := 0
+		for i := range locs {
+			if math.Abs(locs[i].Lat-locs[i0].Lat) < ddeg &&
+				math.Abs(locs[i].Long-locs[i0].Long) < ddeg {
+				n++
+			}
+		}
+		m := 0
+		for _, i := range idx.InSquare(locs[i0].Lat, locs[i0].Long, ddeg) {
+			if math.Abs(locs[i].Lat-locs[i0].Lat) < ddeg &&
+				math.Abs(locs[i].Long-locs[i0].Long) < ddeg {
+				m++
+			}
+		}
+		if n != m {
+			Fatal("InSquare found %d near %v, scan found %d", m, locs[i0], n)
+		}
+	}
+	Println("InSquare matches scan")
+	return
+}
+
+// Radius and nearest queries must agree with distances to every location,
+// including around the antimeridian and the poles.
+func testNear() {
+	rnd := rand.New(rand.NewSource(2))
+	locs := Locations([]Location{})
+	for i := 0; i < 20000; i++ {
+		locs = append(locs, Location{
+			Type:	LOCTYPE["Waypoint"].Tag,
+			Name:	fmt.Sprintf("LOC%d", i),
+			Lat:	RadToDeg(math.Asin(2.0*rnd.Float64() - 1.0)),
+			Long:	360.0*rnd.Float64() - 180.0,
+		})
+	}
+	idx := locs.Index(QUERY_GRID_CELL)
+	centers := []Location{
+		{Name: "Kudahuvadhoo", Lat: 2.666667, Long: 72.9},
+		{Name: "Antimeridian", Lat: -16.5, Long: 179.9},
+		{Name: "NearPole", Lat: 88.5, Long: -40.0},
+		{Name: "SouthPole", Lat: -90.0, Long: 0.0},
+	}
+	for _, center := range centers {
+		v0 := center.ToCartesianVector()
+		for _, km := range []float64{50.0, 500.0, 3000.0} {
+			n := 0
+			for _, loc := range locs {
+				if RadToDist(v0.AngleWith(loc.ToCartesianVector())) <= km {
+					n++
+				}
+			}
+			got := idx.WithinRadius(center, km)
+			if len(got) != n {
+				Fatal("WithinRadius %s %.0f km found %d, scan found %d",
+					center.Name, km, len(got), n)
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i].Dist < got[i-1].Dist {
+					Fatal("WithinRadius %s not sorted at %d", center.Name, i)
+				}
+			}
+		}
+		k := 25
+		got := idx.Nearest(center, k)
+		if len(got) != k {
+			Fatal("Nearest %s gave %d, not %d", center.Name, len(got), k)
+		}
+		beyond := 0
+		for _, loc := range locs {
+			if RadToDist(v0.AngleWith(loc.ToCartesianVector())) <
+				got[k-1].Dist {
+				beyond++
+			}
+		}
+		if beyond > k-1 {
+			Fatal("Nearest %s missed %d closer locations", center.Name,
+				beyond-(k-1))
+		}
+	}
+	Println("WithinRadius and Nearest match scan")
+	return
+}
+
+func testOurAirports() {
+	dir := filepath.Join(GetDataPath(), TESTDATA_DIR, "ourairports")
+	locs := ReadOurAirports(dir)
+	if len(locs) != 5 {
+		Fatal("Expected 3 airports and 2 navaids, got %d locations", len(locs))
+	}
+	loc, exist, _ := locs.FindBy("IATA:MLE")
+	if !exist {
+		Fatal("Velana International not found by IATA code")
+	}
+	if loc.Type != LOCTYPE["Airport"].Tag || loc.Kind != "large_airport" ||
+		loc.ICAOcode != "VRMM" || loc.Country != "MV" || loc.State != "MLE" ||
+		loc.Desc != "Malé" || loc.Lat != 4.19183 || loc.Long != 73.529099 ||
+		loc.Elevation != 6 {
+		Fatal("Velana International mapped wrongly: %#v", loc)
+	}
+	if loc.RunwayLength != 10499 {
+		Fatal("Closed runway counted, longest is %.0f ft", loc.RunwayLength)
+	}
+	loc, _, _ = locs.FindBy("FAA:SFO")
+	if loc.ICAOcode != "KSFO" || loc.State != "CA" || loc.RunwayLength != 11870 {
+		Fatal("San Francisco International mapped wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("Name:Test Lagoon, North")
+	if loc.ICAOcode != "MV-0001" || loc.FAAcode != "" || loc.RunwayLength != 0 {
+		Fatal("Seaplane base mapped wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("ICAO:MLE")
+	if loc.Type != LOCTYPE["Waypoint"].Tag || loc.Kind != "VOR-DME" ||
+		loc.Frequency != 112900 || loc.Control != "BOTH" {
+		Fatal("Male VOR-DME mapped wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("ICAO:HA")
+	if loc.Kind != "NDB" || loc.Frequency != 395 {
+		Fatal("Hanimaadhoo NDB mapped wrongly: %#v", loc)
+	}
+	Println("OurAirports fixtures read correctly")
+	return
+}
+
+func testARINC() {
+	path := filepath.Join(GetDataPath(), TESTDATA_DIR, "arinc424", "sample.424")
+	locs, fixes := ReadARINC424(path)
+	if len(locs) != 6 {
+		Fatal("Expected 6 locations, got %d: %v", len(locs), locs)
+	}
+	loc, _, _ := locs.FindBy("ICAO:ELATO")
+	if loc.Type != LOCTYPE["Waypoint"].Tag || loc.Region != "VR" ||
+		loc.Kind != "Intersection" || loc.Control != "Both" ||
+		math.Abs(loc.Lat-(4.0+59.0/60.0+40.0/3600.0)) > 1e-9 ||
+		math.Abs(loc.Long-(72.0+46.0/60.0+52.0/3600.0)) > 1e-9 {
+		Fatal("Enroute waypoint parsed wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("ICAO:MM401")
+	if loc.Kind != "RNAV" || loc.Control != "Terminal" {
+		Fatal("Terminal waypoint parsed wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("ICAO:MLE")
+	if loc.Kind != "VOR-DME" || loc.Control != "High" ||
+		loc.Frequency != 112900 || loc.Elevation != 6 ||
+		math.Abs(loc.Lat-(4.0+11.0/60.0+11.20/3600.0)) > 1e-9 {
+		Fatal("VOR-DME parsed wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("ICAO:GAN")
+	if loc.Kind != "DME" ||
+		math.Abs(loc.Lat+(0.0+41.0/60.0+20.0/3600.0)) > 1e-9 {
+		Fatal("DME parsed wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("ICAO:HA")
+	if loc.Kind != "NDB" || loc.Frequency != 395 || loc.Name != "HANIMAADHOO" {
+		Fatal("NDB parsed wrongly: %#v", loc)
+	}
+	loc, _, _ = locs.FindBy("IATA:MLE")
+	if loc.Type != LOCTYPE["Airport"].Tag || loc.ICAOcode != "VRMM" ||
+		loc.RunwayLength != 10500 || loc.Name != "VELANA INTL" {
+		Fatal("Airport parsed wrongly: %#v", loc)
+	}
+	if len(fixes) != 2 || fixes[0].Route != "L894" || fixes[1].Seq != 20 ||
+		fixes[1].Fix != "MLE" || fixes[1].Section != "D" ||
+		fixes[0].Direction != "F" || fixes[0].Level != "H" ||
+		fixes[0].MaxAlt != "FL460" {
+		Fatal("Airway fixes parsed wrongly: %#v", fixes)
+	}
+	Println("ARINC 424 sample read correctly")
+	return
+}
+
+func testXPlane() {
+	dir := filepath.Join(GetDataPath(), TESTDATA_DIR, "xplane")
+	locs := ReadXPlaneFixes(filepath.Join(dir, XPLANE_FIX_NAME))
+	if len(locs) != 3 {
+		Fatal("Expected 3 fixes before the terminator, got %d", len(locs))
+	}
+	if locs[0].ICAOcode != "ELATO" || locs[0].Region != "VR" ||
+		locs[0].Lat != 4.993333 || locs[1].Control != "Terminal" ||
+		locs[2].Long != 179.9 {
+		Fatal("Fixes parsed wrongly: %#v", locs)
+	}
+	locs = ReadXPlaneNavaids(filepath.Join(dir, XPLANE_NAV_NAME))
+	if len(locs) != 5 {
+		Fatal("Expected 5 navaids, got %d", len(locs))
+	}
+	if locs[0].Kind != "NDB" || locs[0].Frequency != 395 ||
+		locs[0].Name != "HANIMAADHOO NDB" || locs[0].Elevation != 4 {
+		Fatal("NDB parsed wrongly: %#v", locs[0])
+	}
+	if locs[1].Kind != "VOR-DME" || locs[1].Frequency != 112900 ||
+		locs[1].Region != "VR" || locs[1].Elevation != 6 {
+		Fatal("VOR-DME parsed wrongly: %#v", locs[1])
+	}
+	if locs[3].Kind != "ILS" || locs[3].ICAOcode != "IMLE" {
+		Fatal("ILS parsed wrongly: %#v", locs[3])
+	}
+	locs = ReadXPlaneAirports(filepath.Join(dir, XPLANE_APT_NAME))
+	if len(locs) != 4 {
+		Fatal("Expected 4 airports with a position, got %d", len(locs))
+	}
+	if locs[0].ICAOcode != "VRMM" || locs[0].IATAcode != "MLE" ||
+		locs[0].Name != "Velana Intl" || locs[0].Lat != 4.19183 ||
+		locs[0].Long != 73.529099 || locs[0].Country != "Maldives" {
+		Fatal("Airport parsed wrongly: %#v", locs[0])
+	}
+	if locs[1].Kind != "Seaplane base" || locs[1].Long != 73.005 {
+		Fatal("Seaplane base parsed wrongly: %#v", locs[1])
+	}
+	if locs[2].Kind != "Heliport" || locs[2].Lat != 5.5 {
+		Fatal("Heliport parsed wrongly: %#v", locs[2])
+	}
+	if locs[3].Lat != -16.5 || math.Abs(locs[3].Long + 179.99) > 1e-9 {
+		Fatal("Runway across the antimeridian placed at %f %f", locs[3].Lat,
+			locs[3].Long)
+	}
+	Println("X-Plane fixtures read correctly")
+	return
+}
+
+func testAirway() {
+	dir := filepath.Join(GetDataPath(), TESTDATA_DIR)
+	locs, fixes := ReadARINC424(filepath.Join(dir, "arinc424", "sample.424"))
+	airways := AirwaysFromARINC(fixes, locs)
+	if len(airways) != 1 || airways[0].Name != "L894" ||
+		len(airways[0].Fixes) != 2 || len(airways[0].Segments) != 1 ||
+		airways[0].Segments[0].Direction != "F" {
+		Fatal("ARINC airway built wrongly: %#v", airways)
+	}
+	airways2 := ReadAirwaysFile(filepath.Join(dir, AIRWAYS_CSV_NAME), locs)
+	if len(airways2) != 3 || airways2[0].Name != "W1" ||
+		airways2[0].Fixes[0].ICAOcode != "HA" ||
+		airways2[0].Fixes[2].ICAOcode != "MM401" ||
+		airways2[1].Segments[0].Level != "L" {
+		Fatal("Airway file read wrongly: %#v", airways2)
+	}
+	// Broken where a fix is missing, rather than joining those either side
+	if airways2[2].Name != "W3" || len(airways2[2].Fixes) != 2 ||
+		airways2[2].Fixes[0].ICAOcode != "MLE" ||
+		len(airways2[2].Segments) != 1 || airways2[2].Segments[0].Level != "L" ||
+		airways2[2].Segments[0].Direction != "" {
+		Fatal("Airway with a missing fix read wrongly: %#v", airways2[2])
+	}
+	airways = append(airways, airways2...)
+	_, _, iELATO := locs.FindBy("ICAO:ELATO")
+	_, _, iMLE := locs.FindBy("ICAO:MLE")
+	_, _, iHA := locs.FindBy("ICAO:HA")
+	edges := func(g *RouteGraph, i, j int) int {
+		n := 0
+		for _, e := range g.Edges[i] {
+			if e.To == j {
+				n++
+			}
+		}
+		return n
+	}
+	g := locs.BuildRouteGraph(airways, 0.0, "")
+	if edges(g, iELATO, iMLE) != 1 || edges(g, iMLE, iELATO) != 0 {
+		Fatal("One way airway segment not respected: %#v", g.Edges)
+	}
+	if edges(g, iHA, iELATO) != 1 || edges(g, iELATO, iHA) != 1 {
+		Fatal("Two way airway segment missing: %#v", g.Edges)
+	}
+	// Level H drops the low segment W2
+	g = locs.BuildRouteGraph(airways, 0.0, "H")
+	_, _, iGAN := locs.FindBy("ICAO:GAN")
+	if edges(g, iGAN, iMLE) != 0 || edges(g, iMLE, iGAN) != 0 {
+		Fatal("Low level segment kept at level H")
+	}
+	accept := FlybyPoint{
+		nearestApproach: func(loc1, loc2 Location) (bool, bool, *Flyby) {
+			return true, false, &Flyby{GreatCircle: GreatCircle{
+				Loc1: loc1, Loc2: loc2}}
+		},
+	}
+	pairs := len(g.FindFlybys([]FlybyFilter{accept, accept, accept}))
+	if pairs != len(g.Pairs()) || pairs != 3 {
+		Fatal("FindFlybys tested %d pairs, expected 3", pairs)
+	}
+	// Only the other way fits, which the one way segment ELATO to MLE rules
+	// out
+	reverse := FlybyPoint{
+		nearestApproach: func(loc1, loc2 Location) (bool, bool, *Flyby) {
+			return true, false, &Flyby{GreatCircle: GreatCircle{
+				Loc1: loc2, Loc2: loc1}}
+		},
+	}
+	for _, fb := range g.FindFlybys([]FlybyFilter{reverse, reverse}) {
+		if fb.Loc1.ICAOcode == "MLE" && fb.Loc2.ICAOcode == "ELATO" {
+			Fatal("One way segment flown the wrong way: %v", fb)
+		}
+	}
+	if n := len(g.FindFlybys([]FlybyFilter{reverse})); n != 2 {
+		Fatal("Found %d flybys flown the other way, expected 2", n)
+	}
+	// Direct-to legs within 300 km join the Maldives locations
+	g = locs.BuildRouteGraph(Airways{}, 300.0, "")
+	if edges(g, iMLE, iGAN) != 0 || edges(g, iMLE, iELATO) != 1 {
+		Fatal("Direct-to legs built wrongly: %#v", g.Edges)
+	}
+	Println("Airways and route graph built correctly")
+	return
+}
+
+// Yen's routes over a 3x3 lattice must match every simple path, sorted.
+func testRoute() {
+	locs := Locations([]Location{})
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			locs = append(locs, Location{
+				Type:	LOCTYPE["Waypoint"].Tag,
+				Name:	fmt.Sprintf("P%d%d", i, j),
+				Lat:	float64(i),
+				Long:	float64(j) + 0.01*float64(i),
+			})
+		}
+	}
+	// Only neighbours across and along are within 120 km
+	g := locs.BuildRouteGraph(Airways{}, 120.0, "")
+	all := []float64{}
+	var walk func(n int, seen map[int]bool, d float64)
+	walk = func(n int, seen map[int]bool, d float64) {
+		if n == 8 {
+			all = append(all, d)
+			return
+		}
+		for _, e := range g.Edges[n] {
+			if !seen[e.To] {
+				seen[e.To] = true
+				walk(e.To, seen, d + e.Dist)
+				seen[e.To] = false
+			}
+		}
+	}
+	walk(0, map[int]bool{0: true}, 0.0)
+	sort.Float64s(all)
+	k := 8
+	routes := g.KShortestRoutesVia(0, 8, k, DistToRad(120.0), Locations{}, 0,
+		func(r Route) bool { return true }, MAX_ROUTES_TRIED)
+	if len(routes) != k {
+		Fatal("Found %d routes, not %d", len(routes), k)
+	}
+	for i, r := range routes {
+		if math.Abs(r.Dist-all[i]) > 1e-12 {
+			Fatal("Route %d is %.6f rad, expected %.6f", i+1, r.Dist, all[i])
+		}
+		for _, r2 := range routes[:i] {
+			if sameNodes(r.Nodes, r2.Nodes) {
+				Fatal("Route %d repeated: %v", i+1, r.Nodes)
+			}
+		}
+	}
+	// Passing near the middle, then the top left corner, no longer than the
+	// shortest of the paths found above that do, being free to double back
+	via := Locations{locs[4], locs[6]}
+	radius := DistToRad(5.0)
+	filtered := g.KShortestRoutesVia(0, 8, 1, DistToRad(120.0), Locations{}, 0,
+		func(r Route) bool { return testPassesNear(g, r, via, radius) },
+		MAX_ROUTES_TRIED)
+	routes = g.KShortestRoutesVia(0, 8, 3, DistToRad(120.0), via, radius,
+		func(r Route) bool { return true }, 3)
+	if len(routes) != 3 || len(filtered) != 1 ||
+		!sameNodes(filtered[0].Nodes, []int{0, 1, 4, 3, 6, 7, 8}) ||
+		routes[0].Dist > filtered[0].Dist ||
+		!sameNodes(routes[0].Nodes, []int{0, 3, 4, 7, 6, 7, 8}) {
+		Fatal("Routes via middle and corner wrong: %v", routes)
+	}
+	for i, r := range routes {
+		if !testPassesNear(g, r, via, radius) || (i > 0 && r.Dist < routes[i-1].Dist) {
+			Fatal("Route %d via middle and corner wrong: %v", i+1, r)
+		}
+	}
+	// A via location off to the side, which the shortest routes from 0 to 2
+	// never pass, so that filtering them gives up
+	via = Locations{locs[8]}
+	if n := len(g.KShortestRoutesVia(0, 2, 1, DistToRad(120.0), Locations{}, 0,
+		func(r Route) bool { return testPassesNear(g, r, via, radius) },
+		3)); n != 0 {
+		Fatal("Expected filtering 3 routes to find none via the corner, got %d", n)
+	}
+	routes = g.KShortestRoutesVia(0, 2, 1, DistToRad(120.0), via, radius,
+		func(r Route) bool { return true }, 1)
+	if len(routes) != 1 || len(routes[0].Nodes) != 7 ||
+		!testPassesNear(g, routes[0], via, radius) {
+		Fatal("Route via the far corner wrong: %v", routes)
+	}
+	if len(g.RouteLegs(routes[0]).ToLocations()) != len(routes[0].Nodes) {
+		Fatal("Route legs lost locations")
+	}
+	// A ring 30 km round the middle, which routes not through it miss
+	ring := SatelliteRing{Label: "Middle", Centre: locs[4],
+		Radius: DistToRad(30.0), Time: time.Date(2014, 3, 8, 0, 11, 0, 0, time.UTC)}
+	accept, maxtried := g.TimelineAccept(&Timeline{Vmin: 700, Vmax: 900,
+		Rings: []SatelliteRing{ring}}, 4)
+	routes = g.KShortestRoutesVia(0, 8, 4, DistToRad(120.0), Locations{}, 0,
+		accept, maxtried)
+	if len(routes) != 4 {
+		Fatal("Found %d routes crossing the ring, not 4", len(routes))
+	}
+	for i, r := range routes {
+		through := false
+		for _, node := range r.Nodes {
+			through = through || node == 4
+		}
+		if !through || (i > 0 && r.Dist < routes[i-1].Dist) {
+			Fatal("Route %d missing the ring kept: %v", i+1, r)
+		}
+	}
+	if accept(Route{Nodes: []int{0, 1, 2, 5, 8}}) {
+		Fatal("Route round the edge crossed the ring")
+	}
+	// Direct-to legs only to the nearest where locations are dense
+	dense := Locations([]Location{})
+	for i := 0; i < 11; i++ {
+		for j := 0; j < 11; j++ {
+			dense = append(dense, Location{Type: LOCTYPE["Waypoint"].Tag,
+				Lat: 0.01*float64(i), Long: 0.01*float64(j)})
+		}
+	}
+	g = dense.BuildRouteGraph(Airways{}, 100.0, "")
+	for i := range dense {
+		if len(g.Edges[i]) != MAX_DIRECT_EDGES {
+			Fatal("Location %d has %d direct-to legs, not %d", i,
+				len(g.Edges[i]), MAX_DIRECT_EDGES)
+		}
+	}
+	kept := map[int]bool{}
+	longest := 0.0
+	for _, e := range g.Edges[60] {
+		kept[e.To] = true
+		longest = math.Max(longest, e.Dist)
+	}
+	for j := range dense {
+		if j != 60 && !kept[j] && dense[60].ToCartesianVector().AngleWith(
+			dense[j].ToCartesianVector()) < longest - 1e-12 {
+			Fatal("Direct-to leg to %d dropped for a longer one", j)
+		}
+	}
+	Println("K shortest routes match enumeration of %d paths", len(all))
+	return
+}
+
+// Whether the route passes within radius rad of each of the via locations,
+// in the order given.
+func testPassesNear(g *RouteGraph, r Route, via Locations, radius float64) bool {
+	k := 0
+	for _, loc := range via {
+		for ; k < len(r.Nodes)-1; k++ {
+			if SegmentDistance(
+				g.Locs[r.Nodes[k]], g.Locs[r.Nodes[k+1]], loc) <= radius {
+				break
+			}
+		}
+		if k == len(r.Nodes)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Point a fraction f of the way along the great circle from loc1 to loc2.
+func testPointAlong(loc1, loc2 Location, f float64, name string) Location {
+	v1 := loc1.ToCartesianVector()
+	v2 := loc2.ToCartesianVector()
+	a := v1.AngleWith(v2)
+	s1 := math.Sin((1.0-f)*a)/math.Sin(a)
+	s2 := math.Sin(f*a)/math.Sin(a)
+	loc := Vector{
+		s1*v1.X + s2*v2.X, s1*v1.Y + s2*v2.Y, s1*v1.Z + s2*v2.Z,
+	}.ToLocation()
+	loc.Type = "Other"
+	loc.Name = name
+	return loc
+}
+
+func testObservers() {
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "N", Lat: 10, Long: 75}
+	a := testPointAlong(loc1, loc2, 0.25, "A")
+	b := testPointAlong(loc1, loc2, 0.5, "B")
+	c := testPointAlong(loc1, loc2, 0.75, "C")
+	far := Location{Type: "Other", Name: "Far", Lat: 0, Long: 80}
+	// The path runs a little east of north
+	heading := []float64{315.0, 45.0}
+	southbound := []float64{135.0, 225.0}
+	observerHeading := func(loc Location, optional bool, heading []float64) ObserverConstraint {
+		return ObserverConstraint{
+			ObserverSpec:	ObserverSpec{
+				TimedLabel:	TimedLabel{Label: "Name:" + loc.Name},
+				Dmax:		0.5,
+				Heading:	heading,
+				Optional:	optional,
+			},
+			Loc:	loc,
+		}
+	}
+	observer := func(loc Location, optional bool) ObserverConstraint {
+		return observerHeading(loc, optional, heading)
+	}
+	check := func(what string, want bool, minOptional int, obs ...ObserverConstraint) *Flyby {
+		filter := MakeObserversFilter(obs, 4000, 4000, 4000, minOptional, nil, nil)
+		fits, _, fb := filter(loc1, loc2)
+		fits2, _, _ := filter(loc2, loc1)
+		if fits != want || fits2 != want {
+			Fatal("%s: fits %v and reversed %v, expected %v",
+				what, fits, fits2, want)
+		}
+		return fb
+	}
+	fb := check("In order", true, 0,
+		observer(a, false), observer(b, false), observer(c, false))
+	if len(fb.Observers) != 3 ||
+		math.Abs(RadToDist(fb.Observers[1].AlongTrack) -
+			RadToDist(fb.Ang12)/2.0) > 0.01 ||
+		RadToDist(fb.Observers[2].Nearest) > 0.001 {
+		Fatal("Observer fixes wrong: %#v", fb.Observers)
+	}
+	check("Reverse order", false, 0,
+		observer(c, false), observer(b, false), observer(a, false))
+	fb = check("Reverse order flying south", true, 0,
+		observerHeading(c, false, southbound),
+		observerHeading(b, false, southbound),
+		observerHeading(a, false, southbound))
+	if fb.Loc1 != loc2 || math.Abs(RadToDist(fb.Observers[2].AlongTrack) -
+		0.75*RadToDist(fb.Ang12)) > 0.01 {
+		Fatal("Southbound flyby wrong: %v", fb)
+	}
+	check("Seen flying both ways", false, 0,
+		observer(a, false), observerHeading(c, false, southbound))
+	check("Out of order", false, 0,
+		observer(a, false), observer(c, false), observer(b, false))
+	fb = check("Optional missed", true, 0,
+		observer(a, false), observer(far, true), observer(c, false))
+	if fb.Observers[1].Fits || !fb.Observers[2].Fits {
+		Fatal("Optional observer wrongly fitted: %#v", fb.Observers)
+	}
+	check("Too few optional", false, 2,
+		observer(a, false), observer(far, true), observer(c, true))
+	check("Enough optional", true, 1,
+		observer(a, false), observer(b, true), observer(far, true))
+	check("Required missed", false, 0, observer(a, false), observer(far, false))
+	// The required observers choose the way, and an optional one seen flying
+	// the other way does not fit, rather than ruling out the path
+	fb = check("Optional seen flying the other way", true, 0,
+		observer(a, false), observerHeading(b, true, southbound),
+		observer(c, false))
+	if fb.Loc1 != loc1 || fb.Observers[1].Fits {
+		Fatal("Optional observer the other way wrongly fitted: %v", fb)
+	}
+	fb = check("Optional alone flying south", true, 0,
+		observerHeading(b, true, southbound), observer(far, true))
+	if fb.Loc1 != loc2 || !fb.Observers[0].Fits {
+		Fatal("Southbound optional observer not fitted: %v", fb)
+	}
+	// Either way fits, and the way given is taken
+	both := []float64{0.0, 360.0}
+	filter := MakeObserversFilter([]ObserverConstraint{observerHeading(c, false, both),
+		observerHeading(b, true, both)}, 4000, 4000, 4000, 0, nil, nil)
+	if _, _, fb = filter(loc2, loc1); fb == nil || fb.Loc1 != loc2 ||
+		!fb.Observers[1].Fits {
+		Fatal("Way given not taken: %v", fb)
+	}
+	// One observer gives the same as the single nearest approach filter
+	single := MakeNearestApproachFilter(b, 4000, 4000, 4000, 0.5, heading)
+	_, _, fb1 := single(loc1, loc2)
+	fb = check("Single", true, 0, observer(b, false))
+	if fb.Nearest != fb1.Nearest || fb.Heading != fb1.Heading {
+		Fatal("Single observer differs: %v vs %v", fb, fb1)
+	}
+	Println("Multiple observer filter correct")
+	return
+}
+
+func testTimeline() {
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "N", Lat: 10, Long: 75}
+	a := testPointAlong(loc1, loc2, 0.25, "A")
+	c := testPointAlong(loc1, loc2, 0.75, "C")
+	dist := RadToDist(a.ToCartesianVector().AngleWith(c.ToCartesianVector()))
+	ta := time.Date(2014, 3, 8, 1, 0, 0, 0, time.UTC)
+	// At 800 km/h from A to C
+	tc := ta.Add(time.Duration(dist/800.0*float64(time.Hour)))
+	northbound := []float64{315.0, 45.0}
+	southbound := []float64{135.0, 225.0}
+	observerHeading := func(loc Location, t time.Time, tol float64, heading []float64) ObserverConstraint {
+		stamp := ""
+		if !t.IsZero() {
+			stamp = t.Format(time.RFC3339)
+		}
+		return ObserverConstraint{
+			ObserverSpec:	ObserverSpec{
+				TimedLabel:	TimedLabel{
+					Label:		"Name:" + loc.Name,
+					Time:		stamp,
+					Tolerance:	tol,
+				},
+				Dmax:		0.5,
+				Heading:	heading,
+			},
+			Loc:	loc,
+		}
+	}
+	observer := func(loc Location, t time.Time, tol float64) ObserverConstraint {
+		return observerHeading(loc, t, tol, northbound)
+	}
+	check := func(what string, want bool, tl *Timeline, obs ...ObserverConstraint) {
+		filter := MakeObserversFilter(obs, 4000, 4000, 4000, 0, tl, nil)
+		fits, _, _ := filter(loc1, loc2)
+		fits2, _, _ := filter(loc2, loc1)
+		if fits != want || fits2 != want {
+			Fatal("%s: fits %v and reversed %v, expected %v",
+				what, fits, fits2, want)
+		}
+		return
+	}
+	check("In speed range", true, &Timeline{Vmin: 700, Vmax: 900},
+		observer(a, ta, 0), observer(c, tc, 0))
+	check("Flown the other way", true, &Timeline{Vmin: 700, Vmax: 900},
+		observerHeading(c, ta, 0, southbound),
+		observerHeading(a, tc, 0, southbound))
+	check("Times against the heading", false, &Timeline{Vmin: 700, Vmax: 900},
+		observer(a, tc, 0), observer(c, ta, 0))
+	check("Too slow", false, &Timeline{Vmin: 850, Vmax: 900},
+		observer(a, ta, 0), observer(c, tc, 0))
+	check("Too fast", false, &Timeline{Vmin: 300, Vmax: 750},
+		observer(a, ta, 0), observer(c, tc, 0))
+	// 800 km/h takes about 5 minutes longer than 850 km/h over the distance
+	check("Within tolerance", true, &Timeline{Vmin: 850, Vmax: 900},
+		observer(a, ta, 0), observer(c, tc, 10))
+	// The departure S is half the distance from A, so 900 km/h takes over
+	// half an hour to get there.
+	dep := func(before time.Duration) *Timeline {
+		return &Timeline{
+			Vmin:	700,
+			Vmax:	900,
+			Departure:	&TimedEvent{Label: "Name:S", Time: ta.Add(-before)},
+			DepartureLoc:	loc1,
+		}
+	}
+	check("Departure in time", true, dep(time.Hour),
+		observer(a, ta, 0), observer(c, tc, 0))
+	check("Departure too late", false, dep(30*time.Minute),
+		observer(a, ta, 0), observer(c, tc, 0))
+	check("No times", true, &Timeline{Vmin: 850, Vmax: 900},
+		observer(a, time.Time{}, 0), observer(c, time.Time{}, 0))
+	Println("Timeline checks correct")
+	return
+}
+
+func testRing() {
+	// Geostationary, as for Inmarsat 3F1
+	alt := 35786.0
+	r := EARTH_RAD + alt
+	for _, elev := range []float64{0.0, 10.0, 40.0, 89.0} {
+		theta := RingRadiusFromElevation(alt, elev)
+		slant := math.Sqrt(EARTH_RAD*EARTH_RAD + r*r -
+			2.0*EARTH_RAD*r*math.Cos(theta))
+		if math.Abs(RingRadiusFromRange(alt, slant) - theta) > 1e-9 {
+			Fatal("Ring radius for elevation %g deg differs from range %g km",
+				elev, slant)
+		}
+	}
+	if math.Abs(RingRadiusFromElevation(alt, 0.0) -
+		math.Acos(EARTH_RAD/r)) > 1e-12 ||
+		RingRadiusFromElevation(alt, 90.0) > 1e-12 {
+		Fatal("Ring radius wrong at the horizon or overhead")
+	}
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "N", Lat: 10, Long: 75}
+	length := Leg{Loc1: loc1, Loc2: loc2}.Length()
+	// Far enough south that each ring crosses the path once
+	sat := Location{Lat: -30.0, Long: 64.5}
+	ringAt := func(f float64, t time.Time) SatelliteRing {
+		p := testPointAlong(loc1, loc2, f, "P")
+		return SatelliteRing{
+			Label:	fmt.Sprintf("Ring %g", f),
+			Centre:	sat,
+			Radius:	sat.ToCartesianVector().AngleWith(p.ToCartesianVector()),
+			Time:	t,
+		}
+	}
+	near := func(xs []float64, x float64) bool {
+		for _, x2 := range xs {
+			if math.Abs(x2 - x) < 1e-9 {
+				return true
+			}
+		}
+		return false
+	}
+	t0 := time.Date(2014, 3, 8, 0, 11, 0, 0, time.UTC)
+	ring := ringAt(0.3, t0)
+	if !near(ring.Crossings(loc1, loc2), 0.3*length) {
+		Fatal("Crossings %v do not include %g", ring.Crossings(loc1, loc2),
+			0.3*length)
+	}
+	mid := testPointAlong(loc1, loc2, 0.5, "M")
+	legs := Locations{loc1, mid, loc2}.ToLegs()
+	if !near(ring.LegCrossings(GREAT_CIRCLE_PATH, legs), 0.3*length) ||
+		!near(ringAt(0.7, t0).LegCrossings(GREAT_CIRCLE_PATH, legs),
+		0.7*length) {
+		Fatal("Leg crossings wrong")
+	}
+	// At 800 km/h between rings
+	t1 := t0.Add(time.Duration(RadToDist(0.4*length)/800.0*float64(time.Hour)))
+	gc := GreatCircle{Loc1: loc1, Loc2: loc2}
+	for _, c := range []struct{
+		what	string
+		want	bool
+		vmin	float64
+		vmax	float64
+		rings	[]SatelliteRing
+	}{
+		{"In speed range", true, 700, 900,
+			[]SatelliteRing{ringAt(0.3, t0), ringAt(0.7, t1)}},
+		{"Against the direction of travel", false, 700, 900,
+			[]SatelliteRing{ringAt(0.3, t1), ringAt(0.7, t0)}},
+		{"Too slow", false, 850, 900,
+			[]SatelliteRing{ringAt(0.3, t0), ringAt(0.7, t1)}},
+		{"Ring not crossed", false, 700, 900,
+			[]SatelliteRing{ringAt(0.3, t0), {Centre: sat, Radius: 0.01, Time: t1}}},
+	} {
+		tl := Timeline{Vmin: c.vmin, Vmax: c.vmax, Rings: c.rings}
+		if tl.Fits(gc, nil) != c.want {
+			Fatal("%s: expected fit %v", c.what, c.want)
+		}
+	}
+	// Flown the other way
+	tl := Timeline{Vmin: 700, Vmax: 900,
+		Rings: []SatelliteRing{ringAt(0.3, t1), ringAt(0.7, t0)}}
+	if !tl.Fits(GreatCircle{Loc1: loc2, Loc2: loc1}, nil) {
+		Fatal("Rings not crossed flying the other way")
+	}
+	// A route has a direction
+	if tl.FitsRoute(legs, nil) {
+		Fatal("Route fitted rings crossed in the wrong order")
+	}
+	tl.Rings = []SatelliteRing{ringAt(0.3, t0), ringAt(0.7, t1)}
+	if !tl.FitsRoute(legs, nil) {
+		Fatal("Route did not fit rings")
+	}
+	Println("Satellite ring crossings correct")
+	return
+}
+
+// Degrees, minutes and seconds, negative if deg is.
+func testDMS(deg, min, sec float64) float64 {
+	if deg < 0 {
+		return deg - min/60.0 - sec/3600.0
+	}
+	return deg + min/60.0 + sec/3600.0
+}
+
+func testGeodesy() {
+	// Vincenty's example from Flinders Peak to Buninyong, as published by
+	// Geoscience Australia
+	flinders := Location{Lat: testDMS(-37, 57, 3.72030), Long: testDMS(144, 25, 29.52440)}
+	buninyong := Location{Lat: testDMS(-37, 39, 10.15610), Long: testDMS(143, 55, 35.38390)}
+	dist, az1, az2 := WGS84.Inverse(flinders, buninyong)
+	// The published reverse azimuth is 127 10 25.07, back to Flinders Peak
+	if math.Abs(dist - 54.972271) > 1e-6 ||
+		math.Abs(az1 - testDMS(306, 52, 5.37)) > 0.01/3600.0 ||
+		math.Abs(az2 - testDMS(307, 10, 25.07)) > 0.01/3600.0 {
+		Fatal("Inverse gave %.6f km, azimuths %.6f %.6f", dist, az1, az2)
+	}
+	loc, az := WGS84.Direct(flinders, testDMS(306, 52, 5.37), 54.972271)
+	if math.Abs(loc.Lat - buninyong.Lat) > 1e-4/3600.0 ||
+		math.Abs(loc.Long - buninyong.Long) > 1e-4/3600.0 ||
+		math.Abs(az - az2) > 0.01/3600.0 {
+		Fatal("Direct gave %v, azimuth %.6f", loc, az)
+	}
+	// Vincenty's test lines (a) to (e), Survey Review 23(176), 1975, on the
+	// Bessel and International ellipsoids, (d) and (e) nearly antipodal.
+	// Then a line along the equator, its length exactly a quarter of the
+	// equator, and the WGS84 quarter meridian.  Azimuths
+	// are good to about a thousandth of a second nearly antipodal.
+	bessel := Ellipsoid{Label: "bessel", A: 6377.397155, F: 1.0/299.1528128}
+	intl := Ellipsoid{Label: "international", A: 6378.388, F: 1.0/297.0}
+	for _, v := range []struct {
+		el				Ellipsoid
+		lat1, lat2, dlong, dist, az1, az2	float64 // deg, km
+	}{
+		{bessel, testDMS(55, 45, 0), -testDMS(33, 26, 0), testDMS(108, 13, 0),
+			14110.526170, testDMS(96, 36, 8.79960), testDMS(137, 52, 22.01454)},
+		{intl, testDMS(37, 19, 54.95367), testDMS(26, 7, 42.83946),
+			testDMS(41, 28, 35.50729), 4085.966703, testDMS(95, 27, 59.63089),
+			testDMS(118, 5, 58.96161)},
+		{intl, testDMS(35, 16, 11.24862), testDMS(67, 22, 14.77638),
+			testDMS(137, 47, 28.31435), 8084.823839, testDMS(15, 44, 23.74850),
+			testDMS(144, 55, 39.92147)},
+		{intl, testDMS(1, 0, 0), -testDMS(0, 59, 53.83076),
+			testDMS(179, 17, 48.02997), 19960.0, testDMS(89, 0, 0),
+			testDMS(91, 0, 6.11733)},
+		{intl, testDMS(1, 0, 0), testDMS(1, 1, 15.18952),
+			testDMS(179, 46, 17.84244), 19780.006558, testDMS(4, 59, 59.99995),
+			testDMS(174, 59, 59.88481)},
+		{WGS84.(Ellipsoid), 0.0, 0.0, 90.0, 6378.137*math.Pi/2.0, 90.0, 90.0},
+		{WGS84.(Ellipsoid), 0.0, 90.0, 0.0, 10001.965729, 0.0, 0.0},
+	} {
+		loc1 := Location{Lat: v.lat1, Long: 0.0}
+		loc2 := Location{Lat: v.lat2, Long: v.dlong}
+		dist, az1, az2 := v.el.Inverse(loc1, loc2)
+		if math.Abs(dist - v.dist) > 1e-6 ||
+			math.Abs(math.Remainder(az1 - v.az1, 360.0)) > 5e-3/3600.0 ||
+			math.Abs(math.Remainder(az2 - v.az2, 360.0)) > 5e-3/3600.0 {
+			Fatal("%s inverse from %v to %v gave %.6f km, azimuths %.8f " +
+				"%.8f, expected %.6f km, %.8f %.8f", v.el.Name(), loc1, loc2,
+				dist, az1, az2, v.dist, v.az1, v.az2)
+		}
+		loc, az := v.el.Direct(loc1, v.az1, v.dist)
+		if math.Abs(loc.Lat - v.lat2) > 1e-4/3600.0 ||
+			math.Abs(math.Remainder(loc.Long - v.dlong, 360.0)) > 1e-4/3600.0 ||
+			math.Abs(math.Remainder(az - v.az2, 360.0)) > 5e-3/3600.0 {
+			Fatal("%s direct from %v at %.8f for %.6f km gave %v, azimuth " +
+				"%.8f", v.el.Name(), loc1, v.az1, v.dist, loc, az)
+		}
+	}
+	// Round trips, both models, long and short
+	rnd := rand.New(rand.NewSource(3))
+	for _, geo := range []Geodesy{SPHERE, WGS84} {
+		for i := 0; i < 1000; i++ {
+			loc1 := Location{Lat: rnd.Float64()*170.0 - 85.0,
+				Long: rnd.Float64()*360.0 - 180.0}
+			az1 := rnd.Float64()*360.0
+			d := math.Pow(10.0, rnd.Float64()*4.0) // 1 to 10000 km
+			loc2, az2 := geo.Direct(loc1, az1, d)
+			d2, az1b, az2b := geo.Inverse(loc1, loc2)
+			daz1 := math.Abs(math.Remainder(az1b - az1, 360.0))
+			daz2 := math.Abs(math.Remainder(az2b - az2, 360.0))
+			if math.Abs(d2 - d) > 1e-6 || daz1 > 1e-6 || daz2 > 1e-6 {
+				Fatal("%s round trip from %v at %g for %g km: %g km, %g, %g",
+					geo.Name(), loc1, az1, d, d2, az1b, az2b)
+			}
+			sd, _, _ := SPHERE.Inverse(loc1, loc2)
+			if geo == WGS84 && math.Abs(sd - d)/d > GEODESIC_MARGIN {
+				Fatal("Sphere and ellipsoid differ by more than the margin: " +
+					"%g and %g km", sd, d)
+			}
+		}
+	}
+	// Nearest approach on the ellipsoid agrees roughly with the sphere
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "N", Lat: 10, Long: 75}
+	d12, az12, _ := WGS84.Inverse(loc1, loc2)
+	on, _ := WGS84.Direct(loc1, az12, d12/3.0)
+	heading := []float64{315.0, 45.0}
+	fits, _, fb := MakeGeodesicApproachFilter(WGS84, on,
+		4000, 4000, 4000, 0.01, heading)(loc1, loc2)
+	if !fits || RadToDist(fb.Nearest) > 1e-3 ||
+		math.Abs(RadToDist(fb.AlongTrack) - d12/3.0) > 1e-3 {
+		Fatal("Geodesic filter missed a point on the geodesic: %v %v", fits, fb)
+	}
+	_, _, fbs := MakeGeodesicApproachFilter(SPHERE, on,
+		4000, 4000, 4000, 10.0, heading)(loc1, loc2)
+	if math.Abs(RadToDeg(fb.Heading - fbs.Heading)) > 0.5 ||
+		math.Abs(RadToDeg(fb.B - fbs.B)) > 0.5 ||
+		math.Abs(RadToDeg(fb.C - fbs.C)) > 0.5 ||
+		math.Abs(fb.Ang12 - fbs.Ang12)/fbs.Ang12 > GEODESIC_MARGIN ||
+		math.Abs(fb.Ang13 - fbs.Ang13)/fbs.Ang13 > GEODESIC_MARGIN {
+		Fatal("Ellipsoid and sphere differ: %v and %v", fb, fbs)
+	}
+	// Given the other way round, the same flyby, flown the same way
+	_, _, fbr := MakeGeodesicApproachFilter(WGS84, on,
+		4000, 4000, 4000, 0.01, heading)(loc2, loc1)
+	same := func(x, y float64) bool { return math.Abs(x - y) < 1e-9 }
+	if fbr == nil || fbr.Loc1 != loc1 || !same(fbr.B, fb.B) ||
+		!same(fbr.C, fb.C) || !same(fbr.Ang13, fb.Ang13) ||
+		!same(fbr.Ang23, fb.Ang23) || !same(fbr.Nearest, fb.Nearest) ||
+		!same(fbr.AlongTrack, fb.AlongTrack) {
+		Fatal("Flyby given the other way differs: %v and %v", fbr, fb)
+	}
+	// bmax limits the distance from the start in the direction of travel,
+	// and cmax from the end, on either model, whichever way round the pair
+	// is given
+	southbound := []float64{normalizeAzimuth(heading[0] + 180.0),
+		normalizeAzimuth(heading[1] + 180.0)}
+	for _, geo := range []Geodesy{SPHERE, WGS84} {
+		for _, tc := range []struct {
+			bmax, cmax	float64
+			heading		[]float64
+			want		bool
+		}{
+			{d12/2.0, 4000, heading, true},
+			{4000, d12/2.0, heading, false},
+			{d12/2.0, 4000, southbound, false},
+			{4000, d12/2.0, southbound, true},
+		} {
+			filter := MakeGeodesicApproachFilter(geo, on, 4000, tc.bmax,
+				tc.cmax, 10.0, tc.heading)
+			fits1, _, _ := filter(loc1, loc2)
+			fits2, _, _ := filter(loc2, loc1)
+			if fits1 != tc.want || fits2 != tc.want {
+				Fatal("%s applied bmax %.0f and cmax %.0f wrongly flying %v: " +
+					"%v %v", geo.Name(), tc.bmax, tc.cmax, tc.heading, fits1,
+					fits2)
+			}
+		}
+	}
+	// Nearby search on the ellipsoid finds what a scan does
+	geodesy = WGS84
+	locs := randomLocations(2000, 4)
+	center := Location{Lat: 0.0, Long: 180.0}
+	nbs := locs.WithinRadius(center, 500.0)
+	n := 0
+	for _, loc := range locs {
+		if d, _, _ := WGS84.Inverse(center, loc); d <= 500.0 {
+			n++
+		}
+	}
+	geodesy = SPHERE
+	if len(nbs) != n || n == 0 {
+		Fatal("WithinRadius found %d on the ellipsoid, scan %d", len(nbs), n)
+	}
+	Println("Geodesy models correct")
+	return
+}
+
+// Values from the examples at movable-type.co.uk/scripts/latlong.html, for a
+// sphere of radius 6371 km.
+func testNavigate() {
+	near := func(what string, got, want, tol float64) {
+		if math.Abs(got - want) > tol {
+			Fatal("%s is %.6f, expected %.6f", what, got, want)
+		}
+	}
+	nearLoc := func(what string, got, want Location, tol float64) {
+		near(what + " lat", got.Lat, want.Lat, tol)
+		near(what + " long", got.Long, want.Long, tol)
+	}
+	// Land's End to John o' Groats
+	le := Location{Lat: testDMS(50, 3, 59), Long: testDMS(-5, 42, 53)}
+	jog := Location{Lat: testDMS(58, 38, 38), Long: testDMS(-3, 4, 12)}
+	dist, _, _ := SPHERE.Inverse(le, jog)
+	near("Distance", dist, 968.9, 0.05)
+	near("Initial bearing", le.BearingTo(jog), testDMS(9, 7, 11), 1.0/3600.0)
+	near("Final bearing", le.FinalBearingTo(jog), testDMS(11, 16, 31), 1.0/3600.0)
+	nearLoc("Midpoint", le.MidpointTo(jog),
+		Location{Lat: testDMS(54, 21, 44), Long: testDMS(-4, 31, 50)}, 1.0/3600.0)
+	nearLoc("Intermediate at 0", le.IntermediateTo(jog, 0.0), le, 1e-9)
+	nearLoc("Intermediate at 1", le.IntermediateTo(jog, 1.0), jog, 1e-9)
+	// Destination
+	start := Location{Lat: testDMS(53, 19, 14), Long: testDMS(-1, 43, 47)}
+	dest := start.Destination(testDMS(96, 1, 18), 124.8)
+	nearLoc("Destination", dest,
+		Location{Lat: testDMS(53, 11, 18), Long: testDMS(0, 8, 0)}, 1.0/3600.0)
+	near("Final bearing at destination", start.FinalBearingTo(dest),
+		testDMS(97, 30, 52), 1.0/3600.0)
+	// Cross and along track distance
+	gc := GreatCircle{
+		Loc1:	Location{Lat: 53.3206, Long: -1.7297},
+		Loc2:	Location{Lat: 53.1887, Long: 0.1334},
+	}
+	loc3 := Location{Lat: 53.2611, Long: -0.7972}
+	near("Cross-track", gc.CrossTrack(loc3), -0.3076, 0.0005)
+	near("Along-track", gc.AlongTrack(loc3), 62.331, 0.001)
+	// Intersection of paths from Stansted and Charles de Gaulle
+	x, ok := Intersection(Location{Lat: 51.8853, Long: 0.2545}, 108.547,
+		Location{Lat: 49.0034, Long: 2.5735}, 32.435)
+	if !ok {
+		Fatal("No intersection")
+	}
+	nearLoc("Intersection", x, Location{Lat: 50.9078, Long: 4.5084}, 0.0001)
+	if _, ok := Intersection(le, le.BearingTo(jog), jog,
+		le.FinalBearingTo(jog)); ok {
+		Fatal("Intersection found for a single great circle")
+	}
+	Println("Navigation functions correct")
+	return
+}
+
+func testRhumb() {
+	near := func(what string, got, want, tol float64) {
+		if math.Abs(got - want) > tol {
+			Fatal("%s is %.6f, expected %.6f", what, got, want)
+		}
+	}
+	// Examples from movable-type.co.uk/scripts/latlong.html
+	plymouth := Location{Lat: testDMS(50, 21, 59), Long: testDMS(-4, 8, 2)}
+	boston := Location{Lat: testDMS(42, 21, 4), Long: testDMS(-71, 2, 27)}
+	near("Rhumb distance", RhumbDistance(plymouth, boston), 5198.0, 0.5)
+	near("Rhumb bearing", RhumbBearing(plymouth, boston), testDMS(260, 7, 38),
+		1.0/3600.0)
+	dover := Location{Lat: testDMS(51, 7, 32), Long: testDMS(1, 20, 17)}
+	dest := RhumbDestination(dover, testDMS(116, 38, 10), 40.23)
+	near("Rhumb destination lat", dest.Lat, testDMS(50, 57, 48), 1.0/3600.0)
+	near("Rhumb destination long", dest.Long, testDMS(1, 51, 9), 1.0/3600.0)
+	// Across the antimeridian, the short way
+	w := Location{Lat: 10.0, Long: 179.0}
+	e := Location{Lat: 10.0, Long: -179.0}
+	near("East-west bearing", RhumbBearing(w, e), 90.0, 1e-9)
+	near("East-west distance", RhumbDistance(w, e),
+		RadToDist(DegToRad(2.0))*math.Cos(DegToRad(10.0)), 1e-6)
+	// A point on a rhumb line fits it, but not the great circle
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: 40, Long: 10}
+	loc2 := RhumbDestination(loc1, 60.0, 2000.0)
+	loc2.Type, loc2.Name = LOCTYPE["Waypoint"].Tag, "N"
+	on := RhumbDestination(loc1, 60.0, 800.0)
+	heading := []float64{0.0, 90.0}
+	fits, _, fb := RHUMB_PATH.ApproachFilter(on, 4000, 4000, 4000, 0.5,
+		heading)(loc2, loc1)
+	if !fits || RadToDist(fb.Nearest) > 1e-3 ||
+		math.Abs(RadToDeg(fb.Heading) - 60.0) > 1e-9 ||
+		math.Abs(RadToDist(fb.AlongTrack) - 800.0) > 1e-3 {
+		Fatal("Rhumb filter missed a point on the line: %v %v", fits, fb)
+	}
+	// Angles at the ends are between the rhumb line and the great circles
+	// to the point, which turn off it
+	if fb.C < DegToRad(1.0) || fb.B < DegToRad(1.0) ||
+		math.Abs(RadToDeg(fb.C) - CourseDifference(60.0,
+			loc1.BearingTo(on))) > 1e-9 ||
+		math.Abs(RadToDeg(fb.B) - CourseDifference(240.0,
+			loc2.BearingTo(on))) > 1e-9 {
+		Fatal("Rhumb flyby angles wrong: %v", fb)
+	}
+	// Rings crossed 1000 km apart along the rhumb line, at 800 km/h
+	sat := Location{Lat: 0.0, Long: 40.0}
+	t0 := time.Date(2014, 3, 8, 0, 11, 0, 0, time.UTC)
+	ringAt := func(s float64, t time.Time) SatelliteRing {
+		return SatelliteRing{Label: fmt.Sprintf("Ring %g", s), Centre: sat,
+			Radius: sat.ToCartesianVector().AngleWith(
+				RhumbDestination(loc1, 60.0, s).ToCartesianVector()),
+			Time: t}
+	}
+	rings := []SatelliteRing{ringAt(500.0, t0),
+		ringAt(1500.0, t0.Add(time.Duration(1000.0/800.0*float64(time.Hour))))}
+	crossed := false
+	for _, x := range RHUMB_PATH.RingCrossings(rings[0], loc1, loc2) {
+		crossed = crossed || math.Abs(RadToDist(x) - 500.0) < 1e-6
+	}
+	if !crossed {
+		Fatal("Rhumb line crossings of the ring %v miss 500 km",
+			RHUMB_PATH.RingCrossings(rings[0], loc1, loc2))
+	}
+	gc := GreatCircle{Loc1: loc1, Loc2: loc2}
+	if !(Timeline{Vmin: 790, Vmax: 810, Rings: rings, Path: RHUMB_PATH}).Fits(
+		gc, nil) || (Timeline{Vmin: 850, Vmax: 900, Rings: rings,
+		Path: RHUMB_PATH}).Fits(gc, nil) {
+		Fatal("Rhumb timeline wrong")
+	}
+	if fits, _, _ := GREAT_CIRCLE_PATH.ApproachFilter(on, 4000, 4000, 4000,
+		0.5, heading)(loc1, loc2); fits {
+		Fatal("Great circle filter fitted a point on the rhumb line")
+	}
+	// Off to one side
+	off := Location{Lat: on.Lat, Long: on.Long}.Destination(150.0, 5.0)
+	_, d := RhumbNearest(loc1, loc2, off)
+	near("Nearest approach", d, 5.0, 0.01)
+	if fits, _, _ := RHUMB_PATH.ApproachFilter(on, 4000, 4000, 4000, 0.5,
+		[]float64{270.0, 359.0})(loc1, loc2); fits {
+		Fatal("Rhumb filter fitted the wrong heading")
+	}
+	// The filter agrees with a search along every line, so its cheap bound
+	// rules out only pairs that do not fit
+	rnd := rand.New(rand.NewSource(5))
+	filter := RHUMB_PATH.ApproachFilter(on, 4000, 4000, 4000, 50.0,
+		[]float64{0.0, 360.0})
+	nfits := 0
+	for i := 0; i < 500; i++ {
+		p1 := Location{Lat: on.Lat + rnd.Float64()*20.0 - 10.0,
+			Long: on.Long + rnd.Float64()*20.0 - 10.0}
+		p2 := Location{Lat: on.Lat + rnd.Float64()*20.0 - 10.0,
+			Long: on.Long + rnd.Float64()*20.0 - 10.0}
+		s, d := RhumbNearest(p1, p2, on)
+		want := d <= 50.0 && s > 1e-5 && s < RhumbDistance(p1, p2) - 1e-5
+		if fits, _, _ := filter(p1, p2); fits != want {
+			Fatal("Rhumb filter gave %v for %v to %v, %.3f km away", fits, p1,
+				p2, d)
+		}
+		if want {
+			nfits++
+		}
+	}
+	if nfits == 0 {
+		Fatal("No random rhumb lines passed near enough to test")
+	}
+	Println("Rhumb lines correct")
+	return
+}
+
+func testDeadReckon() {
+	origin := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "O", Lat: 4.0, Long: 73.0}
+	wp := func(name string, loc Location) Location {
+		loc.Type = LOCTYPE["Waypoint"].Tag
+		loc.Name = name
+		return loc
+	}
+	for _, pm := range []PathModel{GREAT_CIRCLE_PATH, RHUMB_PATH} {
+		pathModel = pm
+		dest := origin.Destination
+		if pm == RHUMB_PATH {
+			dest = func(bearing, dist float64) Location {
+				return RhumbDestination(origin, bearing, dist)
+			}
+		}
+		locs := Locations{
+			origin,
+			wp("AHEAD", dest(150.0, 500.0)),
+			wp("BEHIND", dest(330.0, 800.0)),
+			wp("SIDE", dest(150.0, 300.0).Destination(240.0, 5.0)),
+			wp("WIDE", dest(150.0, 300.0).Destination(60.0, 50.0)),
+			wp("FAR", dest(150.0, 2500.0)),
+			wp("OTHER", dest(60.0, 500.0)),
+		}
+		other := locs[6]
+		other.Type = "Other"
+		locs[6] = other
+		names := func(hits TrackHits) string {
+			result := []string{}
+			for _, hit := range hits {
+				result = append(result, hit.Name)
+			}
+			return fmt.Sprint(result)
+		}
+		hits := locs.DeadReckon(origin, 150.0, 150.0, 2000.0, 10.0)
+		if names(hits) != "[BEHIND SIDE AHEAD]" {
+			Fatal("%s track passed %v", pm.Name(), hits)
+		}
+		// SIDE is to the right
+		if math.Abs(hits[0].Along + 800.0) > 0.01 ||
+			math.Abs(hits[2].Along - 500.0) > 0.01 ||
+			math.Abs(hits[1].Cross - 5.0) > 0.05 {
+			Fatal("%s track hits wrong: %v", pm.Name(), hits)
+		}
+		// Turning 10 deg either way takes in WIDE, but never the others
+		hits = locs.DeadReckon(origin, 140.0, 160.0, 2000.0, 10.0)
+		if names(hits) != "[BEHIND SIDE WIDE AHEAD]" ||
+			math.Abs(hits[3].Heading - 150.0) > 1e-9 {
+			Fatal("%s tracks passed %v", pm.Name(), hits)
+		}
+		// A location on the track at a heading between the steps tried is
+		// still found, on that heading
+		between := Locations{origin, wp("BETWEEN", dest(150.5, 1800.0))}
+		hits = between.DeadReckon(origin, 140.0, 160.0, 2000.0, 10.0)
+		if len(hits) != 1 || math.Abs(hits[0].Heading - 150.5) > 1e-4 ||
+			math.Abs(hits[0].Cross) > 0.01 {
+			Fatal("%s tracks passed %v", pm.Name(), hits)
+		}
+		// Out of range, the nearest end of it is taken
+		hits = between.DeadReckon(origin, 151.0, 160.0, 2000.0, 20.0)
+		if len(hits) != 1 || math.Abs(hits[0].Heading - 151.0) > 1e-4 {
+			Fatal("%s tracks passed %v", pm.Name(), hits)
+		}
+	}
+	pathModel = GREAT_CIRCLE_PATH
+	if len(headingRange(350.0, 10.0)) != 21 || len(headingRange(0, 360)) != 361 {
+		Fatal("Heading ranges wrong")
+	}
+	Println("Dead reckoning correct")
+	return
+}
+
+func testScore() {
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Airport"].Tag, Kind: "large_airport",
+		Name: "N", Lat: 10, Long: 75}
+	mid := loc1.MidpointTo(loc2)
+	off := mid.Destination(mid.BearingTo(loc2) + 90.0, 0.6)
+	off.Type, off.Name = "Other", "Off"
+	observer := func(loc Location, heading []float64) []ObserverConstraint {
+		return []ObserverConstraint{{
+			ObserverSpec:	ObserverSpec{
+				TimedLabel:	TimedLabel{Label: "Name:" + loc.Name},
+				Dmax:		0.5,
+				Heading:	heading,
+			},
+			Loc:	loc,
+		}}
+	}
+	wide := []float64{315.0, 45.0}
+	if fits, _, _ := MakeObserversFilter(observer(off, wide),
+		4000, 4000, 4000, 0, nil, nil)(loc1, loc2); fits {
+		Fatal("Hard cutoff fitted a path 600 m off")
+	}
+	spec := &ScoringSpec{Dsigma: 0.2, Hsigma: 2.0}
+	fits, _, fb := MakeObserversFilter(observer(off, wide),
+		4000, 4000, 4000, 0, nil, spec)(loc1, loc2)
+	if !fits || len(fb.Factors) != 2 ||
+		math.Abs(fb.Factors[0].Value - math.Exp(-0.5*0.25)) > 0.01 ||
+		fb.Factors[1].Value != 1.0 || fb.Score != fb.Factors[0].Value {
+		Fatal("Distance scored wrongly: %v %v", fits, fb)
+	}
+	// Heading 2 deg, one sigma, beyond the range
+	h := RadToDeg(fb.Heading)
+	_, _, fb2 := MakeObserversFilter(observer(off, []float64{h + 2.0, h + 10.0}),
+		4000, 4000, 4000, 0, nil, spec)(loc1, loc2)
+	if fb2 == nil || math.Abs(fb2.Factors[1].Value - math.Exp(-0.5)) > 0.001 {
+		Fatal("Heading scored wrongly: %v", fb2)
+	}
+	// Too far off heading to be searched for
+	if fits, _, _ := MakeObserversFilter(observer(off, []float64{h + 7.0, h + 10.0}),
+		4000, 4000, 4000, 0, nil, spec)(loc1, loc2); fits {
+		Fatal("Scoring fitted a heading more than 3 sigma off")
+	}
+	// Priors by kind, else type
+	spec.Priors = map[string]float64{"large_airport": 2.0, "Waypoint": 0.5, "Airport": 0.1}
+	_, _, fb3 := MakeObserversFilter(observer(off, wide),
+		4000, 4000, 4000, 0, nil, spec)(loc1, loc2)
+	if fb3 == nil || len(fb3.Factors) != 4 ||
+		math.Abs(fb3.Score - fb.Score) > 1e-12 {
+		Fatal("Priors scored wrongly: %v", fb3)
+	}
+	spec.Minscore = 0.9
+	if fits, _, _ := MakeObserversFilter(observer(off, wide),
+		4000, 4000, 4000, 0, nil, spec)(loc1, loc2); fits {
+		Fatal("Score below minscore kept")
+	}
+	flybys := []Flyby{*fb2, *fb3, *fb}
+	RankFlybys(flybys)
+	if flybys[0].Score < flybys[1].Score || flybys[1].Score < flybys[2].Score {
+		Fatal("Flybys not ranked")
+	}
+	// An optional observer that does not fit keeps its named columns, empty,
+	// and the results have a header with a name for every column
+	far := off.Destination(mid.BearingTo(loc2) + 90.0, 100.0)
+	far.Name = "Far"
+	obs := append(observer(off, wide), observer(far, wide)...)
+	obs[1].Optional = true
+	spec.Minscore = 0
+	_, _, fb4 := MakeObserversFilter(obs, 4000, 4000, 4000, 0, nil,
+		spec)(loc1, loc2)
+	if fb4 == nil || len(fb4.Factors) != 6 || !fb4.Factors[2].Skipped ||
+		math.Abs(fb4.Score - fb3.Score) > 1e-12 {
+		Fatal("Optional observer scored wrongly: %v", fb4)
+	}
+	dir, err := ioutil.TempDir("", "waypoint")
+	ifError(err)
+	defer os.RemoveAll(dir)
+	WriteFlybysToFile(dir, []Flyby{*fb4})
+	in, err := os.Open(GetResultPath(dir))
+	ifError(err)
+	defer in.Close()
+	records, err := csv.NewReader(in).ReadAll()
+	ifError(err)
+	header := strings.Join(records[0], ",")
+	if len(records) != 2 || len(records[1]) != len(records[0]) ||
+		!strings.Contains(header, "Name:Far nearest,") ||
+		!strings.HasSuffix(header, ",score,distance Name:Off,heading Name:Off," +
+			"distance Name:Far,heading Name:Far,prior loc1,prior loc2") ||
+		records[1][len(records[1]) - 4] != "" || records[1][24] != "" {
+		Fatal("Results written wrongly: %v", records)
+	}
+	Println("Scoring correct")
+	return
+}
+
+// For random paths, including some across the equator, the antimeridian and
+// near the poles, a point on the path must fit at the course found
+// independently from the bearing to the end, flying either way, and not at
+// courses well away from it.
+func testHeading() {
+	rnd := rand.New(rand.NewSource(5))
+	type pair struct {
+		loc1, loc2	Location
+	}
+	pairs := []pair{
+		{Location{Lat: -5, Long: 80}, Location{Lat: 5, Long: 80}},		// equator, north
+		{Location{Lat: 5, Long: 80}, Location{Lat: -5, Long: 85}},		// equator, south
+		{Location{Lat: 10, Long: 178}, Location{Lat: 12, Long: -176}},	// antimeridian, east
+		{Location{Lat: -30, Long: -177}, Location{Lat: -35, Long: 175}},	// antimeridian, west
+		{Location{Lat: 85, Long: 0}, Location{Lat: 85, Long: 170}},		// over the north pole
+		{Location{Lat: -80, Long: 45}, Location{Lat: -84, Long: -120}},	// near the south pole
+		{Location{Lat: 0, Long: 90}, Location{Lat: 0, Long: 100}},		// along the equator
+	}
+	for len(pairs) < 2000 {
+		loc1 := Location{Lat: RadToDeg(math.Asin(2.0*rnd.Float64() - 1.0)),
+			Long: rnd.Float64()*360.0 - 180.0}
+		loc2 := Location{Lat: RadToDeg(math.Asin(2.0*rnd.Float64() - 1.0)),
+			Long: rnd.Float64()*360.0 - 180.0}
+		a := loc1.ToCartesianVector().AngleWith(loc2.ToCartesianVector())
+		// Not so long as to be nearly antipodal, nor so short as to be
+		// numerically awkward
+		if RadToDist(a) > 50.0 && RadToDist(a) < 15000.0 {
+			pairs = append(pairs, pair{loc1, loc2})
+		}
+	}
+	for i, p := range pairs {
+		f := 0.1 + 0.8*rnd.Float64()
+		loc3 := p.loc1.IntermediateTo(p.loc2, f)
+		loc3.Type, loc3.Name = "Other", "P"
+		course := loc3.BearingTo(p.loc2)
+		a := RadToDist(p.loc1.ToCartesianVector().AngleWith(p.loc2.ToCartesianVector()))
+		for _, reverse := range []bool{false, true} {
+			want := course
+			if reverse {
+				want = math.Mod(course + 180.0, 360.0)
+			}
+			filter := MakeNearestApproachFilter(loc3, 20000, 20000, 20000, 0.5,
+				[]float64{want - 1.0, want + 1.0})
+			for _, swap := range []bool{false, true} {
+				loc1, loc2 := p.loc1, p.loc2
+				if swap {
+					loc1, loc2 = loc2, loc1
+				}
+				fits, _, fb := filter(loc1, loc2)
+				if !fits {
+					Fatal("Pair %d %v -> %v at %.3f, course %.3f: no fit",
+						i, p.loc1, p.loc2, f, want)
+				}
+				along := f*a
+				start := p.loc1
+				if reverse {
+					along = a - along
+					start = p.loc2
+				}
+				if fb.Loc1 != start ||
+					CourseDifference(RadToDeg(fb.Heading), want) > 1e-3 ||
+					RadToDist(fb.Nearest) > 0.01 ||
+					math.Abs(RadToDist(fb.AlongTrack) - along) > 0.01 {
+					Fatal("Pair %d %v -> %v at %.3f: flyby %v, course %.6f, " +
+						"expected %.6f", i, p.loc1, p.loc2, f, fb, RadToDeg(fb.Heading), want)
+				}
+			}
+			off := MakeNearestApproachFilter(loc3, 20000, 20000, 20000, 0.5,
+				[]float64{want + 10.0, want + 20.0})
+			if fits, _, _ := off(p.loc1, p.loc2); fits {
+				Fatal("Pair %d %v -> %v fitted a course 10 deg off", i,
+					p.loc1, p.loc2)
+			}
+		}
+	}
+	Println("Headings correct for %d paths", len(pairs))
+	return
+}
+
+// Legendre functions against their closed forms, declinations against those
+// worked by hand at the equator, where only a few terms survive, and a
+// magnetic heading turned into true courses for the filter.
+func testMagnetic() {
+	theta := 0.7
+	ct, st := math.Cos(theta), math.Sin(theta)
+	closed := func(theta float64) [][]float64 {
+		c, s := math.Cos(theta), math.Sin(theta)
+		return [][]float64{
+			{1.0},
+			{c, s},
+			{(3.0*c*c - 1.0)/2.0, math.Sqrt(3.0)*c*s, math.Sqrt(3.0)/2.0*s*s},
+			{(5.0*c*c*c - 3.0*c)/2.0, math.Sqrt(3.0/8.0)*s*(5.0*c*c - 1.0),
+				math.Sqrt(15.0)/2.0*c*s*s, math.Sqrt(5.0/8.0)*s*s*s},
+		}
+	}
+	P, dP := schmidtLegendre(3, theta)
+	want := closed(theta)
+	h := 1e-6
+	above, below := closed(theta + h), closed(theta - h)
+	for n := range want {
+		for m := range want[n] {
+			dwant := (above[n][m] - below[n][m])/(2.0*h)
+			if math.Abs(P[n][m] - want[n][m]) > 1e-12 ||
+				math.Abs(dP[n][m] - dwant) > 1e-8 {
+				Fatal("P%d%d at cos %.3f, sin %.3f is %g, %g, expected %g, %g",
+					n, m, ct, st, P[n][m], dP[n][m], want[n][m], dwant)
+			}
+		}
+	}
+	if y := DecimalYear(time.Date(2014, 3, 8, 0, 0, 0, 0, time.UTC));
+		math.Abs(y - (2014.0 + 66.0/365.0)) > 1e-9 {
+		Fatal("8 March 2014 is %.6f", y)
+	}
+
+	path := filepath.Join(GetDataPath(), TESTDATA_DIR, "wmm", WMM_COF_NAME)
+	mm := ReadMagneticModelFile(path)
+	if mm.Name != "WMM-TEST" || mm.Epoch != 2020.0 || mm.Nmax != 2 ||
+		mm.H[2][1] != -2991.6 || mm.Gdot[1][1] != 7.7 {
+		Fatal("Magnetic model read wrongly: %#v", mm)
+	}
+	// On the equator, where geodetic and geocentric north agree
+	date := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	k := WMM_REF_RAD/WGS84.(Ellipsoid).A
+	coeff := func(c, cdot [][]float64, n, m int) float64 {
+		return c[n][m] + 5.0*cdot[n][m]
+	}
+	for _, long := range []float64{-170.0, -60.0, 0.0, 45.0, 120.0, 179.0} {
+		l := DegToRad(long)
+		g := func(n, m int) float64 { return coeff(mm.G, mm.Gdot, n, m) }
+		hh := func(n, m int) float64 { return coeff(mm.H, mm.Hdot, n, m) }
+		x := -k*k*k*g(1, 0) - k*k*k*k*math.Sqrt(3.0)*
+			(g(2, 1)*math.Cos(l) + hh(2, 1)*math.Sin(l))
+		y := k*k*k*(g(1, 1)*math.Sin(l) - hh(1, 1)*math.Cos(l)) +
+			k*k*k*k*math.Sqrt(3.0)*(g(2, 2)*math.Sin(2.0*l) - hh(2, 2)*math.Cos(2.0*l))
+		d := mm.Declination(Location{Lat: 0, Long: long}, date)
+		if math.Abs(d - RadToDeg(math.Atan2(y, x))) > 1e-9 {
+			Fatal("Declination at long %g is %.6f, expected %.6f", long, d,
+				RadToDeg(math.Atan2(y, x)))
+		}
+	}
+	// Near the poles the declination is still found
+	for _, lat := range []float64{-90.0, 89.9, 90.0} {
+		if d := mm.Declination(Location{Lat: lat, Long: 30}, date);
+			math.IsNaN(d) || math.IsInf(d, 0) {
+			Fatal("Declination at lat %g is %v", lat, d)
+		}
+	}
+	if hd := MagneticToTrue([]float64{350.0, 20.0}, 15.0);
+		hd[0] != 5.0 || hd[1] != 35.0 {
+		Fatal("Magnetic 350 to 20 with declination 15 gave %v", hd)
+	}
+
+	// A path seen at its midpoint, with the sighting given as magnetic
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "N", Lat: 10, Long: 75}
+	mid := testPointAlong(loc1, loc2, 0.5, "M")
+	course := mid.BearingTo(loc2)
+	decl := mm.Declination(mid, date)
+	sc := Scenario{
+		Amax:	4000, Bmax: 4000, Cmax: 4000, Nproc: 1,
+		Observer:	"Name:M",
+		Dmax:		0.5,
+		Heading:	[]float64{10, 20},
+		Date:		"2025-01-01",
+	}
+	if sc.Validate() != nil {
+		Fatal("Scenario invalid: %v", sc.Validate())
+	}
+	sc.Magnetic = true
+	sc.Date = ""
+	if sc.Validate() == nil {
+		Fatal("Magnetic heading accepted without a date")
+	}
+	sc.Date = "2025-01-01"
+	dir := filepath.Join(GetDataPath(), TESTDATA_DIR, "wmm")
+	locs := Locations{loc1, loc2, mid}
+	for _, tc := range []struct {
+		what		string
+		magnetic	bool
+		heading		float64
+		want		bool
+	}{
+		{"Magnetic heading", true, course - decl, true},
+		{"True heading taken as magnetic", true, course, false},
+		{"True heading", false, course, true},
+	} {
+		sc.Magnetic = tc.magnetic
+		sc.Heading = []float64{normalizeAzimuth(tc.heading - 1.0),
+			normalizeAzimuth(tc.heading + 1.0)}
+		filter := locs.MakeUserFilters(sc, dir)[0].(*FlybyPoint).nearestApproach
+		fits, _, fb := filter(loc1, loc2)
+		if fits != tc.want {
+			Fatal("%s: fits %v, expected %v", tc.what, fits, tc.want)
+		}
+		if fits && tc.magnetic && (!fb.Observers[0].Declined ||
+			CourseDifference(fb.Observers[0].MagneticHeading(), course - decl) > 1e-3) {
+			Fatal("%s: magnetic course %v, expected %.3f", tc.what,
+				fb.Observers[0], course - decl)
+		}
+	}
+	Println("Magnetic model correct, declination %.2f deg at %v", decl, mid)
+	return
+}
+
+// The wind triangle solved for cases worked by hand, and for tracks flown at
+// random headings, airspeeds and winds, a wind grid interpolated, and a
+// heading seen with the wind across the path checked against its track.
+func testWind() {
+	if east, north := WindVector(270, 100); math.Abs(east - 100) > 1e-9 ||
+		math.Abs(north) > 1e-9 {
+		Fatal("Wind from the west blows %g east, %g north", east, north)
+	}
+	east, north := WindVector(90, 50)
+	for _, tc := range []struct {
+		what				string
+		heading, airspeed	[]float64
+		east, north			float64
+		track				float64
+		fits				bool
+		crab, gs			float64
+	}{
+		{"Wind from the right", []float64{0, 20}, []float64{400, 400},
+			east, north, 0, true, RadToDeg(math.Asin(50.0/400.0)),
+			400.0*math.Cos(math.Asin(50.0/400.0))},
+		{"Headwind", []float64{350, 10}, []float64{300, 500}, 0, -100, 0,
+			true, 0, 300},
+		{"Heading not seen", []float64{20, 30}, []float64{400, 400},
+			east, north, 0, false, 0, 0},
+		{"Wind too strong", []float64{0, 179}, []float64{40, 45},
+			east, north, 0, false, 0, 0},
+		{"Blown backwards", []float64{350, 10}, []float64{80, 90}, 0, -100, 0,
+			false, 0, 0},
+	} {
+		d := Drift{Heading: tc.heading, Airspeed: tc.airspeed,
+			East: tc.east, North: tc.north}
+		crab, gs, fits := d.Solve(tc.track)
+		if fits != tc.fits || (fits && (math.Abs(crab - tc.crab) > 1e-9 ||
+			math.Abs(gs - tc.gs) > 1e-9)) {
+			Fatal("%s: crab %.3f, ground speed %.3f, fits %v, expected " +
+				"%.3f, %.3f, %v", tc.what, crab, gs, fits, tc.crab, tc.gs, tc.fits)
+		}
+	}
+	rnd := rand.New(rand.NewSource(7))
+	for i := 0; i < 2000; i++ {
+		h0 := rnd.Float64()*360.0
+		d := Drift{
+			Heading:	[]float64{h0, normalizeAzimuth(h0 + rnd.Float64()*90.0)},
+			Airspeed:	[]float64{300, 300 + rnd.Float64()*600.0},
+		}
+		d.East, d.North = WindVector(rnd.Float64()*360.0, rnd.Float64()*250.0)
+		h := normalizeAzimuth(d.Heading[0] +
+			rnd.Float64()*CourseSpan(d.Heading[0], d.Heading[1]))
+		v := d.Airspeed[0] + rnd.Float64()*(d.Airspeed[1] - d.Airspeed[0])
+		track := d.track(h, v)
+		tracks := d.Tracks()
+		if !InCourseRange(track, tracks[0], tracks[1]) || tracks[0] < 0 ||
+			tracks[1] > 360.0 || (tracks[1] == 360.0 && tracks[0] != 0) {
+			Fatal("Track %.3f from %v not in %v", track, d, tracks)
+		}
+		// Only that heading and airspeed hold the track
+		exact := Drift{Heading: []float64{h, h}, Airspeed: []float64{v, v},
+			East: d.East, North: d.North}
+		hr, vr := DegToRad(h), v
+		gswant := math.Hypot(vr*math.Sin(hr) + d.East, vr*math.Cos(hr) + d.North)
+		crab, gs, fits := exact.Solve(track)
+		if !fits || CourseDifference(track + crab, h) > 1e-6 ||
+			math.Abs(gs - gswant) > 1e-6 {
+			Fatal("Track %.3f from %v gave crab %.3f, ground speed %.3f, " +
+				"fits %v", track, exact, crab, gs, fits)
+		}
+	}
+
+	wg := ReadWindGridFile(filepath.Join(GetDataPath(), TESTDATA_DIR, "wind.csv"))
+	corners := [][]float64{{270, 100}, {270, 50}, {180, 100}, {90, 20}}
+	ve, vn := 0.0, 0.0
+	for _, c := range corners {
+		e, n := WindVector(c[0], c[1])
+		ve, vn = ve + e/4.0, vn + n/4.0
+	}
+	e, n := wg.At(Location{Lat: 0, Long: 75})
+	e2, n2 := wg.At(Location{Lat: 30, Long: 100})
+	ec, nc := WindVector(90, 20)
+	if math.Abs(e - ve) > 1e-9 || math.Abs(n - vn) > 1e-9 ||
+		math.Abs(e2 - ec) > 1e-9 || math.Abs(n2 - nc) > 1e-9 {
+		Fatal("Wind grid gave %g, %g in the middle and %g, %g outside",
+			e, n, e2, n2)
+	}
+	// Across the antimeridian, from 175 to -175, and outside it from the
+	// nearer edge
+	wg = ReadWindGridFile(filepath.Join(GetDataPath(), TESTDATA_DIR,
+		"wind_dateline.csv"))
+	ew, nw := WindVector(270, 100)
+	ee, ne := WindVector(90, 20)
+	for _, tc := range []struct {
+		long, f	float64
+	}{{175, 0}, {180, 0.5}, {-180, 0.5}, {-177.5, 0.75}, {-175, 1},
+		{-170, 1}, {-10, 1}, {10, 0}, {170, 0}} {
+		e, n := wg.At(Location{Lat: 0, Long: tc.long})
+		if math.Abs(e - (ew + tc.f*(ee - ew))) > 1e-9 ||
+			math.Abs(n - (nw + tc.f*(ne - nw))) > 1e-9 {
+			Fatal("Wind grid across the antimeridian gave %g, %g at %g",
+				e, n, tc.long)
+		}
+	}
+	// All the way round, from 60 back to -180
+	round := WindGrid{Lats: []float64{0}, Longs: []float64{-180, -60, 60},
+		East: [][]float64{{0, 10, 20}}, North: [][]float64{{0, 0, 0}}}
+	if e, _ := round.At(Location{Long: 120}); math.Abs(e - 10) > 1e-9 {
+		Fatal("Wind grid all the way round gave %g at 120", e)
+	}
+
+	// A path seen at its midpoint, with the wind from the east
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "N", Lat: 10, Long: 75}
+	mid := testPointAlong(loc1, loc2, 0.5, "M")
+	course := mid.BearingTo(loc2)
+	locs := Locations{loc1, loc2, mid}
+	sc := Scenario{
+		Amax:	4000, Bmax: 4000, Cmax: 4000, Nproc: 1,
+		Observer:	"Name:M",
+		Dmax:		0.5,
+		Wind:		&WindSpec{Direction: 90, Speed: 100},
+		Airspeed:	[]float64{700, 900},
+	}
+	for _, tc := range []struct {
+		what	string
+		heading	float64
+		want	bool
+	}{
+		{"Heading into the wind", course + 8.0, true},
+		{"Heading along the track", course, false},
+		{"Heading off downwind", course - 8.0, false},
+	} {
+		sc.Heading = []float64{normalizeAzimuth(tc.heading - 1.0),
+			normalizeAzimuth(tc.heading + 1.0)}
+		if err := sc.Validate(); err != nil {
+			Fatal("Scenario invalid: %v", err)
+		}
+		filter := locs.MakeUserFilters(sc, GetDataPath())[0].(*FlybyPoint).nearestApproach
+		fits, _, fb := filter(loc1, loc2)
+		if fits != tc.want {
+			Fatal("%s: fits %v, expected %v", tc.what, fits, tc.want)
+		}
+		if fits && (fb.Crab < 7.0 || fb.Crab > 9.0 || fb.GroundSpeed < 700 ||
+			fb.GroundSpeed > 900) {
+			Fatal("%s: crab %.2f, ground speed %.0f", tc.what, fb.Crab,
+				fb.GroundSpeed)
+		}
+	}
+	sc.Airspeed = nil
+	if sc.Validate() == nil {
+		Fatal("Wind accepted without airspeed")
+	}
+	Println("Wind triangle correct")
+	return
+}
+
+// Sight ranges against the distance to the horizon, elevations at the edge
+// of sight against the minimum, and observers off the path seen or not by
+// how far they are.
+func testSight() {
+	horizon := SightSpec{Altitude: []float64{0, 10000}}
+	want := EARTH_RAD*math.Acos(EARTH_RAD/(EARTH_RAD + 10.0))
+	if math.Abs(horizon.Range() - want) > 1e-9 ||
+		math.Abs(horizon.Elevation(0, 10000) - 90.0) > 1e-9 {
+		Fatal("Horizon at %.3f km, expected %.3f, elevation overhead %.3f",
+			horizon.Range(), want, horizon.Elevation(0, 10000))
+	}
+	rnd := rand.New(rand.NewSource(11))
+	for i := 0; i < 1000; i++ {
+		low := rnd.Float64()*5000.0
+		spec := SightSpec{
+			Eye:			rnd.Float64()*100.0,
+			MinElevation:	rnd.Float64()*45.0,
+			Altitude:		[]float64{low, 200.0 + low + rnd.Float64()*12000.0},
+		}
+		r := spec.Range()
+		if math.Abs(spec.Elevation(r, spec.Altitude[1]) - spec.MinElevation) > 1e-6 ||
+			spec.Elevation(r, spec.Altitude[0]) > spec.MinElevation {
+			Fatal("Sight %#v at its range %.3f km has elevations %v", spec, r,
+				spec.Elevations(r))
+		}
+	}
+
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "S", Lat: -10, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "N", Lat: 10, Long: 75}
+	mid := testPointAlong(loc1, loc2, 0.5, "M")
+	course := mid.BearingTo(loc2)
+	sight := &SightSpec{Eye: 2, MinElevation: 10, Altitude: []float64{3000, 10000}}
+	Println("Seen out to %.2f km", sight.Range())
+	for _, tc := range []struct {
+		what		string
+		dist, dmax	float64
+		want		bool
+	}{
+		{"Within sight", 30, 0, true},
+		{"Out of sight", 80, 0, false},
+		{"Within sight but beyond dmax", 30, 20, false},
+		{"Within dmax and sight", 10, 20, true},
+	} {
+		loc3 := mid.Destination(course + 90.0, tc.dist)
+		loc3.Type, loc3.Name = "Other", "O"
+		spec := ObserverSpec{
+			TimedLabel:	TimedLabel{Label: "Name:O"},
+			Dmax:		tc.dmax,
+			Heading:	[]float64{normalizeAzimuth(course - 5.0), course + 5.0},
+			Sight:		sight,
+		}
+		if err := (Scenario{Amax: 1, Bmax: 1, Cmax: 1, Nproc: 1,
+			Observers: []ObserverSpec{spec}}).Validate(); err != nil {
+			Fatal("%s: scenario invalid: %v", tc.what, err)
+		}
+		filter := MakeObserversFilter(
+			[]ObserverConstraint{{ObserverSpec: spec, Loc: loc3}},
+			4000, 4000, 4000, 0, nil, nil)
+		fits, _, fb := filter(loc1, loc2)
+		if fits != tc.want {
+			Fatal("%s: fits %v, expected %v", tc.what, fits, tc.want)
+		}
+		if fits {
+			elev := fb.Observers[0].Elevation
+			if !fb.Observers[0].Sighted || len(elev) != 2 ||
+				math.Abs(elev[1] - sight.Elevation(tc.dist, 10000)) > 0.01 ||
+				elev[0] >= elev[1] {
+				Fatal("%s: elevations %v", tc.what, elev)
+			}
+		}
+	}
+	if (Scenario{Amax: 1, Bmax: 1, Cmax: 1, Nproc: 1, Observer: "Name:O",
+		Heading: []float64{0, 10}}).Validate() == nil {
+		Fatal("Observer accepted without dmax or sight")
+	}
+	Println("Sight model correct")
+	return
+}
+
+// The sun's declination at the equinoxes and solstices of 2024, the
+// equation of time at its extremes, the sun overhead where it should be and
+// at noon and sunrise, and sightings flying into the sun rejected.
+func testSun() {
+	at := func(txt string) time.Time {
+		t, err := time.Parse(time.RFC3339, txt)
+		ifError(err)
+		return t
+	}
+	for _, tc := range []struct {
+		when	string
+		decl	float64
+	}{
+		{"2024-03-20T03:06:00Z", 0.0},
+		{"2024-06-20T20:51:00Z", 23.44},
+		{"2024-09-22T12:44:00Z", 0.0},
+		{"2024-12-21T09:20:00Z", -23.44},
+	} {
+		if decl, _ := sunDeclination(at(tc.when)); math.Abs(decl - tc.decl) > 0.01 {
+			Fatal("Declination at %s is %.4f, expected %.2f", tc.when, decl, tc.decl)
+		}
+	}
+	for _, tc := range []struct {
+		when	string
+		eqtime	float64
+	}{
+		{"2024-02-11T12:00:00Z", -14.2},
+		{"2024-11-03T12:00:00Z", 16.4},
+	} {
+		if _, eqtime := sunDeclination(at(tc.when)); math.Abs(eqtime - tc.eqtime) > 0.2 {
+			Fatal("Equation of time at %s is %.2f min, expected %.1f", tc.when,
+				eqtime, tc.eqtime)
+		}
+	}
+	// Overhead where the declination and equation of time put it
+	rnd := rand.New(rand.NewSource(13))
+	for i := 0; i < 200; i++ {
+		t := time.Unix(946684800 + rnd.Int63n(3600*24*365*30), 0).UTC()
+		decl, eqtime := sunDeclination(t)
+		minutes := float64(t.Hour()*60 + t.Minute()) + float64(t.Second())/60.0
+		long := math.Remainder((720.0 - minutes - eqtime)/4.0, 360.0)
+		if sun := SunAt(Location{Lat: decl, Long: long}, t); sun.Elevation < 89.99 {
+			Fatal("Sun at %s not overhead at %.3f, %.3f: %v", t, decl, long, sun)
+		}
+	}
+	// Noon at Greenwich on the solstice, and sunrise on the equator at the
+	// equinox, when the sun's centre is lifted by refraction
+	noon := SunAt(Location{Lat: 51.4769, Long: 0}, at("2024-06-20T12:01:35Z"))
+	rise := SunAt(Location{Lat: 0, Long: 0}, at("2024-03-20T06:07:15Z"))
+	if math.Abs(noon.Elevation - (90.0 - 51.4769 + 23.44)) > 0.05 ||
+		CourseDifference(noon.Azimuth, 180.0) > 0.5 ||
+		math.Abs(rise.Elevation - 0.48) > 0.1 ||
+		CourseDifference(rise.Azimuth, 90.0) > 0.1 {
+		Fatal("Noon %v, sunrise %v", noon, rise)
+	}
+	east := SunPosition{Azimuth: 90, Elevation: 0}
+	if east.AngleTo(90) > 1e-6 || math.Abs(east.AngleTo(270) - 180.0) > 1e-6 ||
+		math.Abs(SunPosition{Azimuth: 90, Elevation: 90}.AngleTo(0) - 90.0) > 1e-6 {
+		Fatal("Angles to the sun wrong")
+	}
+
+	// Flying along the equator at sunrise, into the sun and away from it
+	loc1 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "W", Lat: 0, Long: 70}
+	loc2 := Location{Type: LOCTYPE["Waypoint"].Tag, Name: "E", Lat: 0, Long: 75}
+	loc3 := Location{Type: "Other", Name: "O", Lat: 0.001, Long: 72.5}
+	for _, tc := range []struct {
+		what	string
+		time	string
+		heading	[]float64
+		sun		SunSpec
+		want	bool
+		angle	float64
+	}{
+		{"Into the sun", "2024-03-20T01:17:00Z", []float64{80, 100},
+			SunSpec{MinAngle: 30}, false, 0},
+		{"Away from the sun", "2024-03-20T01:17:00Z", []float64{260, 280},
+			SunSpec{MinAngle: 30}, true, 180},
+		{"Into the sun, unconstrained", "2024-03-20T01:17:00Z",
+			[]float64{80, 100}, SunSpec{}, true, 0},
+		{"At night", "2024-03-19T19:17:00Z", []float64{80, 100},
+			SunSpec{Above: true}, false, 0},
+	} {
+		spec := ObserverSpec{
+			TimedLabel:	TimedLabel{Label: "Name:O", Time: tc.time},
+			Dmax:		0.5,
+			Heading:	tc.heading,
+			Sun:		&tc.sun,
+		}
+		if msgs := spec.problems("observer"); len(msgs) > 0 {
+			Fatal("%s: %v", tc.what, msgs)
+		}
+		filter := MakeObserversFilter(
+			[]ObserverConstraint{{ObserverSpec: spec, Loc: loc3}},
+			4000, 4000, 4000, 0, nil, nil)
+		fits, _, fb := filter(loc1, loc2)
+		if fits != tc.want {
+			Fatal("%s: fits %v, expected %v", tc.what, fits, tc.want)
+		}
+		if fits && (!fb.Observers[0].SunKnown ||
+			math.Abs(fb.Observers[0].SunAngle - tc.angle) > 2.0) {
+			Fatal("%s: angle to the sun %.1f, expected %.0f", tc.what,
+				fb.Observers[0].SunAngle, tc.angle)
+		}
+	}
+	if msgs := (ObserverSpec{TimedLabel: TimedLabel{Label: "Name:O"}, Dmax: 1,
+		Heading: []float64{0, 10}, Sun: &SunSpec{}}).problems("observer");
+		len(msgs) == 0 {
+		Fatal("Sun constraint accepted without a time")
+	}
+	Println("Sun positions correct")
+	return
+}
+
+// Downloads from a local server that fails in various ways: errors retried
+// with backoff where worth it, missing pages not saved, requests spaced out,
+// complete files skipped, changed files fetched again and unchanged ones
+// left alone when refreshing.
+// Sends requests through a function, to watch them go.
+type testRoundTripper func(r *http.Request) (*http.Response, error)
+
+func (rt testRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return rt(r)
+}
+
+func testDownload() {
+	var mutex sync.Mutex
+	hits := map[string]int{}
+	times := []time.Time{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			hits[r.URL.Path]++
+			n := hits[r.URL.Path]
+			mutex.Unlock()
+			switch r.URL.Path {
+				case "/ok":
+					if r.Header.Get("If-None-Match") == `"v1"` {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					w.Header().Set("ETag", `"v1"`)
+					w.Write([]byte("hello"))
+				case "/flaky":
+					if n <= 2 {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					w.Write([]byte("at last"))
+				case "/limited":
+					if n == 1 {
+						w.Header().Set("Retry-After", "0")
+						w.WriteHeader(http.StatusTooManyRequests)
+						return
+					}
+					w.Write([]byte("thanks"))
+				case "/down":
+					w.WriteHeader(http.StatusInternalServerError)
+				default:
+					http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	// Times taken as each request is sent, rather than as it reaches the
+	// server, which adds the jitter of the connection
+	client := server.Client()
+	base := client.Transport
+	client.Transport = testRoundTripper(func(r *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		times = append(times, time.Now())
+		mutex.Unlock()
+		return base.RoundTrip(r)
+	})
+	dir, err := ioutil.TempDir("", "waypoint")
+	ifError(err)
+	defer os.RemoveAll(dir)
+	names := []string{"ok", "flaky", "limited", "down", "missing"}
+	jobs := []FetchJob{}
+	for _, name := range names {
+		jobs = append(jobs, FetchJob{Url: server.URL + "/" + name,
+			Path: filepath.Join(dir, name + ".html")})
+	}
+	delay, tolerance := 40*time.Millisecond, 10*time.Millisecond
+	fetcher := func(refresh bool) *Fetcher {
+		return &Fetcher{Client: client, Workers: 3,
+			Delay: delay, Retries: 3, Backoff: time.Millisecond,
+			Refresh: refresh, ManifestPath: filepath.Join(dir, "manifest.json")}
+	}
+	check := func(what string, results []FetchResult, want map[string][]interface{}) {
+		for i, r := range results {
+			w := want[names[i]]
+			if r.Status != w[0].(string) || r.Attempts != w[1].(int) {
+				Fatal("%s: %s %s after %d attempts, expected %v", what, names[i],
+					r.Status, r.Attempts, w)
+			}
+		}
+		PrintFetchSummary(results)
+	}
+	check("First run", fetcher(false).FetchAll(jobs), map[string][]interface{}{
+		"ok":		{FETCH_FETCHED, 1},
+		"flaky":	{FETCH_FETCHED, 3},
+		"limited":	{FETCH_FETCHED, 2},
+		"down":		{FETCH_FAILED, 4},
+		"missing":	{FETCH_FAILED, 1},
+	})
+	for _, name := range []string{"down", "missing"} {
+		if _, err := os.Stat(filepath.Join(dir, name + ".html")); !os.IsNotExist(err) {
+			Fatal("Failed download of %s saved", name)
+		}
+	}
+	if parts, _ := filepath.Glob(filepath.Join(dir, "*.part")); len(parts) > 0 {
+		Fatal("Part files left: %v", parts)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for i := 1; i < len(times); i++ {
+		if times[i].Sub(times[i-1]) < delay - tolerance {
+			Fatal("Requests %d and %d only %v apart", i-1, i,
+				times[i].Sub(times[i-1]))
+		}
+	}
+
+	// Complete files skipped without asking, and one cut short fetched again
+	ifError(ioutil.WriteFile(filepath.Join(dir, "flaky.html"), []byte("at"), 0644))
+	nhits := len(times)
+	check("Second run", fetcher(false).FetchAll(jobs), map[string][]interface{}{
+		"ok":		{FETCH_SKIPPED, 0},
+		"flaky":	{FETCH_FETCHED, 1},
+		"limited":	{FETCH_SKIPPED, 0},
+		"down":		{FETCH_FAILED, 4},
+		"missing":	{FETCH_FAILED, 1},
+	})
+	if len(times) - nhits != 6 {
+		Fatal("Second run made %d requests, expected 6", len(times) - nhits)
+	}
+	check("Refresh", fetcher(true).FetchAll(jobs[:1]), map[string][]interface{}{
+		"ok":	{FETCH_UNCHANGED, 1},
+	})
+	byts, err := ioutil.ReadFile(filepath.Join(dir, "ok.html"))
+	ifError(err)
+	if string(byts) != "hello" {
+		Fatal("Unchanged file now %q", byts)
+	}
+	Println("Downloader correct")
+	return
+}
+
+// A source of fixed locations, for testing.
+type testLocationSource struct {
+	name	string
+	locs	Locations
+}
+
+func (src testLocationSource) Name() string {
+	return src.name
+}
+
+func (src testLocationSource) Provenance() string {
+	return "test locations"
+}
+
+func (src testLocationSource) Load(datapath string) Locations {
+	return append(Locations{}, src.locs...)
+}
+
+func testSources() {
+	waypoint := LOCTYPE["Waypoint"].Tag
+	RegisterLocationSource(testLocationSource{name: "testfirst", locs: Locations{
+		{Type: waypoint, Name: "FIRST", Lat: 4.0, Long: 73.0},
+		{Type: waypoint, Name: "ONLYFIRST", Lat: 5.0, Long: 73.0},
+	}})
+	RegisterLocationSource(testLocationSource{name: "testsecond", locs: Locations{
+		{Type: waypoint, Name: "SECOND", Lat: 4.0, Long: 73.0},
+		{Type: waypoint, Name: "ONLYSECOND", Lat: 6.0, Long: 73.0},
+	}})
+	from := map[string]string{"FIRST": "testfirst", "ONLYFIRST": "testfirst",
+		"SECOND": "testsecond", "ONLYSECOND": "testsecond"}
+	for _, order := range [][]string{
+		{"testfirst", "testsecond"}, {" testsecond", "testfirst "}} {
+		locs := LoadLocationData("", order).RemoveRedundant(1000)
+		if len(locs) != 3 {
+			Fatal("Sources %v kept %d locations, not 3", order, len(locs))
+		}
+		for _, loc := range locs {
+			if loc.Source != from[loc.Name] {
+				Fatal("%s recorded as from source %q", loc.Name, loc.Source)
+			}
+		}
+		if locs[0].Source != strings.TrimSpace(order[0]) {
+			Fatal("Sources %v kept %s, not the location from the first",
+				order, locs[0].Name)
+		}
+	}
+	names := LocationSourceNames()
+	for _, name := range []string{"fallingrain", "ourairports", "arinc",
+		"xplane", "supplementary", "user"} {
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			Fatal("Source %s not registered, have %v", name, names)
+		}
+	}
+	Println("Location sources tagged and prioritised in order given")
+	return
+}
+
+func testMerge() {
+	airport, waypoint := LOCTYPE["Airport"].Tag, LOCTYPE["Waypoint"].Tag
+	RegisterLocationSource(testLocationSource{name: "testbest"})
+	RegisterLocationSource(testLocationSource{name: "testnext"})
+	// 0.01 deg of latitude is about 1.1 km
+	locs := Locations{
+		{Type: airport, Source: "testbest", ICAOcode: "VRMM", Name: "Male Intl",
+			Lat: 4.19, Long: 73.53},
+		{Type: waypoint, Source: "testbest", Name: "KUDA", Lat: 1.0, Long: 73.0},
+		{Type: waypoint, Source: "testbest", Name: "MANTA", Lat: 2.0, Long: 73.0},
+		{Type: waypoint, Source: "testbest", ICAOcode: "MLE", Lat: 4.3, Long: 73.5},
+		{Type: waypoint, Source: "testbest", Name: "KUDA EAST", Lat: 1.0,
+			Long: 73.002},
+		{Type: airport, Source: "testnext", ICAOcode: "VRMM", IATAcode: "MLE",
+			Name: "Velana International", Lat: 4.217, Long: 73.53, Elevation: 6},
+		{Type: waypoint, Source: "testnext", Name: "Kuda.", Lat: 1.002,
+			Long: 73.0, Frequency: 395},
+		{Type: waypoint, Source: "testnext", Name: "RAYS", Lat: 2.001, Long: 73.0},
+		{Type: airport, Source: "testnext", ICAOcode: "MLE", Lat: 4.3, Long: 73.5},
+	}
+	policy := NewMergePolicy([]string{"testbest", "testnext"}, "", 0.5)
+	merged, conflicts := locs.Merge(policy)
+	if len(merged) != 7 {
+		Fatal("Merged %d locations into %d, not 7: %v", len(locs),
+			len(merged), merged)
+	}
+	if merged[0].Source != "testbest+testnext" || merged[0].Lat != 4.19 ||
+		merged[0].IATAcode != "MLE" || merged[0].Name != "Male Intl" ||
+		merged[0].Elevation != 6 {
+		Fatal("Airports sharing a code merged wrongly: %#v", merged[0])
+	}
+	if merged[1].Source != "testbest+testnext" || merged[1].Name != "KUDA" ||
+		merged[1].Frequency != 395 {
+		Fatal("Nearby waypoints with similar names merged wrongly: %#v",
+			merged[1])
+	}
+	if merged[2].Source != "testbest" {
+		Fatal("Nearby waypoints with different names merged: %#v", merged[2])
+	}
+	if merged[3].Source != "testbest" {
+		Fatal("Waypoint merged with airport sharing its code: %#v", merged[3])
+	}
+	if merged[4].Name != "KUDA EAST" || merged[4].Source != "testbest" {
+		Fatal("Waypoints from the same source merged: %#v", merged[4])
+	}
+	if len(conflicts) != 1 || conflicts[0].Merged.ICAOcode != "VRMM" ||
+		math.Abs(conflicts[0].Dist[1] - 3.0) > 0.01 {
+		Fatal("Expected one conflict of 3 km, at VRMM, got %v", conflicts)
+	}
+	dir, err := ioutil.TempDir("", "waypoint")
+	ifError(err)
+	defer os.RemoveAll(dir)
+	conflicts.WriteToFile(GetMergeConflictsPath(dir))
+	in, err := os.Open(GetMergeConflictsPath(dir))
+	ifError(err)
+	defer in.Close()
+	records, err := csv.NewReader(in).ReadAll()
+	ifError(err)
+	if len(records) != 3 || !reflect.DeepEqual(records[0],
+		MERGE_CONFLICT_COLUMNS) || !reflect.DeepEqual(records[2],
+		[]string{airport, "IATA:MLE", "4.190000", "73.530000", "testnext",
+			"4.217000", "73.530000", "3.002"}) {
+		Fatal("Merge conflicts written wrongly: %v", records)
+	}
+	// Coordinates preferred from the second, and the conflict threshold
+	// raised above the disagreement
+	policy = NewMergePolicy([]string{"testbest", "testnext"},
+		"coords=testnext; frequency=testbest", 5.0)
+	merged, conflicts = locs.Merge(policy)
+	if merged[0].Lat != 4.217 || merged[0].Name != "Male Intl" ||
+		merged[1].Frequency != 395 || len(conflicts) != 0 {
+		Fatal("Field preferences not applied: %v %v %v", merged[0],
+			merged[1], conflicts)
+	}
+	// Far north, 0.6 km due east is more than 0.01 deg of longitude, and
+	// across the antimeridian the longitudes are far apart
+	east := Location{Lat: 60.0, Long: 10.0}.Destination(90.0, 0.6)
+	locs = Locations{
+		{Type: waypoint, Source: "testbest", Name: "NORTH", Lat: 60.0, Long: 10.0},
+		{Type: waypoint, Source: "testbest", Name: "DATELINE", Lat: -16.0,
+			Long: 179.998},
+		{Type: waypoint, Source: "testnext", Name: "NORTH", Lat: east.Lat,
+			Long: east.Long},
+		{Type: waypoint, Source: "testnext", Name: "DATELINE", Lat: -16.0,
+			Long: -179.998},
+	}
+	merged, _ = locs.Merge(NewMergePolicy([]string{"testbest", "testnext"},
+		"", 0.5))
+	if len(merged) != 2 || merged[0].Source != "testbest+testnext" ||
+		merged[1].Source != "testbest+testnext" {
+		Fatal("Waypoints far north or across the antimeridian not merged: %v",
+			merged)
+	}
+	if NameSimilarity("Velana Intl", "VELANA INTERNATIONAL") >= 1.0 ||
+		NameSimilarity("Kuda", "kuda.") != 1.0 ||
+		NameSimilarity("MANTA", "RAYS") >= MERGE_NAME_SIMILARITY {
+		Fatal("Name similarity wrong")
+	}
+	Println("Locations from different sources merged correctly")
+	return
+}
+
+func testNative() {
+	dir, err := ioutil.TempDir("", "waypoint")
+	ifError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, LOCATION_CSV_NAME)
+	locs := Locations{
+		{Type: LOCTYPE["Airport"].Tag, Country: "MV", State: "MLE",
+			ICAOcode: "VRMM", IATAcode: "MLE", Name: "Velana International, \"Malé\"",
+			Kind: "large_airport", Desc: "Hulhulé\nIsland", Lat: 4.191830123456789,
+			Long: 73.529099, Elevation: 6, RunwayLength: 10499,
+			Source: "ourairports+fallingrain"},
+		{Type: LOCTYPE["Waypoint"].Tag, Region: "VR", ICAOcode: "MLE",
+			Name: "MALE", Kind: "VOR-DME", Control: "BOTH", Lat: -0.5,
+			Long: -179.999999, Frequency: 112900, Source: "xplane"},
+	}
+	settings := []string{"src=ourairports,fallingrain,xplane", "prefer=",
+		"conflict=0.5"}
+	locs.WriteToNativeCSVPath(path, settings)
+	byts, err := ioutil.ReadFile(path)
+	ifError(err)
+	if !strings.HasPrefix(string(byts), fmt.Sprintf(
+		"%s,%d,\"src=ourairports,fallingrain,xplane\",prefer=,conflict=0.5\n" +
+		"type,country,", NATIVE_VERSION_TAG, NATIVE_FORMAT_VERSION)) {
+		Fatal("Native file lacks version and header: %q", string(byts[:80]))
+	}
+	if got := ReadNativeLocationsFile(path); !reflect.DeepEqual(got, locs) {
+		Fatal("Native file did not keep locations:\n%#v\n%#v", got, locs)
+	}
+	if got := ReadNativeSettings(path); !reflect.DeepEqual(got, settings) {
+		Fatal("Native file did not keep settings: %v", got)
+	}
+	// Only settings given on the command line are checked against those,
+	// whatever flags this test was run with
+	savedSources, savedPrefer, savedConflict := cmdSources, cmdPrefer, cmdConflict
+	defer func() {
+		cmdSources, cmdPrefer, cmdConflict = savedSources, savedPrefer, savedConflict
+	}()
+	cmdSources, cmdPrefer, cmdConflict = "fallingrain,supplementary", "", 0.5
+	if unmet := UnmetNativeSettings(path, map[string]bool{}); len(unmet) != 0 {
+		Fatal("Default settings checked against native file: %v", unmet)
+	}
+	given := map[string]bool{"src": true, "prefer": true, "conflict": true}
+	if unmet := UnmetNativeSettings(path, given); len(unmet) != 1 ||
+		unmet[0] != "src=fallingrain,supplementary" {
+		Fatal("Native file made with other sources used: %v", unmet)
+	}
+	cmdSources = "ourairports, fallingrain,xplane"
+	if unmet := UnmetNativeSettings(path, given); len(unmet) != 0 {
+		Fatal("Native file made with the sources given not used: %v", unmet)
+	}
+	cmdConflict = 0.25
+	if unmet := UnmetNativeSettings(path, given); len(unmet) != 1 ||
+		unmet[0] != "conflict=0.25" {
+		Fatal("Native file made with another conflict distance used: %v", unmet)
+	}
+
+	// Version 1, without header
+	ifError(ioutil.WriteFile(path, []byte(
+		"Airport,MV,MLE,,VRMM,MLE,,Velana International  Male,large_airport," +
+		"Hulhule,,4.191830,73.529099\n" +
+		"Waypoint,,,VR,MLE,,,MALE,VOR-DME,,BOTH,-0.500000,-179.999999\n"), 0644))
+	got := ReadNativeLocationsFile(path)
+	if len(got) != 2 || got[0].Name != "Velana International  Male" ||
+		got[0].Lat != 4.19183 || got[1].Control != "BOTH" ||
+		got[1].Long != -179.999999 || got[1].Source != "" {
+		Fatal("Version 1 native file read wrongly: %#v", got)
+	}
+
+	// Columns in any order, and those not known ignored
+	ifError(ioutil.WriteFile(path, []byte(NATIVE_VERSION_TAG + ",3\n" +
+		"long,lat,type,colour,name\n73.5,4.2,Waypoint,red,\"A, B\"\n"), 0644))
+	got = ReadNativeLocationsFile(path)
+	if len(got) != 1 || got[0].Lat != 4.2 || got[0].Long != 73.5 ||
+		got[0].Name != "A, B" || got[0].Type != "Waypoint" {
+		Fatal("Native file with other columns read wrongly: %#v", got)
+	}
+	Println("Native location files written and read correctly")
+	return
+}
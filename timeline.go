@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Something that happened at a known time, give or take Tolerance, at one of
+// several possible positions along a path.
+type TimedEvent struct {
+	Label		string
+	Positions	[]float64 // rad from Loc1 of the path
+	Time		time.Time
+	Tolerance	time.Duration
+}
+
+// Speed range of the aircraft, an optional departure point it left at a
+// known time, such as the last radar contact, and any satellite rings it
+// crossed.  Paths are flown by Path, great circles if nil.
+type Timeline struct {
+	Vmin		float64 // km/h
+	Vmax		float64 // km/h
+	Departure	*TimedEvent
+	DepartureLoc	Location
+	Rings		[]SatelliteRing
+	Path		PathModel
+}
+
+// Whether the aircraft could have been at one position of each event at its
+// time, and crossed every ring at its time, flying along the path from Loc1
+// to Loc2 at a speed in the range.  The departure is off the path, so only
+// the great circle distance to the path, a lower bound, is used to limit the
+// earliest time it could reach the first event.  Positions are distances
+// along the path, as the path model measures them.
+func (tl Timeline) Fits(gc GreatCircle, events []TimedEvent) bool {
+	return tl.FitsRoute(Legs{{Loc1: gc.Loc1, Loc2: gc.Loc2}}, events)
+}
+
+// As Fits, but for a route flown from the start of its first leg.
+func (tl Timeline) FitsRoute(legs Legs, events []TimedEvent) bool {
+	path := tl.Path
+	if path == nil {
+		path = GREAT_CIRCLE_PATH
+	}
+	sorted := append([]TimedEvent{}, events...)
+	for _, ring := range tl.Rings {
+		ev := ring.Event(path, legs)
+		if len(ev.Positions) == 0 {
+			return false
+		}
+		sorted = append(sorted, ev)
+	}
+	if len(sorted) == 0 {
+		return true
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+	// Speeds as rad/s
+	vmin := DistToRad(tl.Vmin)/3600.0
+	vmax := DistToRad(tl.Vmax)/3600.0
+	var vdep Vector
+	if tl.Departure != nil {
+		vdep = tl.DepartureLoc.ToCartesianVector()
+	}
+	seconds := func(t time.Time) float64 {
+		return float64(t.UnixNano())/1e9
+	}
+	var reach func(k int, pos, lo, hi float64) bool
+	reach = func(k int, pos, lo, hi float64) bool {
+		if k == len(sorted) {
+			return true
+		}
+		ev := sorted[k]
+		t := seconds(ev.Time)
+		tol := ev.Tolerance.Seconds()
+		for _, p := range ev.Positions {
+			elo, ehi := t-tol, t+tol
+			if k == 0 {
+				if tl.Departure != nil {
+					d := vdep.AngleWith(legs.PointAt(path, p))
+					dlo := seconds(tl.Departure.Time) -
+						tl.Departure.Tolerance.Seconds()
+					elo = math.Max(elo, dlo + d/vmax)
+				}
+			} else {
+				ds := p - pos
+				if ds < -1e-12 {
+					continue // would have to turn back
+				}
+				ds = math.Max(ds, 0.0)
+				elo = math.Max(elo, lo + ds/vmax)
+				if vmin > 0 {
+					ehi = math.Min(ehi, hi + ds/vmin)
+				}
+			}
+			if elo <= ehi && reach(k+1, p, elo, ehi) {
+				return true
+			}
+		}
+		return false
+	}
+	return reach(0, 0.0, 0.0, 0.0)
+}
@@ -10,6 +10,7 @@ import (
 	"flag"
 	"time"
 	"os"
+	"strings"
 )
 
 func main() {
@@ -18,38 +19,60 @@ func main() {
 	if cmdHelp {
 		Help()
 	}
+	geodesy = GeodesyModel(cmdModel)
+	pathModel = PathModelByName(cmdPathModel)
+	if len(cmdGeo) > 0 {
+		GeoCommand(cmdGeo, flag.Args())
+		os.Exit(0)
+	}
 	datapath := GetDataPath()
 	if cmdDownload {
-		Download(datapath)
+		Download(datapath, cmdRefresh)
 	}
 	var locs Locations
 	nativepath := GetLocationCSVPath(datapath)
 	finfo, err := os.Stat(nativepath)
 	removeRedundancies := true
-	if !cmdMake && !cmdRaw && (!os.IsNotExist(err) && !finfo.IsDir()) {
+	native := !cmdMake && !cmdRaw && (!os.IsNotExist(err) && !finfo.IsDir())
+	if native {
+		if unmet := UnmetNativeSettings(nativepath, GivenFlags()); len(unmet) > 0 {
+			Println("%s was not made with %s, so loading locations from " +
+				"the sources, use -m to remake it", nativepath,
+				strings.Join(unmet, " "))
+			native = false
+		}
+	}
+	if native {
 		Println("Reading native csv file for locations")
 		locs = ReadNativeLocationsFile(nativepath)
 		removeRedundancies = false
 	} else {
-		locs = LoadLocationData(datapath)
+		locs = LoadLocationData(datapath, strings.Split(cmdSources, ","))
 	}
 
 	if cmdRaw {
 		if len(cmdFind) > 0 {
 			locs.PrintLabelMatchedLocations(cmdFind)
 		} else if len(cmdNear) > 0 {
-			locs.PrintNearbyLocations(cmdNear, cmdDelta)
+			locs.PrintNearby(cmdNear)
 		}
 	}
 
 	if removeRedundancies {
+		sources := strings.Split(cmdSources, ",")
+		if len(sources) > 1 {
+			var conflicts MergeConflicts
+			locs, conflicts = locs.Merge(
+				NewMergePolicy(sources, cmdPrefer, cmdConflict))
+			conflicts.WriteToFile(GetMergeConflictsPath(datapath))
+		}
 		locs = locs.RemoveRedundant(1000) // half-length of square in m
 	}
 
 	if len(cmdFind) > 0 {
 		locs.PrintLabelMatchedLocations(cmdFind)
 	} else if len(cmdNear) > 0 {
-		locs.PrintNearbyLocations(cmdNear, cmdDelta)
+		locs.PrintNearby(cmdNear)
 	}
 	if cmdMake {
 		locs.WriteToNativeCSV(datapath)
@@ -65,8 +88,24 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(cmdDR) > 0 {
+		locs.PrintDeadReckoning(cmdDR, cmdDRHeading, cmdDRLength, cmdDRWidth)
+		os.Exit(0)
+	}
+
+	scenario := DefaultScenario()
+	if len(cmdScenario) > 0 {
+		scenario = ReadScenarioFile(cmdScenario)
+	}
+
+	if len(cmdRoute) > 0 {
+		locs.FindRoutes(cmdRoute, cmdVia, cmdNearest, cmdLeg, cmdViaDelta,
+			locs.MakeTimeline(scenario), datapath)
+		os.Exit(0)
+	}
+
 	// Make filters before we cull locations that aren't waypoints or airports
-	filters := locs.MakeUserFilters()
+	filters := locs.MakeUserFilters(scenario, datapath)
 
 	// Only use waypoints and airports for further calcs... 
 	var locs2 Locations
@@ -88,8 +127,21 @@ func main() {
 	Println("%d locations chosen", len(chosen))
 	Println("%d great circles from chosen", maxPairs(0,len(chosen)-1))
 	t0 := time.Now()
-	within := chosen.FindPairsPassingWithinRadius(filters)
+	var within []Flyby
+	if scenario.Pairs == "airways" {
+		airways := LoadAirways(datapath, chosen)
+		graph := chosen.BuildRouteGraph(
+			airways, scenario.Directmax, scenario.Level)
+		within = graph.FindFlybys(filters)
+	} else {
+		within = chosen.FindPairsPassingWithinRadius(filters)
+	}
 	t1 := time.Now()
 	Println("Found %d pairs fitting criteria in %v", len(within), t1.Sub(t0))
+	if scenario.Scoring != nil {
+		RankFlybys(within)
+		PrintTopFlybys(within, SCORE_PRINT_TOP)
+	}
 	WriteFlybysToFile(datapath, within)
+	WriteScenarioFile(datapath, scenario)
 }
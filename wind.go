@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	. "math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Wind over the area searched, as the velocity in km/h of the air, east and
+// north, towards which it blows.
+type WindField interface {
+	At(loc Location) (float64, float64)
+}
+
+// The same wind everywhere.
+type ConstantWind struct {
+	East, North	float64
+}
+
+// Wind given on a regular grid of latitudes and longitudes, interpolated
+// bilinearly between them, and taken from the nearest edge outside.  A grid
+// may cross the antimeridian, or go all the way round.
+type WindGrid struct {
+	Lats, Longs	[]float64 // deg, ascending, beyond 180 across the antimeridian
+	East, North	[][]float64 // km/h, by lat then long
+}
+
+// Wind at an observer, the headings seen there and the airspeeds allowed,
+// which together give the tracks over the ground the aircraft could have
+// been making good.
+type Drift struct {
+	Heading		[]float64 // true headings, deg, first clockwise to second
+	Airspeed	[]float64 // km/h, min and max
+	East, North	float64 // km/h
+}
+
+// Step in deg between headings tried when finding the tracks a range of
+// them gives.
+const DRIFT_HEADING_STEP float64 = 0.1
+
+// Velocity of a wind blowing from direction deg at speed km/h, as east and
+// north components of where it blows to.
+func WindVector(direction, speed float64) (float64, float64) {
+	return -speed*Sin(DegToRad(direction)), -speed*Cos(DegToRad(direction))
+}
+
+func (cw ConstantWind) At(loc Location) (float64, float64) {
+	return cw.East, cw.North
+}
+
+// Index below x in xs and the fraction of the way to the next, clamped to
+// the ends.
+func gridPosition(xs []float64, x float64) (int, float64) {
+	if len(xs) == 1 || x <= xs[0] {
+		return 0, 0.0
+	}
+	if x >= xs[len(xs)-1] {
+		return len(xs) - 2, 1.0
+	}
+	i := sort.SearchFloat64s(xs, x) - 1
+	return i, (x - xs[i])/(xs[i+1] - xs[i])
+}
+
+// Longitudes in deg, sorted, turned to start after the widest gap between
+// them if that is not across the antimeridian, and ascending from there
+// beyond 180, so that a grid across the antimeridian is in one piece.
+func unwrapLongitudes(longs []float64) []float64 {
+	n := len(longs)
+	start, widest := 0, longs[0] + 360.0 - longs[n-1]
+	for j := 1; j < n && longs[n-1] - longs[0] < 360.0; j++ {
+		if gap := longs[j] - longs[j-1]; gap > widest {
+			start, widest = j, gap
+		}
+	}
+	result := []float64{}
+	for k := 0; k < n; k++ {
+		long := longs[(start + k) % n]
+		if k > 0 && long < result[k-1] {
+			long += 360.0
+		}
+		result = append(result, long)
+	}
+	return result
+}
+
+// Longitude in deg turned to lie from the first of the grid's longitudes to
+// 360 beyond it, unless already within the grid.
+func (wg WindGrid) unwrap(long float64) float64 {
+	for long < wg.Longs[0] {
+		long += 360.0
+	}
+	for long > wg.Longs[len(wg.Longs)-1] && long - 360.0 >= wg.Longs[0] {
+		long -= 360.0
+	}
+	return long
+}
+
+// Indices of the grid's longitudes either side of long, and the fraction of
+// the way from the first to the second.  Beyond the last, a grid going all
+// the way round, with no wider gap back to the first than between any two,
+// is interpolated across that gap, and otherwise the nearer edge is taken.
+func (wg WindGrid) longPosition(long float64) (int, int, float64) {
+	long = wg.unwrap(long)
+	n := len(wg.Longs)
+	if n == 1 {
+		return 0, 0, 0.0
+	}
+	if long <= wg.Longs[n-1] {
+		j, fj := gridPosition(wg.Longs, long)
+		return j, j + 1, fj
+	}
+	gap, widest := wg.Longs[0] + 360.0 - wg.Longs[n-1], 0.0
+	for j := 1; j < n; j++ {
+		widest = Max(widest, wg.Longs[j] - wg.Longs[j-1])
+	}
+	if gap <= widest + 1e-9 {
+		return n - 1, 0, (long - wg.Longs[n-1])/gap
+	}
+	if long - wg.Longs[n-1] <= gap/2.0 {
+		return n - 1, n - 1, 0.0
+	}
+	return 0, 0, 0.0
+}
+
+func (wg WindGrid) At(loc Location) (float64, float64) {
+	i, fi := gridPosition(wg.Lats, loc.Lat)
+	i2 := i
+	if i + 1 < len(wg.Lats) {
+		i2 = i + 1
+	}
+	j, j2, fj := wg.longPosition(loc.Long)
+	at := func(grid [][]float64) float64 {
+		return (1 - fi)*((1 - fj)*grid[i][j] + fj*grid[i][j2]) +
+			fi*((1 - fj)*grid[i2][j] + fj*grid[i2][j2])
+	}
+	return at(wg.East), at(wg.North)
+}
+
+// Read a wind grid from a csv file of lat, long, direction the wind blows
+// from in deg and speed in km/h, one line for each point of the grid, with
+// lines starting # ignored.
+func ReadWindGridFile(path string) WindGrid {
+	file, err := os.Open(path)
+	ifError(err)
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+	lines, err := reader.ReadAll()
+	if err != nil {
+		Fatal("Could not read wind grid %s: %v", path, err)
+	}
+	type point struct {
+		lat, long, east, north	float64
+	}
+	points := []point{}
+	latSet, longSet := map[float64]bool{}, map[float64]bool{}
+	for _, line := range lines {
+		x := make([]float64, 4)
+		for k, field := range line {
+			x[k], err = strconv.ParseFloat(field, 64)
+			if err != nil {
+				Fatal("Wind grid %s has %q, not a number", path, field)
+			}
+		}
+		east, north := WindVector(x[2], x[3])
+		points = append(points, point{x[0], x[1], east, north})
+		latSet[x[0]], longSet[x[1]] = true, true
+	}
+	wg := WindGrid{}
+	for lat := range latSet {
+		wg.Lats = append(wg.Lats, lat)
+	}
+	for long := range longSet {
+		wg.Longs = append(wg.Longs, long)
+	}
+	sort.Float64s(wg.Lats)
+	sort.Float64s(wg.Longs)
+	if len(wg.Longs) > 0 {
+		wg.Longs = unwrapLongitudes(wg.Longs)
+	}
+	if len(points) == 0 || len(points) != len(wg.Lats)*len(wg.Longs) {
+		Fatal("Wind grid %s has %d points, not one for each of %d lats " +
+			"and %d longs", path, len(points), len(wg.Lats), len(wg.Longs))
+	}
+	wg.East = make([][]float64, len(wg.Lats))
+	wg.North = make([][]float64, len(wg.Lats))
+	for i := range wg.Lats {
+		wg.East[i] = make([]float64, len(wg.Longs))
+		wg.North[i] = make([]float64, len(wg.Longs))
+	}
+	for _, p := range points {
+		i := sort.SearchFloat64s(wg.Lats, p.lat)
+		j := sort.SearchFloat64s(wg.Longs, wg.unwrap(p.long))
+		wg.East[i][j], wg.North[i][j] = p.east, p.north
+	}
+	return wg
+}
+
+// The wind field given by the scenario, with its grid file if any in the
+// data directory.
+func (spec WindSpec) Field(datapath string) WindField {
+	if len(spec.File) > 0 {
+		return ReadWindGridFile(filepath.Join(datapath, spec.File))
+	}
+	east, north := WindVector(spec.Direction, spec.Speed)
+	return ConstantWind{East: east, North: north}
+}
+
+// Course in deg of the velocity east, north.
+func velocityCourse(east, north float64) float64 {
+	return normalizeAzimuth(RadToDeg(Atan2(east, north)))
+}
+
+// Range of tracks made good, as true courses in deg from the first clockwise
+// to the second, flying any heading and airspeed allowed.  If the wind can
+// be as strong as the aircraft is slow, any track is possible.
+func (d Drift) Tracks() []float64 {
+	span := CourseSpan(d.Heading[0], d.Heading[1])
+	wind := Hypot(d.East, d.North)
+	if wind >= d.Airspeed[0] && wind <= d.Airspeed[1] &&
+		InCourseRange(velocityCourse(-d.East, -d.North),
+			d.Heading[0], d.Heading[1]) {
+		return []float64{0.0, 360.0}
+	}
+	// Tracks lie between those at the ends of the headings and at the ends
+	// of the airspeeds, and are measured from one in the middle
+	ref := d.track(d.Heading[0] + span/2.0,
+		(d.Airspeed[0] + d.Airspeed[1])/2.0)
+	lo, hi := 0.0, 0.0
+	n := int(Ceil(span/DRIFT_HEADING_STEP))
+	for k := 0; k <= n; k++ {
+		h := d.Heading[0] + span*float64(k)/float64(Max(1.0, float64(n)))
+		for _, v := range d.Airspeed {
+			dev := Remainder(d.track(h, v) - ref, 360.0)
+			lo, hi = Min(lo, dev), Max(hi, dev)
+		}
+	}
+	if hi - lo >= 360.0 - 2.0*DRIFT_HEADING_STEP {
+		return []float64{0.0, 360.0}
+	}
+	// A little wider, for the steps between headings
+	tracks := WidenCourseRange([]float64{normalizeAzimuth(ref + lo),
+		normalizeAzimuth(ref + hi)}, DRIFT_HEADING_STEP)
+	if tracks[1] - tracks[0] >= 360.0 {
+		return tracks
+	}
+	return []float64{normalizeAzimuth(tracks[0]), normalizeAzimuth(tracks[1])}
+}
+
+func (d Drift) track(heading, airspeed float64) float64 {
+	h := DegToRad(heading)
+	return velocityCourse(airspeed*Sin(h) + d.East, airspeed*Cos(h) + d.North)
+}
+
+// Solve the wind triangle for a track in deg: the crab angle in deg, being
+// the heading less the track, and ground speed in km/h, for a heading and
+// airspeed within range.  False if none holds the track.  Where several do,
+// the crab angle is that in the middle of those that do.
+func (d Drift) Solve(track float64) (float64, float64, bool) {
+	t := DegToRad(track)
+	// Wind across the track, to the right, and along it
+	cross := d.East*Cos(t) - d.North*Sin(t)
+	along := d.East*Sin(t) + d.North*Cos(t)
+	// The airspeed needed across the track makes the crab angle
+	vlo := Max(d.Airspeed[0], Abs(cross))
+	if vlo > d.Airspeed[1] {
+		return 0, 0, false
+	}
+	c1 := RadToDeg(Asin(-cross/d.Airspeed[1]))
+	c2 := RadToDeg(Asin(-cross/vlo))
+	clo, chi := Min(c1, c2), Max(c1, c2)
+	// Crab angles the headings allow, which may be either side of -180
+	hlo := Remainder(d.Heading[0] - track, 360.0)
+	span := CourseSpan(d.Heading[0], d.Heading[1])
+	for _, base := range []float64{hlo, hlo - 360.0, hlo + 360.0} {
+		lo, hi := Max(clo, base), Min(chi, base + span)
+		if lo > hi + 1e-9 {
+			continue
+		}
+		crab := (lo + hi)/2.0
+		v := (d.Airspeed[0] + d.Airspeed[1])/2.0
+		if Abs(cross) > 1e-9 {
+			v = -cross/Sin(DegToRad(crab))
+		}
+		gs := v*Cos(DegToRad(crab)) + along
+		if gs <= 0 {
+			return 0, 0, false
+		}
+		return crab, gs, true
+	}
+	return 0, 0, false
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("headings %.1f to %.1f deg at %.0f to %.0f km/h, " +
+		"wind %.0f km/h from %.0f deg", d.Heading[0], d.Heading[1],
+		d.Airspeed[0], d.Airspeed[1], Hypot(d.East, d.North),
+		velocityCourse(-d.East, -d.North))
+}
@@ -0,0 +1,288 @@
+/*
+	Read X-Plane navigation data in its public text formats:
+	earth_fix.dat, earth_nav.dat and apt.dat, found in the data directory.
+	Each file starts with "I" or "A", then a version line, and ends with 99.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// earth_nav.dat row codes
+var XPLANE_NAV_KIND map[int]string = map[int]string{
+	2:	"NDB",
+	3:	"VOR",
+	4:	"ILS",
+	5:	"LOC",
+	6:	"GS",
+	7:	"OM",
+	8:	"MM",
+	9:	"IM",
+	12:	"DME",
+	13:	"DME",
+}
+
+// apt.dat header row codes
+var XPLANE_APT_KIND map[string]string = map[string]string{
+	"1":	"Airport",
+	"16":	"Seaplane base",
+	"17":	"Heliport",
+}
+
+// Load every X-Plane file present in the data directory.
+func LoadXPlaneData(datapath string) Locations {
+	locs := Locations([]Location{})
+	found := false
+	for _, name := range []string{
+		XPLANE_FIX_NAME, XPLANE_NAV_NAME, XPLANE_APT_NAME,
+	} {
+		path := filepath.Join(datapath, name)
+		if !fileExists(path) {
+			continue
+		}
+		found = true
+		var locs2 Locations
+		switch name {
+			case XPLANE_FIX_NAME: locs2 = ReadXPlaneFixes(path)
+			case XPLANE_NAV_NAME: locs2 = ReadXPlaneNavaids(path)
+			case XPLANE_APT_NAME: locs2 = ReadXPlaneAirports(path)
+		}
+		Println("Parsed %d locations in %s", len(locs2), path)
+		locs = append(locs, locs2...)
+	}
+	if !found {
+		Fatal("None of %s, %s or %s found in %s",
+			XPLANE_FIX_NAME, XPLANE_NAV_NAME, XPLANE_APT_NAME, datapath)
+	}
+	return locs
+}
+
+// Data rows as fields, with the file and version headers removed, up to the
+// 99 terminator.  Also returns the version, e.g. 1100.
+func readXPlaneRows(fpath string) ([][]string, int) {
+	byts, err := ioutil.ReadFile(fpath)
+	ifError(err)
+	lines := strings.Split(string(byts), "\n")
+	if len(lines) < 2 {
+		Fatal("%s is too short to be an X-Plane file", fpath)
+	}
+	origin := strings.TrimSpace(lines[0])
+	if origin != "I" && origin != "A" {
+		Fatal("%s does not start with I or A", fpath)
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) == 0 {
+		Fatal("%s has no version line", fpath)
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		Fatal("%s has bad version %q", fpath, fields[0])
+	}
+	rows := [][]string{}
+	for _, line := range lines[2:] {
+		fields = strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "99" {
+			break
+		}
+		rows = append(rows, fields)
+	}
+	return rows, version
+}
+
+func parseXPlaneFloat(fpath, txt string) float64 {
+	result, err := strconv.ParseFloat(txt, 64)
+	if err != nil {
+		Fatal("%s: bad number %q", fpath, txt)
+	}
+	return result
+}
+
+// Rows "lat long ident", followed from version 1101 by the terminal
+// airport or ENRT, and ICAO region.
+func ReadXPlaneFixes(fpath string) Locations {
+	rows, version := readXPlaneRows(fpath)
+	result := Locations([]Location{})
+	for _, fields := range rows {
+		if len(fields) < 3 {
+			Fatal("%s: short fix row %v", fpath, fields)
+		}
+		loc := Location{
+			Type:		LOCTYPE["Waypoint"].Tag,
+			Kind:		"Fix",
+			Lat:		parseXPlaneFloat(fpath, fields[0]),
+			Long:		parseXPlaneFloat(fpath, fields[1]),
+			ICAOcode:	fields[2],
+		}
+		if version >= 1101 && len(fields) >= 5 {
+			if fields[3] != "ENRT" {
+				loc.Control = ARINC_LEVEL["T"]
+			}
+			loc.Region = fields[4]
+		}
+		result = append(result, loc)
+	}
+	return result
+}
+
+// Rows "code lat long elev freq range extra ident", then from version 1100
+// terminal airport or ENRT and ICAO region, then the name.
+func ReadXPlaneNavaids(fpath string) Locations {
+	rows, version := readXPlaneRows(fpath)
+	result := Locations([]Location{})
+	for _, fields := range rows {
+		code, err := strconv.Atoi(fields[0])
+		kind, known := XPLANE_NAV_KIND[code]
+		if err != nil || !known {
+			continue
+		}
+		nname := 8
+		if version >= 1100 {
+			nname = 10
+		}
+		if len(fields) < nname {
+			Fatal("%s: short navaid row %v", fpath, fields)
+		}
+		freq := parseXPlaneFloat(fpath, fields[4])
+		if code != 2 {
+			freq *= 10.0 // MHz/100 -> kHz
+		}
+		loc := Location{
+			Type:		LOCTYPE["Waypoint"].Tag,
+			Kind:		kind,
+			Lat:		parseXPlaneFloat(fpath, fields[1]),
+			Long:		parseXPlaneFloat(fpath, fields[2]),
+			Elevation:	parseXPlaneFloat(fpath, fields[3]),
+			Frequency:	freq,
+			ICAOcode:	fields[7],
+			Name:		strings.Join(fields[nname:], " "),
+		}
+		if version >= 1100 {
+			loc.Region = fields[9]
+		}
+		// Names end with the type, e.g. "MALE VOR-DME"
+		if code == 3 || code == 12 {
+			parts := strings.Fields(loc.Name)
+			if n := len(parts); n > 1 {
+				switch parts[n-1] {
+					case "VOR-DME", "VORTAC", "TACAN", "VOR":
+						loc.Kind = parts[n-1]
+				}
+			}
+		}
+		result = append(result, loc)
+	}
+	return result
+}
+
+// Airport, seaplane base and heliport header rows, "code elev - - ident name".
+// The position comes from the 1302 datum_lat and datum_lon metadata where
+// given, otherwise from the middle of the first runway, water runway or
+// helipad.
+func ReadXPlaneAirports(fpath string) Locations {
+	rows, _ := readXPlaneRows(fpath)
+	result := Locations([]Location{})
+	var loc *Location
+	located := false
+	var datumLat, datumLong string
+	flush := func() {
+		if loc == nil {
+			return
+		}
+		if len(datumLat) > 0 && len(datumLong) > 0 {
+			loc.Lat = parseXPlaneFloat(fpath, datumLat)
+			loc.Long = parseXPlaneFloat(fpath, datumLong)
+			located = true
+		}
+		if located {
+			result = append(result, *loc)
+		} else {
+			Println("%s: no position for airport %s", fpath, loc.ICAOcode)
+		}
+		loc = nil
+		return
+	}
+	for _, fields := range rows {
+		if kind, ok := XPLANE_APT_KIND[fields[0]]; ok {
+			flush()
+			if len(fields) < 6 {
+				Fatal("%s: short airport row %v", fpath, fields)
+			}
+			loc = &Location{
+				Type:		LOCTYPE["Airport"].Tag,
+				Kind:		kind,
+				Elevation:	parseXPlaneFloat(fpath, fields[1]),
+				ICAOcode:	fields[4],
+				Name:		strings.Join(fields[5:], " "),
+			}
+			located = false
+			datumLat, datumLong = "", ""
+			continue
+		}
+		if loc == nil {
+			continue
+		}
+		switch fields[0] {
+			case "100": // land runway, ends at fields 9,10 and 18,19
+				if !located && len(fields) >= 20 {
+					loc.Lat, loc.Long = xplaneMidpoint(fpath,
+						fields[9], fields[10], fields[18], fields[19])
+					located = true
+				}
+			case "101": // water runway, ends at fields 4,5 and 7,8
+				if !located && len(fields) >= 9 {
+					loc.Lat, loc.Long = xplaneMidpoint(fpath,
+						fields[4], fields[5], fields[7], fields[8])
+					located = true
+				}
+			case "102": // helipad
+				if !located && len(fields) >= 4 {
+					loc.Lat = parseXPlaneFloat(fpath, fields[2])
+					loc.Long = parseXPlaneFloat(fpath, fields[3])
+					located = true
+				}
+			case "1302":
+				if len(fields) >= 3 {
+					value := strings.Join(fields[2:], " ")
+					switch fields[1] {
+						case "datum_lat": datumLat = value
+						case "datum_lon": datumLong = value
+						case "iata_code": loc.IATAcode = value
+						case "faa_code": loc.FAAcode = value
+						case "icao_code": loc.ICAOcode = value
+						case "country": loc.Country = value
+						case "city": loc.Desc = value
+						case "state": loc.State = value
+						case "region_code": loc.Region = value
+					}
+				}
+		}
+	}
+	flush()
+	return result
+}
+
+// Midpoint of a runway from its ends, the longitudes averaged the short way
+// round, so that a runway across the antimeridian stays there.
+func xplaneMidpoint(fpath, lat1, long1, lat2, long2 string) (float64, float64) {
+	x1, x2 := parseXPlaneFloat(fpath, long1), parseXPlaneFloat(fpath, long2)
+	if x2 - x1 > 180.0 {
+		x2 -= 360.0
+	} else if x2 - x1 < -180.0 {
+		x2 += 360.0
+	}
+	long := (x1 + x2)/2.0
+	if long > 180.0 {
+		long -= 360.0
+	} else if long < -180.0 {
+		long += 360.0
+	}
+	return (parseXPlaneFloat(fpath, lat1) + parseXPlaneFloat(fpath, lat2))/2.0,
+		long
+}